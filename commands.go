@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/medallia/cnm-routed-plugin/routed"
+	"github.com/urfave/cli"
+)
+
+// Shown length of endpoint and network IDs, as docker does
+const shortID = 12
+
+var clientFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "admin-socket",
+		Value: routed.DefaultAdminSocket,
+		Usage: "unix socket path of the admin API of the running plugin",
+	},
+	cli.BoolFlag{
+		Name:  "json",
+		Usage: "print JSON instead of tables",
+	},
+}
+
+var commands = []cli.Command{
+	{
+		Name:   "status",
+		Usage:  "summarize the pools and endpoints of the running plugin",
+		Flags:  clientFlags,
+		Action: statusCommand,
+	},
+	{
+		Name:   "endpoints",
+		Usage:  "list the endpoints with their addresses and veths",
+		Flags:  clientFlags,
+		Action: endpointsCommand,
+	},
+	{
+		Name:      "release",
+		Usage:     "free an address leaked by Docker",
+		ArgsUsage: "<ip>",
+		Flags:     clientFlags,
+		Action:    releaseCommand,
+	},
+	{
+		Name:   "gc",
+		Usage:  "remove veths, routes and iptables chains and rules left by deleted endpoints",
+		Flags:  clientFlags,
+		Action: gcCommand,
+	},
+	{
+		Name:  "doctor",
+		Usage: "check that this host can run routed networks",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "gateway, g",
+				Usage: "gateway the plugin is started with",
+			},
+			cli.StringFlag{
+				Name:  "gateway-mode",
+				Value: routed.GatewayProxyArp,
+				Usage: "gateway mode the plugin is started with",
+			},
+			cli.BoolFlag{
+				Name:  "json",
+				Usage: "print JSON instead of tables",
+			},
+		},
+		Action: doctorCommand,
+	},
+	{
+		Name:      "trace",
+		Usage:     "show the route, interface and filtering rules traffic to an address goes through",
+		ArgsUsage: "<ip>",
+		Flags: append([]cli.Flag{
+			cli.StringFlag{
+				Name:  "from, f",
+				Usage: "source address of the traffic",
+			},
+			cli.StringFlag{
+				Name:  "proto, p",
+				Value: "tcp",
+				Usage: "protocol of the traffic",
+			},
+			cli.IntFlag{
+				Name:  "port",
+				Usage: "destination port of the traffic",
+			},
+		}, clientFlags...),
+		Action: traceCommand,
+	},
+	{
+		Name:  "policy",
+		Usage: "change the policies of an endpoint",
+		Subcommands: []cli.Command{
+			{
+				Name:      "set",
+				Usage:     "set the sources allowed to reach an endpoint, or allow all when none is given",
+				ArgsUsage: "<endpoint> [<ip|cidr|range>,...]",
+				Flags:     clientFlags,
+				Action:    policySetCommand,
+			},
+		},
+	},
+}
+
+func short(id string) string {
+	if len(id) > shortID {
+		return id[:shortID]
+	}
+	return id
+}
+
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// commandError makes cli exit with a non zero status.
+func commandError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return cli.NewExitError(err.Error(), 1)
+}
+
+// resolveEndpoint returns the endpoint whose ID starts with prefix.
+func resolveEndpoint(client *routed.AdminClient, prefix string) (string, error) {
+	networks, err := client.Networks()
+	if err != nil {
+		return "", err
+	}
+	var found []string
+	for _, n := range networks {
+		for _, ep := range n.Endpoints {
+			if strings.HasPrefix(ep.ID, prefix) {
+				found = append(found, ep.ID)
+			}
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("No endpoint %s", prefix)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("Endpoint %s is ambiguous", prefix)
+}
+
+func statusCommand(c *cli.Context) error {
+	client := routed.NewAdminClient(c.String("admin-socket"))
+	pools, err := client.Pools()
+	if err != nil {
+		return commandError(err)
+	}
+	networks, err := client.Networks()
+	if err != nil {
+		return commandError(err)
+	}
+
+	if c.Bool("json") {
+		return commandError(printJSON(map[string]interface{}{"pools": pools, "networks": networks}))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "POOL\tSUBNET\tGATEWAY\tAGGREGATE\tALLOCATED")
+	for _, p := range pools {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", p.ID, p.Subnet, p.Gateway, p.Aggregate, len(p.Allocated))
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "NETWORK\tGATEWAY\tMODE\tMTU\tENDPOINTS\tROUTES")
+	for _, n := range networks {
+		states := make(map[string]int)
+		var order []string
+		for _, ep := range n.Endpoints {
+			if states[ep.RouteState] == 0 {
+				order = append(order, ep.RouteState)
+			}
+			states[ep.RouteState]++
+		}
+		var routes []string
+		for _, state := range order {
+			routes = append(routes, fmt.Sprintf("%d %s", states[state], state))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", short(n.ID), n.Gateway, n.GatewayMode, n.MTU, len(n.Endpoints), strings.Join(routes, ", "))
+	}
+	return commandError(w.Flush())
+}
+
+func endpointsCommand(c *cli.Context) error {
+	client := routed.NewAdminClient(c.String("admin-socket"))
+	networks, err := client.Networks()
+	if err != nil {
+		return commandError(err)
+	}
+
+	endpoints := []routed.EndpointState{}
+	for _, n := range networks {
+		endpoints = append(endpoints, n.Endpoints...)
+	}
+	if c.Bool("json") {
+		return commandError(printJSON(endpoints))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ENDPOINT\tADDRESS\tMAC\tHOST VETH\tCONTAINER VETH\tROUTE\tFILTERING\tQOS")
+	for _, ep := range endpoints {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", short(ep.ID), ep.Address, ep.MacAddress,
+			ep.HostInterface, ep.ContainerInterface, ep.RouteState, ep.Filtering, ep.Qos)
+	}
+	return commandError(w.Flush())
+}
+
+func releaseCommand(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return commandError(fmt.Errorf("Usage: %s release <ip>", c.App.Name))
+	}
+	address := c.Args().First()
+	client := routed.NewAdminClient(c.String("admin-socket"))
+	if err := client.Release(address); err != nil {
+		return commandError(err)
+	}
+	if c.Bool("json") {
+		return commandError(printJSON(map[string]string{"released": address}))
+	}
+	fmt.Printf("Released %s\n", address)
+	return nil
+}
+
+func gcCommand(c *cli.Context) error {
+	client := routed.NewAdminClient(c.String("admin-socket"))
+	report, err := client.CollectGarbage()
+	if err != nil {
+		return commandError(err)
+	}
+	if c.Bool("json") {
+		return commandError(printJSON(report))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "REMOVED\tNAME")
+	for _, removed := range []struct {
+		kind  string
+		names []string
+	}{
+		{"link", report.Links},
+		{"route", report.Routes},
+		{"chain", report.Chains},
+		{"rule", report.Rules},
+	} {
+		for _, name := range removed.names {
+			fmt.Fprintf(w, "%s\t%s\n", removed.kind, name)
+		}
+	}
+	w.Flush()
+
+	if len(report.Errors) > 0 {
+		return commandError(fmt.Errorf("Some garbage couldn't be removed:\n%s", strings.Join(report.Errors, "\n")))
+	}
+	return nil
+}
+
+func policySetCommand(c *cli.Context) error {
+	if c.NArg() < 1 || c.NArg() > 2 {
+		return commandError(fmt.Errorf("Usage: %s policy set <endpoint> [<ip|cidr|range>,...]", c.App.Name))
+	}
+	client := routed.NewAdminClient(c.String("admin-socket"))
+	eid, err := resolveEndpoint(client, c.Args().Get(0))
+	if err != nil {
+		return commandError(err)
+	}
+	allowed := c.Args().Get(1)
+	if err := client.SetPolicy(eid, allowed); err != nil {
+		return commandError(err)
+	}
+
+	if c.Bool("json") {
+		return commandError(printJSON(map[string]string{"endpoint": eid, "ingress_allowed": allowed}))
+	}
+	if allowed == "" {
+		fmt.Printf("Endpoint %s accepts traffic from any source\n", short(eid))
+	} else {
+		fmt.Printf("Endpoint %s accepts traffic from %s\n", short(eid), allowed)
+	}
+	return nil
+}
+
+func doctorCommand(c *cli.Context) error {
+	gateway := c.String("gateway")
+	if gateway == "" && c.String("gateway-mode") == routed.GatewayLinkLocal {
+		gateway = routed.LinkLocalGateway
+	}
+	results := routed.NewDoctor(gateway, c.String("gateway-mode")).Run()
+	healthy := routed.Healthy(results)
+
+	if c.Bool("json") {
+		if err := printJSON(map[string]interface{}{"healthy": healthy, "checks": results}); err != nil {
+			return commandError(err)
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "STATUS\tCHECK\tDETAIL")
+		for _, r := range results {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", strings.ToUpper(r.Status), r.Name, r.Detail)
+			if r.Fix != "" {
+				fmt.Fprintf(w, "\t\tfix: %s\n", r.Fix)
+			}
+		}
+		w.Flush()
+	}
+
+	if !healthy {
+		return cli.NewExitError("This host can't run routed networks", 1)
+	}
+	return nil
+}
+
+func traceCommand(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return commandError(fmt.Errorf("Usage: %s trace [--from <ip>] [--proto <proto>] [--port <port>] <ip>", c.App.Name))
+	}
+	dst := net.ParseIP(c.Args().First())
+	if dst == nil {
+		return commandError(fmt.Errorf("Invalid address %s", c.Args().First()))
+	}
+	var src net.IP
+	if from := c.String("from"); from != "" {
+		if src = net.ParseIP(from); src == nil {
+			return commandError(fmt.Errorf("Invalid source address %s", from))
+		}
+	}
+
+	tracer := routed.NewTracer(routed.NewAdminClient(c.String("admin-socket")))
+	report, err := tracer.Trace(dst, src, c.String("proto"), c.Int("port"))
+	if err != nil {
+		return commandError(err)
+	}
+	if c.Bool("json") {
+		return commandError(printJSON(report))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	endpoint := "none"
+	if ep := report.Endpoint; ep != nil {
+		endpoint = fmt.Sprintf("%s (%s, route %s)", short(ep.ID), ep.HostInterface, ep.RouteState)
+	}
+	fmt.Fprintf(w, "Endpoint:\t%s\n", endpoint)
+	fmt.Fprintf(w, "Route:\t%s\n", report.Route)
+	fmt.Fprintf(w, "Interface:\t%s %s\n", report.Interface, report.InterfaceState)
+	fmt.Fprintf(w, "Origin:\t%s\n", report.Origin)
+	if report.Verdict != "" {
+		fmt.Fprintf(w, "Filtering:\t%s\n", report.Verdict)
+		for _, rule := range report.Rules {
+			fmt.Fprintf(w, "\t  %s\n", rule)
+		}
+	}
+	if report.Endpoint != nil {
+		fmt.Fprintf(w, "Container routes:\t%s\n", strings.Join(report.ContainerRoutes, "\n\t"))
+	}
+	w.Flush()
+
+	for _, note := range report.Notes {
+		fmt.Printf("note: %s\n", note)
+	}
+	for _, problem := range report.Problems {
+		fmt.Printf("problem: %s\n", problem)
+	}
+	if len(report.Problems) > 0 {
+		return cli.NewExitError(fmt.Sprintf("Traffic to %s can't get through", dst), 1)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/medallia/cnm-routed-plugin/routed"
+	"github.com/urfave/cli"
+)
+
+// configFile is the configuration file given with --config, applied to the
+// flags not set on the command line.
+type configFile struct {
+	path   string
+	config *routed.Config
+	// Flags set on the command line, which the file doesn't change
+	explicit map[string]bool
+	// Values of the reloaded flags when the file doesn't set them
+	base  map[string]string
+	debug bool
+}
+
+// loadConfigFile reads the configuration file, if any, and gives its values
+// to the flags.
+func loadConfigFile(c *cli.Context) (*configFile, error) {
+	f := &configFile{
+		path:     c.String("config"),
+		config:   &routed.Config{},
+		explicit: make(map[string]bool),
+		base:     make(map[string]string),
+		debug:    c.Bool("debug"),
+	}
+	for _, name := range c.FlagNames() {
+		f.explicit[name] = c.IsSet(name)
+	}
+	for _, name := range routed.ReloadedFlags {
+		f.base[name] = c.String(name)
+	}
+	if f.path == "" {
+		return f, nil
+	}
+
+	config, err := routed.LoadConfig(f.path)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range config.Flags {
+		if f.explicit[name] {
+			log.Infof("loadConfigFile: --%s on the command line overrides %s", name, f.path)
+			continue
+		}
+		if err := c.Set(name, value); err != nil {
+			return nil, fmt.Errorf("Invalid %s %s in %s: %v", name, value, f.path, err)
+		}
+	}
+	f.config = config
+	return f, nil
+}
+
+// isSet reports whether a flag was set on the command line or in the file.
+func (f *configFile) isSet(name string) bool {
+	_, ok := f.config.Flags[name]
+	return f.explicit[name] || ok
+}
+
+// value returns the value of a reloaded flag.
+func (f *configFile) value(name string) string {
+	if value, ok := f.config.Flags[name]; ok && !f.explicit[name] {
+		return value
+	}
+	return f.base[name]
+}
+
+// apply sets the settings of the file that can change while running.
+func (f *configFile) apply(nd *routed.NetDriver) error {
+	if err := setLogLevel(f.value("log-level"), f.debug); err != nil {
+		return err
+	}
+	if err := nd.SetRouteGuard(f.value("allowed-routes"), f.value("denied-routes")); err != nil {
+		return err
+	}
+	if err := nd.SetNetworkProfiles(f.config.Networks); err != nil {
+		return err
+	}
+	return nd.SetDefaultPolicy(f.value("ingress-allowed"))
+}
+
+// reload reads the file again and applies the settings that can change
+// while running. The previous settings stay when the file is invalid.
+func (f *configFile) reload(nd *routed.NetDriver) error {
+	if f.path == "" {
+		return fmt.Errorf("No configuration file to reload")
+	}
+	config, err := routed.LoadConfig(f.path)
+	if err != nil {
+		return err
+	}
+	previous := f.config
+	f.config = config
+	if err := f.apply(nd); err != nil {
+		f.config = previous
+		f.apply(nd)
+		return err
+	}
+	log.Infof("reload: Reloaded %s", f.path)
+	return nil
+}
+
+func setLogLevel(level string, debug bool) error {
+	if debug {
+		level = "debug"
+	}
+	l, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(l)
+	return nil
+}
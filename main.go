@@ -2,8 +2,8 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"os"
-	"sync"
 
 	log "github.com/Sirupsen/logrus"
 	ipamApi "github.com/docker/go-plugins-helpers/ipam"
@@ -16,6 +16,10 @@ import (
 const (
 	version    = "0.1"
 	defaultMtu = 1500
+
+	// Exit statuses
+	exitStartupFailed = 1
+	exitUnclean       = 2
 )
 
 func main() {
@@ -43,12 +47,112 @@ func main() {
 		Usage: "IP to configure as default gateway for containers",
 	}
 
+	gatewayMode := cli.StringFlag{
+		Name:  "gateway-mode",
+		Value: routed.GatewayProxyArp,
+		Usage: "how containers reach the gateway: proxy-arp, or link-local for a gateway address on each veth (default gateway " + routed.LinkLocalGateway + ")",
+	}
+
 	mtu := cli.UintFlag{
 		Name:  "mtu, m",
 		Value: defaultMtu,
 		Usage: "MTU for container interfaces",
 	}
 
+	aggregate := cli.StringFlag{
+		Name:  "aggregate, a",
+		Value: "",
+		Usage: "block of the pool owned by this host, announced as a single route (e.g. 10.1.3.0/26)",
+	}
+
+	allowedRoutes := cli.StringFlag{
+		Name:  "allowed-routes",
+		Value: "",
+		Usage: "comma separated prefixes container addresses must belong to (default any)",
+	}
+
+	deniedRoutes := cli.StringFlag{
+		Name:  "denied-routes",
+		Value: "",
+		Usage: "comma separated prefixes container addresses must not overlap",
+	}
+
+	ipConflicts := cli.StringFlag{
+		Name:  "ip-conflicts",
+		Value: routed.ConflictWarn,
+		Usage: "action when a requested IP is already routed to another host: refuse, warn or off",
+	}
+
+	drainMode := cli.StringFlag{
+		Name:  "drain-mode",
+		Value: routed.DrainNone,
+		Usage: "how container routes are taken down before their interface is removed: none, metric or withdraw",
+	}
+
+	drainGrace := cli.DurationFlag{
+		Name:  "drain-grace",
+		Usage: "time to wait after taking down a container route before removing its interface",
+	}
+
+	dampeningHalfLife := cli.DurationFlag{
+		Name:  "dampening-half-life",
+		Usage: "half life of the flap penalty of container routes, enables route dampening",
+	}
+
+	hostSysctls := cli.StringFlag{
+		Name:  "host-sysctls",
+		Value: routed.SysctlCheck,
+		Usage: "what to do at startup when host sysctls such as ip_forward are wrong: check (refuse to start), fix or off",
+	}
+
+	metricsAddr := cli.StringFlag{
+		Name:  "metrics-addr",
+		Value: "",
+		Usage: "host:port to serve Prometheus metrics on at /metrics (default disabled)",
+	}
+
+	adminSocket := cli.StringFlag{
+		Name:  "admin-socket",
+		Value: routed.DefaultAdminSocket,
+		Usage: "unix socket path of the admin API, empty to disable",
+	}
+
+	ingressAllowed := cli.StringFlag{
+		Name:  "ingress-allowed",
+		Value: "",
+		Usage: "comma separated IPs, CIDRs and IP ranges allowed to reach the endpoints not given their own policy (default any)",
+	}
+
+	logLevel := cli.StringFlag{
+		Name:  "log-level",
+		Value: "info",
+		Usage: "log level: debug, info, warning or error",
+	}
+
+	logFormat := cli.StringFlag{
+		Name:  "log-format",
+		Value: routed.LogFormatText,
+		Usage: "log format: text, or json with the network, endpoint, pool, address and correlation ID of each plugin call",
+	}
+
+	config := cli.StringFlag{
+		Name:  "config, c",
+		Value: "",
+		Usage: "TOML configuration file, whose settings apply unless given on the command line and reload on SIGHUP",
+	}
+
+	stateFile := cli.StringFlag{
+		Name:  "state-file",
+		Value: routed.DefaultStateFile,
+		Usage: "file the pools, networks and endpoints are written to on shutdown, empty to disable",
+	}
+
+	shutdownTimeout := cli.DurationFlag{
+		Name:  "shutdown-timeout",
+		Value: defaultShutdownTimeout,
+		Usage: "time to wait on shutdown for the plugin calls in progress",
+	}
+
 	app := cli.NewApp()
 	app.Name = "routed"
 	app.Usage = "Docker routed network driver"
@@ -60,64 +164,158 @@ func main() {
 		ipamSocket,
 		netSocket,
 		gateway,
+		gatewayMode,
 		mtu,
+		aggregate,
+		allowedRoutes,
+		deniedRoutes,
+		ipConflicts,
+		drainMode,
+		drainGrace,
+		dampeningHalfLife,
+		hostSysctls,
+		metricsAddr,
+		adminSocket,
+		ingressAllowed,
+		logLevel,
+		logFormat,
+		config,
+		stateFile,
+		shutdownTimeout,
 	}
 
 	app.Action = driverRun
+	app.Commands = commands
 	app.Run(os.Args)
 }
 
-func driverRun(c *cli.Context) {
+// startupError makes the plugin exit with the status telling it couldn't
+// start.
+func startupError(err error) error {
+	log.Errorf("Couldn't start: %v", err)
+	return cli.NewExitError(err.Error(), exitStartupFailed)
+}
+
+func driverRun(c *cli.Context) error {
 
-	if c.Bool("debug") {
-		log.SetLevel(log.DebugLevel)
+	cfg, err := loadConfigFile(c)
+	if err != nil {
+		return startupError(err)
+	}
+
+	if err := setLogLevel(c.String("log-level"), c.Bool("debug")); err != nil {
+		return startupError(err)
+	}
+	if err := routed.SetLogFormat(c.String("log-format")); err != nil {
+		return startupError(err)
 	}
 
 	gateway := c.String("gateway")
-	_, err := netlink.ParseAddr(fmt.Sprintf("%s/32", gateway))
-	if err != nil {
-		fmt.Printf("%+v\n", err)
-		os.Exit(-1)
+	if c.String("gateway-mode") == routed.GatewayLinkLocal && !cfg.isSet("gateway") {
+		gateway = routed.LinkLocalGateway
+	}
+	if _, err := netlink.ParseAddr(fmt.Sprintf("%s/32", gateway)); err != nil {
+		return startupError(err)
 	}
 
 	mtu := c.Int("mtu")
 
-	messages := make(chan int)
-	var wg sync.WaitGroup
+	var metrics *routed.Metrics
+	if c.String("metrics-addr") != "" {
+		metrics = routed.NewMetrics()
+	}
 
-	wg.Add(2)
+	id, err := routed.NewIpamDriver(version, gateway, c.String("aggregate"))
+	if err != nil {
+		return startupError(err)
+	}
+	if err := id.SetConflictMode(c.String("ip-conflicts")); err != nil {
+		return startupError(err)
+	}
 
-	go func() {
-		defer wg.Done()
+	nd, err := routed.NewNetDriver(version, gateway, mtu, c.String("aggregate"))
+	if err != nil {
+		return startupError(err)
+	}
+	if err := nd.CheckHostSysctls(c.String("host-sysctls")); err != nil {
+		return startupError(err)
+	}
+	if err := nd.SetGatewayMode(c.String("gateway-mode")); err != nil {
+		return startupError(err)
+	}
+	// Route guardrails, network profiles and default policy
+	if err := cfg.apply(nd); err != nil {
+		return startupError(err)
+	}
+	if err := nd.SetDrain(c.String("drain-mode"), c.Duration("drain-grace")); err != nil {
+		return startupError(err)
+	}
+	if err := nd.SetDampening(c.Duration("dampening-half-life")); err != nil {
+		return startupError(err)
+	}
 
-		id, err := routed.NewIpamDriver(version, gateway)
-		if err != nil {
-			fmt.Printf("%+v\n", err)
-			os.Exit(-1)
-		}
+	var ipam ipamApi.Ipam = id
+	var driver netApi.Driver = nd
+	if metrics != nil {
+		id.SetMetrics(metrics)
+		ipam = routed.InstrumentIpamDriver(id)
+		nd.SetMetrics(metrics)
+		driver = routed.InstrumentNetDriver(nd)
+	}
 
-		log.Debugf("Startig routed ipam driver: %+v", id)
-		ih := ipamApi.NewHandler(id)
-		ih.ServeUnix("root", c.String("ipamsock"))
+	// Listeners are bound before the plugin starts, a busy address is a
+	// startup failure
+	var metricsListener net.Listener
+	if addr := c.String("metrics-addr"); addr != "" {
+		if metricsListener, err = net.Listen("tcp", addr); err != nil {
+			return startupError(fmt.Errorf("Can't serve metrics on %s: %v", addr, err))
+		}
+	}
+	var adminListener net.Listener
+	if path := c.String("admin-socket"); path != "" {
+		if adminListener, err = routed.ListenAdmin(path); err != nil {
+			if metricsListener != nil {
+				metricsListener.Close()
+			}
+			return startupError(fmt.Errorf("Can't serve the admin API on %s: %v", path, err))
+		}
+	}
 
-		messages <- 1
-	}()
+	s := newSupervisor(id, nd, cfg)
+	s.stateFile = c.String("state-file")
+	s.shutdownTimeout = c.Duration("shutdown-timeout")
+	s.drainGrace = c.Duration("drain-grace")
 
+	if c.String("ip-conflicts") != routed.ConflictOff {
+		go func() {
+			if err := id.WatchConflicts(s.done); err != nil {
+				log.Errorf("Conflict watcher stopped: %v", err)
+			}
+		}()
+	}
 	go func() {
-		defer wg.Done()
-
-		nd, err := routed.NewNetDriver(version, gateway, mtu)
-		if err != nil {
-			fmt.Printf("%+v\n", err)
-			os.Exit(-1)
+		if err := nd.Reconcile(s.done); err != nil {
+			log.Errorf("Reconciler stopped: %v", err)
 		}
+	}()
 
-		log.Debugf("Starting routed network driver: %+v", nd)
-		nh := netApi.NewHandler(nd)
-		nh.ServeUnix("root", c.String("netsock"))
+	if metricsListener != nil {
+		s.listen("metrics", metricsListener, func(l net.Listener) error {
+			return routed.ServeMetrics(metrics, l)
+		})
+	}
+	if adminListener != nil {
+		s.sockets = append(s.sockets, c.String("admin-socket"))
+		admin := routed.NewAdminServer(id, nd)
+		s.listen("admin API", adminListener, func(l net.Listener) error {
+			return routed.ServeAdmin(admin, l)
+		})
+	}
 
-		messages <- 2
-	}()
+	log.Debugf("Starting routed ipam driver: %+v", id)
+	s.serve("ipam", c.String("ipamsock"), ipamApi.NewHandler(routed.GateIpamDriver(ipam, s.gate)).ServeUnix)
+	log.Debugf("Starting routed network driver: %+v", nd)
+	s.serve("network", c.String("netsock"), netApi.NewHandler(routed.GateNetDriver(driver, s.gate)).ServeUnix)
 
-	wg.Wait()
+	return s.run()
 }
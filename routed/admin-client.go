@@ -0,0 +1,104 @@
+package routed
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// AdminClient calls the admin API of a running plugin.
+type AdminClient struct {
+	path   string
+	client *http.Client
+}
+
+func NewAdminClient(path string) *AdminClient {
+	return &AdminClient{
+		path: path,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return net.Dial("unix", path)
+				},
+			},
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+// call sends in, when not nil, as the JSON body of the request and decodes
+// the response into out, when not nil.
+func (c *AdminClient) call(method string, path string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, "http://routed"+path, body)
+	if err != nil {
+		return err
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Can't reach the plugin on %s: %v", c.path, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&e); err != nil || e.Error == "" {
+			return fmt.Errorf("%s %s failed: %s", method, path, res.Status)
+		}
+		return fmt.Errorf("%s", e.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func (c *AdminClient) Pools() ([]PoolState, error) {
+	var pools []PoolState
+	return pools, c.call("GET", "/pools", nil, &pools)
+}
+
+func (c *AdminClient) Networks() ([]NetworkState, error) {
+	var networks []NetworkState
+	return networks, c.call("GET", "/networks", nil, &networks)
+}
+
+func (c *AdminClient) StartupActions() ([]StartupAction, error) {
+	var actions []StartupAction
+	return actions, c.call("GET", "/startup", nil, &actions)
+}
+
+func (c *AdminClient) Release(address string) error {
+	return c.call("POST", "/pools/release", &ReleaseRequest{Address: address}, nil)
+}
+
+func (c *AdminClient) CollectGarbage() (*GarbageReport, error) {
+	report := &GarbageReport{}
+	return report, c.call("POST", "/gc", nil, report)
+}
+
+func (c *AdminClient) Reapply(eid string) error {
+	return c.call("POST", "/endpoints/"+eid+"/reapply", nil, nil)
+}
+
+func (c *AdminClient) SetPolicy(eid string, ingressAllowed string) error {
+	return c.call("PUT", "/endpoints/"+eid+"/policy", &PolicyRequest{IngressAllowed: ingressAllowed}, nil)
+}
+
+func (c *AdminClient) SetQos(eid string, q *QosRequest) error {
+	return c.call("PUT", "/endpoints/"+eid+"/qos", q, nil)
+}
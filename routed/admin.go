@@ -0,0 +1,428 @@
+package routed
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// DefaultAdminSocket is where the admin API listens unless told otherwise
+	DefaultAdminSocket = "/run/routed/admin.sock"
+)
+
+// StartupAction is a change made to the host when the plugin started.
+type StartupAction struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+}
+
+type actionLog struct {
+	actions []StartupAction
+	m       sync.Mutex
+}
+
+func (l *actionLog) record(format string, args ...interface{}) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.actions = append(l.actions, StartupAction{Time: time.Now(), Action: fmt.Sprintf(format, args...)})
+}
+
+func (l *actionLog) snapshot() []StartupAction {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return append([]StartupAction{}, l.actions...)
+}
+
+// PoolState is a pool of the IPAM driver and its allocated addresses.
+type PoolState struct {
+	ID        string   `json:"id"`
+	Subnet    string   `json:"subnet"`
+	Gateway   string   `json:"gateway"`
+	Aggregate string   `json:"aggregate,omitempty"`
+	Allocated []string `json:"allocated"`
+}
+
+// NetworkState is a network of the network driver and its endpoints.
+type NetworkState struct {
+	ID          string          `json:"id"`
+	Gateway     string          `json:"gateway"`
+	GatewayMode string          `json:"gateway_mode"`
+	MTU         int             `json:"mtu"`
+	Metric      int             `json:"metric"`
+	Endpoints   []EndpointState `json:"endpoints"`
+}
+
+// EndpointState is an endpoint with its links, the kernel routes to its
+// address and its policies.
+type EndpointState struct {
+	ID                 string         `json:"id"`
+	Address            string         `json:"address"`
+	MacAddress         string         `json:"mac_address,omitempty"`
+	HostInterface      string         `json:"host_interface,omitempty"`
+	ContainerInterface string         `json:"container_interface,omitempty"`
+	SandboxKey         string         `json:"sandbox_key,omitempty"`
+	RouteState         string         `json:"route_state"`
+	Routes             []string       `json:"routes"`
+	Filtering          string         `json:"filtering"`
+	Readiness          string         `json:"readiness,omitempty"`
+	Qos                string         `json:"qos"`
+	Stats              *EndpointStats `json:"stats,omitempty"`
+}
+
+type byID []EndpointState
+
+func (s byID) Len() int           { return len(s) }
+func (s byID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+// QosRequest changes the traffic limits of an endpoint, with the values of
+// the endpoint labels. Empty values remove the limit.
+type QosRequest struct {
+	EgressRate  string `json:"egress_rate"`
+	IngressRate string `json:"ingress_rate"`
+	Dscp        string `json:"dscp"`
+}
+
+// PolicyRequest sets the ingress filtering of an endpoint, with the value of
+// the ingress allowed option. An empty value removes the filtering.
+type PolicyRequest struct {
+	IngressAllowed string `json:"ingress_allowed"`
+}
+
+// ReleaseRequest frees an address of a pool.
+type ReleaseRequest struct {
+	Address string `json:"address"`
+}
+
+// Pools returns the pools with their allocated addresses.
+func (d *IpamDriver) Pools() []PoolState {
+	d.pool.m.Lock()
+	defer d.pool.m.Unlock()
+
+	state := PoolState{
+		ID:        d.pool.id,
+		Subnet:    d.pool.subnet.String(),
+		Gateway:   d.pool.gateway.IP.String(),
+		Allocated: []string{},
+	}
+	if d.aggregate != nil {
+		state.Aggregate = d.aggregate.String()
+	}
+	for addr := range d.pool.allocatedIPs {
+		state.Allocated = append(state.Allocated, addr)
+	}
+	sort.Strings(state.Allocated)
+	return []PoolState{state}
+}
+
+// ForceRelease frees an address Docker never released. The gateway can't be
+// released.
+func (d *IpamDriver) ForceRelease(address string) error {
+	ip := net.ParseIP(address)
+	if ip == nil || ip.To4() == nil {
+		return fmt.Errorf("Invalid address %s", address)
+	}
+	addr := fmt.Sprintf("%s/32", ip)
+
+	d.pool.m.Lock()
+	defer d.pool.m.Unlock()
+
+	if ip.Equal(d.pool.gateway.IP) {
+		return fmt.Errorf("Address %s is the gateway", address)
+	}
+	if !d.pool.allocatedIPs[addr] {
+		return fmt.Errorf("Address %s is not allocated", address)
+	}
+	delete(d.pool.allocatedIPs, addr)
+	log.Warnf("ForceRelease: Released %s from %s", addr, d.pool.id)
+	return nil
+}
+
+// StartupActions returns the changes made to the host when the driver
+// started.
+func (d *NetDriver) StartupActions() []StartupAction {
+	return d.startup.snapshot()
+}
+
+// Networks returns the networks with their endpoints.
+func (d *NetDriver) Networks() []NetworkState {
+	states := []NetworkState{}
+	for _, network := range d.allNetworks() {
+		states = append(states, d.networkState(network))
+	}
+	return states
+}
+
+func (d *NetDriver) networkState(network *routedNetwork) NetworkState {
+	network.m.Lock()
+	defer network.m.Unlock()
+
+	state := NetworkState{
+		ID:          network.id,
+		Gateway:     network.gateway,
+		GatewayMode: network.gatewayMode,
+		MTU:         network.mtu,
+		Metric:      network.metric,
+		Endpoints:   []EndpointState{},
+	}
+	for eid, ep := range network.endpoints {
+		state.Endpoints = append(state.Endpoints, d.endpointState(network, eid, ep))
+	}
+	sort.Sort(byID(state.Endpoints))
+	return state
+}
+
+// endpointState describes an endpoint. Caller must hold the network lock.
+func (d *NetDriver) endpointState(network *routedNetwork, eid string, ep *routedEndpoint) EndpointState {
+	state := EndpointState{
+		ID:                 eid,
+		Address:            ep.ipv4Address.IP.String(),
+		HostInterface:      ep.hostInterfaceName,
+		ContainerInterface: ep.containerIfaceName,
+		SandboxKey:         ep.sandboxKey,
+		RouteState:         ep.routeState(),
+		Routes:             []string{},
+		Filtering:          ep.netFilter.String(),
+		Qos:                ep.qos.String(),
+		Stats:              network.readStats(eid, ep),
+	}
+	if ep.macAddress != nil {
+		state.MacAddress = ep.macAddress.String()
+	}
+	if ep.readiness != nil {
+		state.Readiness = ep.readiness.String()
+	}
+	if ep.hostInterfaceName == "" {
+		return state
+	}
+
+	link, err := d.nl.LinkByName(ep.hostInterfaceName)
+	if err != nil {
+		return state
+	}
+	routes, err := d.nl.RouteList(link, netlink.FAMILY_V4)
+	if err != nil {
+		log.Warnf("endpointState: Couldn't list routes of %s: %v", ep.hostInterfaceName, err)
+		return state
+	}
+	for _, route := range routes {
+		if route.Dst != nil && route.Dst.String() == ep.ipv4Address.String() {
+			state.Routes = append(state.Routes, fmt.Sprintf("%s dev %s metric %d", route.Dst, ep.hostInterfaceName, route.Priority))
+		}
+	}
+	return state
+}
+
+// endpointWithAddress returns the ID of the endpoint having the address ip,
+// or an empty string.
+func (d *NetDriver) endpointWithAddress(ip net.IP) string {
+	for _, network := range d.allNetworks() {
+		network.m.Lock()
+		for eid, ep := range network.endpoints {
+			if ep.ipv4Address.IP.Equal(ip) {
+				network.m.Unlock()
+				return eid
+			}
+		}
+		network.m.Unlock()
+	}
+	return ""
+}
+
+// Reapply sets up again the host route, link, traffic limits and filtering
+// of a joined endpoint. Only what is missing is added, the endpoint staying
+// limited and filtered meanwhile.
+func (d *NetDriver) Reapply(eid string) error {
+	network, err := d.endpointNetwork(eid)
+	if err != nil {
+		return err
+	}
+
+	network.m.Lock()
+	defer network.m.Unlock()
+
+	ep, ok := network.endpoints[eid]
+	if !ok {
+		return fmt.Errorf("Endpoint %s not found", eid)
+	}
+	if !ep.joined {
+		return fmt.Errorf("Endpoint %s is not joined", eid)
+	}
+
+	if err := d.reconcileEndpoint(network, eid, ep); err != nil {
+		return err
+	}
+
+	if !network.dataplane.SharesHostLink() {
+		if err := applyQos(d.tc, d.fw, ep.hostInterfaceName, ep.qos); err != nil {
+			return err
+		}
+	}
+
+	if ep.netFilter != nil {
+		if err := ep.netFilter.reapplyFiltering(); err != nil {
+			return err
+		}
+	}
+	log.Infof("Reapply: Set up endpoint %s again", eid)
+	return nil
+}
+
+// AdminServer serves the state of the drivers and a few repairs as JSON.
+type AdminServer struct {
+	ipam *IpamDriver
+	net  *NetDriver
+	mux  *http.ServeMux
+}
+
+func NewAdminServer(ipam *IpamDriver, net *NetDriver) *AdminServer {
+	a := &AdminServer{ipam: ipam, net: net, mux: http.NewServeMux()}
+	a.mux.HandleFunc("/pools", a.get(func() interface{} { return ipam.Pools() }))
+	a.mux.HandleFunc("/pools/release", a.release)
+	a.mux.HandleFunc("/networks", a.get(func() interface{} { return net.Networks() }))
+	a.mux.HandleFunc("/startup", a.get(func() interface{} { return net.StartupActions() }))
+	a.mux.HandleFunc("/stats", a.get(func() interface{} { return net.EndpointStatistics() }))
+	a.mux.HandleFunc("/dampening", a.get(func() interface{} { return net.DampeningStates() }))
+	a.mux.HandleFunc("/gc", a.gc)
+	a.mux.HandleFunc("/endpoints/", a.endpoint)
+	return a
+}
+
+func (a *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Debugf("AdminServer: %s %s", r.Method, r.URL.Path)
+	a.mux.ServeHTTP(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnf("AdminServer: Couldn't write response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (a *AdminServer) get(state func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+			return
+		}
+		writeJSON(w, http.StatusOK, state())
+	}
+}
+
+// release frees a leaked address, unless an endpoint still uses it.
+func (a *AdminServer) release(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+		return
+	}
+	var req ReleaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid request: %v", err))
+		return
+	}
+	if ip := net.ParseIP(req.Address); ip != nil {
+		if eid := a.net.endpointWithAddress(ip); eid != "" {
+			writeError(w, http.StatusConflict, fmt.Errorf("Address %s is used by endpoint %s", req.Address, eid))
+			return
+		}
+	}
+	if err := a.ipam.ForceRelease(req.Address); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{})
+}
+
+func (a *AdminServer) gc(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+		return
+	}
+	writeJSON(w, http.StatusOK, a.net.CollectGarbage())
+}
+
+// endpoint handles /endpoints/<id>/reapply, /endpoints/<id>/qos and
+// /endpoints/<id>/policy.
+func (a *AdminServer) endpoint(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/endpoints/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Unknown path %s", r.URL.Path))
+		return
+	}
+	eid := parts[0]
+
+	var err error
+	switch {
+	case parts[1] == "reapply" && r.Method == "POST":
+		err = a.net.Reapply(eid)
+	case parts[1] == "qos" && r.Method == "PUT":
+		var req QosRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid request: %v", err))
+			return
+		}
+		err = a.net.SetEndpointQos(eid, req.EgressRate, req.IngressRate, req.Dscp)
+	case parts[1] == "policy" && r.Method == "PUT":
+		var req PolicyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid request: %v", err))
+			return
+		}
+		err = a.net.SetEndpointPolicy(eid, req.IngressAllowed)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("Unknown path %s %s", r.Method, r.URL.Path))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{})
+}
+
+// ListenAdmin binds the unix socket path of the admin API, readable by root
+// only. The umask being shared by the whole process, it must be called
+// before anything else creates files.
+func ListenAdmin(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// A socket left by a previous run
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// The socket is created with its final mode, it is never reachable by
+	// other users
+	umask := syscall.Umask(0177)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// ServeAdmin serves the admin API to the connections accepted by l.
+func ServeAdmin(a *AdminServer, l net.Listener) error {
+	log.Infof("ServeAdmin: Serving admin API on %s", l.Addr())
+	return http.Serve(l, a)
+}
@@ -0,0 +1,201 @@
+package routed
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ipamApi "github.com/docker/go-plugins-helpers/ipam"
+	netApi "github.com/docker/go-plugins-helpers/network"
+	"github.com/vishvananda/netlink"
+)
+
+func adminCall(a *AdminServer, method string, path string, body string, v interface{}) int {
+	r, _ := http.NewRequest(method, path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	if v != nil {
+		json.NewDecoder(w.Body).Decode(v)
+	}
+	return w.Code
+}
+
+func TestAdminServer(t *testing.T) {
+	netID := "c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c"
+	eID := "4b50fb7f12adb0da3e6662148e9b1bc43b507ad2fd8a0f187ff297cbc88aee05"
+
+	id, _ := newIpamDriver(newFakeNetlink(), "0.1", "10.100.0.1", "")
+	id.SetConflictMode(ConflictOff)
+	for _, address := range []string{"10.1.0.2", "10.1.0.9"} {
+		id.RequestAddress(&ipamApi.RequestAddressRequest{PoolID: "routed", Address: address})
+	}
+
+	nl := newFakeNetlink()
+	nl.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "vethr1234"}})
+	nd, _ := newNetDriver(nl, newFakeIptables(), newFakeSysctls(), newFakeTc(), "0.1", "10.100.0.1", 1500, "")
+	nd.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: netID})
+	nd.CreateEndpoint(&netApi.CreateEndpointRequest{
+		NetworkID:  netID,
+		EndpointID: eID,
+		Interface:  &netApi.EndpointInterface{Address: "10.1.0.2/32"},
+	})
+	nd.Join(&netApi.JoinRequest{NetworkID: netID, EndpointID: eID})
+	a := NewAdminServer(id, nd)
+
+	var pools []PoolState
+	if code := adminCall(a, "GET", "/pools", "", &pools); code != http.StatusOK || len(pools) != 1 ||
+		strings.Join(pools[0].Allocated, ",") != "10.1.0.2/32,10.1.0.9/32,10.100.0.1/32" {
+		t.Fatalf("TestAdminServer failed: wrong pools %d %+v", code, pools)
+	}
+
+	var networks []NetworkState
+	adminCall(a, "GET", "/networks", "", &networks)
+	if len(networks) != 1 || len(networks[0].Endpoints) != 1 {
+		t.Fatalf("TestAdminServer failed: wrong networks %+v", networks)
+	}
+	ep := networks[0].Endpoints[0]
+	if ep.ID != eID || ep.Address != "10.1.0.2" || ep.MacAddress != "02:42:0a:01:00:02" || ep.RouteState != "announced" ||
+		len(ep.Routes) != 1 || ep.Filtering != "none" || ep.Qos != "none" {
+		t.Fatalf("TestAdminServer failed: wrong endpoint %+v", ep)
+	}
+
+	var startup []StartupAction
+	adminCall(a, "GET", "/startup", "", &startup)
+	if len(startup) != 1 || startup[0].Action != "Removed stale interface vethr1234" {
+		t.Fatalf("TestAdminServer failed: wrong startup actions %+v", startup)
+	}
+
+	// Addresses of endpoints and the gateway are kept
+	for address, code := range map[string]int{
+		"10.1.0.2":   http.StatusConflict,
+		"10.100.0.1": http.StatusBadRequest,
+		"10.1.0.3":   http.StatusBadRequest,
+		"10.1.0.9":   http.StatusOK,
+	} {
+		if c := adminCall(a, "POST", "/pools/release", `{"address":"`+address+`"}`, nil); c != code {
+			t.Fatalf("TestAdminServer failed: release of %s returned %d", address, c)
+		}
+	}
+	if _, ok := id.pool.allocatedIPs["10.1.0.9/32"]; ok {
+		t.Fatalf("TestAdminServer failed: address not released")
+	}
+
+	route := nl.findRoute("10.1.0.2/32")
+	nl.RouteDel(route)
+	if code := adminCall(a, "POST", "/endpoints/"+eID+"/reapply", "", nil); code != http.StatusOK || nl.findRoute("10.1.0.2/32") == nil {
+		t.Fatalf("TestAdminServer failed: route not reapplied %d", code)
+	}
+
+	if code := adminCall(a, "PUT", "/endpoints/"+eID+"/qos", `{"dscp":"ef"}`, nil); code != http.StatusOK ||
+		nd.networks[netID].endpoints[eID].qos.String() != "dscp 46" {
+		t.Fatalf("TestAdminServer failed: qos not set %d", code)
+	}
+
+	for _, path := range []string{"/endpoints/unknown/reapply", "/endpoints/" + eID + "/qos"} {
+		var res map[string]string
+		if code := adminCall(a, "POST", path, "", &res); code == http.StatusOK || res["error"] == "" {
+			t.Fatalf("TestAdminServer failed: %s returned %d %+v", path, code, res)
+		}
+	}
+	if code := adminCall(a, "DELETE", "/pools", "", nil); code != http.StatusMethodNotAllowed {
+		t.Fatalf("TestAdminServer failed: DELETE returned %d", code)
+	}
+}
+
+func TestReapply(t *testing.T) {
+	netID := "c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c"
+	eID := "4b50fb7f12adb0da3e6662148e9b1bc43b507ad2fd8a0f187ff297cbc88aee05"
+
+	fw := newFakeIptables(containersChainName, containerRejectChainName)
+	tc := newFakeTc()
+	d, _ := newNetDriver(newFakeNetlink(), fw, newFakeSysctls(), tc, "0.1", "10.100.0.1", 1500, "")
+	d.SetDefaultPolicy("10.2.0.0/16,10.3.0.1-10.3.0.9")
+	d.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: netID})
+	d.CreateEndpoint(&netApi.CreateEndpointRequest{
+		NetworkID:  netID,
+		EndpointID: eID,
+		Interface:  &netApi.EndpointInterface{Address: "10.1.0.2/32"},
+		Options:    map[string]interface{}{"routed.ingress-rate": "100mbit", "routed.egress-rate": "10mbit", "routed.dscp": "ef"},
+	})
+	if _, err := d.Join(&netApi.JoinRequest{NetworkID: netID, EndpointID: eID}); err != nil {
+		t.Fatalf("TestReapply failed: Join %v", err)
+	}
+	iface := d.networks[netID].endpoints[eID].hostInterfaceName
+	chain := "CONTAINER-" + iface
+	check := func(when string) {
+		if rules := fw.chains[chain]; len(rules) != 3 || rules[1] != "-m iprange --src-range 10.3.0.1-10.3.0.9 -j ACCEPT" ||
+			len(fw.chains) != 4 || len(fw.chains[containersChainName]) != 1 || len(fw.chains["mangle/PREROUTING"]) != 1 {
+			t.Fatalf("TestReapply failed: %s: wrong rules %+v", when, fw.chains)
+		}
+		if len(tc.qdiscs[iface]) != 2 || len(tc.filters[iface]) != 1 {
+			t.Fatalf("TestReapply failed: %s: wrong limits %+v %+v", when, tc.qdiscs[iface], tc.filters[iface])
+		}
+	}
+
+	// Nothing is added twice
+	if err := d.Reapply(eID); err != nil {
+		t.Fatalf("TestReapply failed: %v", err)
+	}
+	check("reapplied")
+
+	// Only what is missing is added back
+	fw.chains[containersChainName] = nil
+	fw.chains["mangle/PREROUTING"] = nil
+	fw.chains[chain] = fw.chains[chain][1:]
+	delete(tc.qdiscs[iface], "root")
+	if err := d.Reapply(eID); err != nil {
+		t.Fatalf("TestReapply failed: %v", err)
+	}
+	check("repaired")
+}
+
+func TestAdminClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routed")
+	if err != nil {
+		t.Fatalf("TestAdminClient failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "admin.sock")
+
+	id, _ := newIpamDriver(newFakeNetlink(), "0.1", "10.100.0.1", "")
+	id.SetConflictMode(ConflictOff)
+	id.RequestAddress(&ipamApi.RequestAddressRequest{PoolID: "routed", Address: "10.1.0.9"})
+	nd, _ := newNetDriver(newFakeNetlink(), newFakeIptables(), newFakeSysctls(), newFakeTc(), "0.1", "10.100.0.1", 1500, "")
+	l, err := ListenAdmin(path)
+	if err != nil {
+		t.Fatalf("TestAdminClient failed: %v", err)
+	}
+	defer l.Close()
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("TestAdminClient failed: wrong socket mode %+v %v", info, err)
+	}
+	go ServeAdmin(NewAdminServer(id, nd), l)
+
+	client := NewAdminClient(path)
+	var pools []PoolState
+	for i := 0; i < 50; i++ {
+		if pools, err = client.Pools(); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil || len(pools) != 1 || len(pools[0].Allocated) != 2 {
+		t.Fatalf("TestAdminClient failed: wrong pools %+v %v", pools, err)
+	}
+
+	if err := client.Release("10.1.0.9"); err != nil {
+		t.Fatalf("TestAdminClient failed: %v", err)
+	}
+	if err := client.Release("10.1.0.9"); err == nil || err.Error() != "Address 10.1.0.9 is not allocated" {
+		t.Fatalf("TestAdminClient failed: wrong error %v", err)
+	}
+	if networks, err := client.Networks(); err != nil || len(networks) != 0 {
+		t.Fatalf("TestAdminClient failed: wrong networks %+v %v", networks, err)
+	}
+}
@@ -0,0 +1,106 @@
+package routed
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// Routing protocol id set on host routes covered by the aggregate, so the
+	// routing daemon can tell them apart from the routes it must announce.
+	aggregatedRouteProto = 200
+)
+
+// hostAggregate is the block of the pool owned by this host. The block is
+// announced as a single route and container addresses inside it get local
+// host routes only.
+type hostAggregate struct {
+	block *net.IPNet
+}
+
+func parseAggregate(cidr string) (*hostAggregate, error) {
+	if cidr == "" {
+		return nil, nil
+	}
+
+	_, block, err := net.ParseCIDR(cidr)
+	if err != nil || block.IP.To4() == nil {
+		return nil, fmt.Errorf("Invalid aggregate block %s", cidr)
+	}
+
+	if ones, bits := block.Mask.Size(); ones >= bits-1 {
+		return nil, fmt.Errorf("Aggregate block %s is too small", cidr)
+	}
+
+	return &hostAggregate{block: block}, nil
+}
+
+func (a *hostAggregate) String() string {
+	return a.block.String()
+}
+
+func (a *hostAggregate) contains(ip net.IP) bool {
+	return a != nil && a.block.Contains(ip)
+}
+
+// usable reports whether ip can be handed out to a container. The network
+// and broadcast addresses of the block are never used.
+func (a *hostAggregate) usable(ip net.IP) bool {
+	if !a.contains(ip) {
+		return false
+	}
+	ip4 := ip.To4()
+	network := a.block.IP.To4()
+	broadcast := make(net.IP, len(network))
+	for i := range network {
+		broadcast[i] = network[i] | ^a.block.Mask[i]
+	}
+	return !ip4.Equal(network) && !ip4.Equal(broadcast)
+}
+
+// addresses walks the usable addresses of the block in order.
+func (a *hostAggregate) addresses(fn func(ip net.IP) bool) {
+	ip := make(net.IP, net.IPv4len)
+	copy(ip, a.block.IP.To4())
+	for ; a.block.Contains(ip); ip = nextIP(ip) {
+		if a.usable(ip) && !fn(ip) {
+			return
+		}
+	}
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// blackholeRoute drops traffic to addresses of the block that are not
+// assigned to a local container. It is also the route announced for the
+// whole block.
+func (a *hostAggregate) blackholeRoute() *netlink.Route {
+	return &netlink.Route{
+		Dst:  a.block,
+		Type: syscall.RTN_BLACKHOLE,
+	}
+}
+
+func (a *hostAggregate) install(nl Netlink) error {
+	route := a.blackholeRoute()
+	log.Debugf("hostAggregate: Adding blackhole route %+v", route)
+	if err := nl.RouteAdd(route); err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("Unable to add blackhole route for aggregate %s: %v", a, err)
+	}
+	log.Infof("hostAggregate: Announcing aggregate %s", a)
+	return nil
+}
@@ -0,0 +1,319 @@
+package routed
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// configFlags maps the settings of the configuration file, by section and
+// key, to the command line flags they give a value to.
+var configFlags = map[string]string{
+	"defaults.ipamsock":          "ipamsock",
+	"defaults.netsock":           "netsock",
+	"defaults.gateway":           "gateway",
+	"defaults.gateway-mode":      "gateway-mode",
+	"defaults.mtu":               "mtu",
+	"defaults.aggregate":         "aggregate",
+	"defaults.ip-conflicts":      "ip-conflicts",
+	"defaults.host-sysctls":      "host-sysctls",
+	"defaults.state-file":        "state-file",
+	"defaults.shutdown-timeout":  "shutdown-timeout",
+	"routes.allowed":             "allowed-routes",
+	"routes.denied":              "denied-routes",
+	"routes.drain-mode":          "drain-mode",
+	"routes.drain-grace":         "drain-grace",
+	"routes.dampening-half-life": "dampening-half-life",
+	"filtering.ingress-allowed":  "ingress-allowed",
+	"observability.log-level":    "log-level",
+	"observability.log-format":   "log-format",
+	"observability.metrics-addr": "metrics-addr",
+	"observability.admin-socket": "admin-socket",
+}
+
+// ReloadedFlags are the settings applied again when the configuration file
+// is reloaded.
+var ReloadedFlags = []string{"log-level", "allowed-routes", "denied-routes", "ingress-allowed"}
+
+// networksSection holds the network profiles, as [networks.<profile>]
+const networksSection = "networks"
+
+// Network options a profile can set
+var profileLabels = map[string]bool{
+	gatewayLabel:     true,
+	gatewayModeLabel: true,
+	mtuLabel:         true,
+	vethPrefixLabel:  true,
+	metricLabel:      true,
+	dataplaneLabel:   true,
+	ipvlanParent:     true,
+	ipvlanModeLabel:  true,
+}
+
+func oneOf(values ...string) func(string) error {
+	return func(value string) error {
+		for _, v := range values {
+			if value == v {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %s", strings.Join(values, ", "))
+	}
+}
+
+func checkDuration(value string) error {
+	if d, err := time.ParseDuration(value); err != nil || d < 0 {
+		return fmt.Errorf("must be a duration such as 30s")
+	}
+	return nil
+}
+
+// configChecks validate the values of the flags set by the configuration
+// file.
+var configChecks = map[string]func(value string) error{
+	"gateway": func(value string) error {
+		_, err := parseGateway(value)
+		return err
+	},
+	"gateway-mode": oneOf(GatewayProxyArp, GatewayLinkLocal),
+	"mtu": func(value string) error {
+		_, err := parseMtu(value)
+		return err
+	},
+	"aggregate": func(value string) error {
+		_, err := parseAggregate(value)
+		return err
+	},
+	"ip-conflicts": oneOf(ConflictRefuse, ConflictWarn, ConflictOff),
+	"host-sysctls": oneOf(SysctlCheck, SysctlFix, SysctlOff),
+	"allowed-routes": func(value string) error {
+		_, err := parsePrefixList(value)
+		return err
+	},
+	"denied-routes": func(value string) error {
+		_, err := parsePrefixList(value)
+		return err
+	},
+	"drain-mode":          oneOf(DrainNone, DrainMetric, DrainWithdraw),
+	"drain-grace":         checkDuration,
+	"dampening-half-life": checkDuration,
+	"shutdown-timeout":    checkDuration,
+	"ingress-allowed": func(value string) error {
+		_, err := NetFilterConfigParse(value)
+		return err
+	},
+	"log-level": func(value string) error {
+		_, err := log.ParseLevel(value)
+		return err
+	},
+	"log-format": oneOf(LogFormatText, LogFormatJSON),
+	"metrics-addr": func(value string) error {
+		if value == "" {
+			return nil
+		}
+		_, _, err := net.SplitHostPort(value)
+		return err
+	},
+}
+
+// Config is the content of the configuration file.
+type Config struct {
+	// Flags holds the values the file gives to command line flags, by
+	// flag name.
+	Flags map[string]string
+	// Networks holds the network options of each profile, by profile name.
+	Networks map[string]map[string]string
+}
+
+// LoadConfig reads and validates the configuration file at path.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read configuration file: %v", err)
+	}
+	config, err := parseConfig(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid configuration file %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// parseConfig reads the subset of TOML the configuration file is written
+// in: tables, and keys with string, integer, boolean or string array
+// values. Arrays become comma separated lists.
+func parseConfig(data string) (*Config, error) {
+	config := &Config{
+		Flags:    make(map[string]string),
+		Networks: make(map[string]map[string]string),
+	}
+
+	section := ""
+	lines := strings.Split(data, "\n")
+	for i := 0; i < len(lines); i++ {
+		lineno := i + 1
+		line := strings.TrimSpace(stripComment(lines[i]))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: unterminated table header", lineno)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if profile := strings.TrimPrefix(section, networksSection+"."); profile != section {
+				if profile == "" {
+					return nil, fmt.Errorf("line %d: network profile without a name", lineno)
+				}
+				if _, ok := config.Networks[profile]; ok {
+					return nil, fmt.Errorf("line %d: network profile %s defined twice", lineno, profile)
+				}
+				config.Networks[profile] = make(map[string]string)
+				continue
+			}
+			if _, ok := configSections()[section]; !ok {
+				return nil, fmt.Errorf("line %d: unknown table [%s]", lineno, section)
+			}
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", lineno)
+		}
+		key := strings.TrimSpace(line[:eq])
+		raw := strings.TrimSpace(line[eq+1:])
+		// Arrays may span several lines
+		for strings.HasPrefix(raw, "[") && !strings.HasSuffix(raw, "]") && i+1 < len(lines) {
+			i++
+			raw += " " + strings.TrimSpace(stripComment(lines[i]))
+		}
+		value, err := parseConfigValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %v", lineno, key, err)
+		}
+
+		if profile := strings.TrimPrefix(section, networksSection+"."); profile != section {
+			label := labelPrefix + key
+			if !profileLabels[label] {
+				return nil, fmt.Errorf("line %d: unknown network option %s", lineno, key)
+			}
+			config.Networks[profile][label] = value
+			continue
+		}
+
+		flag, ok := configFlags[section+"."+key]
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown setting %s in [%s]", lineno, key, section)
+		}
+		if _, ok := config.Flags[flag]; ok {
+			return nil, fmt.Errorf("line %d: %s set twice", lineno, key)
+		}
+		if check, ok := configChecks[flag]; ok {
+			if err := check(value); err != nil {
+				return nil, fmt.Errorf("line %d: invalid %s %q: %v", lineno, key, value, err)
+			}
+		}
+		config.Flags[flag] = value
+	}
+
+	for profile, labels := range config.Networks {
+		if err := checkNetworkLabels(labels); err != nil {
+			return nil, fmt.Errorf("network profile %s: %v", profile, err)
+		}
+	}
+	return config, nil
+}
+
+// configSections returns the tables holding flag settings.
+func configSections() map[string]bool {
+	sections := make(map[string]bool)
+	for key := range configFlags {
+		sections[key[:strings.Index(key, ".")]] = true
+	}
+	return sections
+}
+
+// stripComment removes a # comment outside of strings.
+func stripComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseConfigValue(raw string) (string, error) {
+	switch {
+	case raw == "":
+		return "", fmt.Errorf("missing value")
+	case strings.HasPrefix(raw, "\""):
+		return strconv.Unquote(raw)
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") {
+			return "", fmt.Errorf("unterminated string %s", raw)
+		}
+		return raw[1 : len(raw)-1], nil
+	case strings.HasPrefix(raw, "["):
+		if !strings.HasSuffix(raw, "]") {
+			return "", fmt.Errorf("unterminated array %s", raw)
+		}
+		var items []string
+		for _, item := range splitArray(raw[1 : len(raw)-1]) {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			if strings.HasPrefix(item, "[") {
+				return "", fmt.Errorf("nested arrays are not supported")
+			}
+			value, err := parseConfigValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, value)
+		}
+		return strings.Join(items, ","), nil
+	case raw == "true" || raw == "false":
+		return raw, nil
+	}
+	if _, err := strconv.ParseInt(strings.Replace(raw, "_", "", -1), 10, 64); err != nil {
+		return "", fmt.Errorf("unsupported value %s, strings must be quoted", raw)
+	}
+	return strings.Replace(raw, "_", "", -1), nil
+}
+
+// splitArray splits the items of an array on the commas outside strings.
+func splitArray(items string) []string {
+	var parts []string
+	quote := byte(0)
+	start := 0
+	for i := 0; i < len(items); i++ {
+		switch c := items[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == ',':
+			parts = append(parts, items[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, items[start:])
+}
@@ -0,0 +1,196 @@
+package routed
+
+import (
+	"syscall"
+	"testing"
+
+	netApi "github.com/docker/go-plugins-helpers/network"
+)
+
+func TestParseConfig(t *testing.T) {
+	config, err := parseConfig(`
+# Routed plugin settings
+[defaults]
+gateway = "10.100.0.1"
+mtu = 9_000
+
+[routes]
+allowed = ["10.46.0.0/16"]
+denied = [
+  "10.46.255.0/24", # reserved
+  '10.46.254.0/24',
+]
+drain-mode = "metric"
+drain-grace = "10s"
+
+[filtering]
+ingress-allowed = ["10.46.0.0/16", "10.50.0.1-10.50.0.9"]
+
+[observability]
+log-level = "warning"
+admin-socket = "/run/routed/admin#1.sock"
+
+[networks.web]
+mtu = 1400
+gateway-mode = "link-local"
+gateway = "169.254.1.1"
+`)
+	if err != nil {
+		t.Fatalf("TestParseConfig failed: %v", err)
+	}
+	expected := map[string]string{
+		"gateway":         "10.100.0.1",
+		"mtu":             "9000",
+		"allowed-routes":  "10.46.0.0/16",
+		"denied-routes":   "10.46.255.0/24,10.46.254.0/24",
+		"drain-mode":      "metric",
+		"drain-grace":     "10s",
+		"ingress-allowed": "10.46.0.0/16,10.50.0.1-10.50.0.9",
+		"log-level":       "warning",
+		"admin-socket":    "/run/routed/admin#1.sock",
+	}
+	if len(config.Flags) != len(expected) {
+		t.Fatalf("TestParseConfig failed: wrong settings %+v", config.Flags)
+	}
+	for name, value := range expected {
+		if config.Flags[name] != value {
+			t.Fatalf("TestParseConfig failed: %s is %q instead of %q", name, config.Flags[name], value)
+		}
+	}
+	web := config.Networks["web"]
+	if len(config.Networks) != 1 || len(web) != 3 || web[mtuLabel] != "1400" || web[gatewayModeLabel] != GatewayLinkLocal {
+		t.Fatalf("TestParseConfig failed: wrong network profiles %+v", config.Networks)
+	}
+
+	for _, invalid := range []string{
+		"mtu = 9000",
+		"[defaults]\nmtu = 10",
+		"[defaults]\nmtu = \"big\"",
+		"[defaults]\ngateway = 10.100.0.1",
+		"[defaults]\ngateway-mode = \"bridge\"",
+		"[defaults]\ncolor = \"blue\"",
+		"[routes]\nallowed = [\"10.46.0.0/33\"]",
+		"[routes]\ndrain-grace = \"soon\"",
+		"[routes]\ndrain-mode = \"none\"\ndrain-mode = \"metric\"",
+		"[filtering]\ningress-allowed = \"everyone\"",
+		"[observability]\nlog-level = \"loud\"",
+		"[observability]\nmetrics-addr = \"9180\"",
+		"[logging]",
+		"[defaults\n",
+		"[networks.web]\nmetric = -1",
+		"[networks.web]\nreadiness.tcp = \"80\"",
+		"[networks.web]\n[networks.web]",
+		"[routes]\nallowed = [\"10.46.0.0/16\"",
+	} {
+		if _, err := parseConfig(invalid); err == nil {
+			t.Fatalf("TestParseConfig failed: accepted %q", invalid)
+		}
+	}
+}
+
+func TestNetworkProfiles(t *testing.T) {
+	netID := "c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c"
+
+	d, _ := newNetDriver(newFakeNetlink(), newFakeIptables(), newFakeSysctls(), newFakeTc(), "0.1", "10.100.0.1", 1500, "")
+	err := d.SetNetworkProfiles(map[string]map[string]string{
+		"web": {mtuLabel: "9000", metricLabel: "20"},
+	})
+	if err != nil {
+		t.Fatalf("TestNetworkProfiles failed: %v", err)
+	}
+
+	err = d.CreateNetwork(&netApi.CreateNetworkRequest{
+		NetworkID: netID,
+		Options:   map[string]interface{}{profileLabel: "web", metricLabel: "30"},
+	})
+	if n := d.networks[netID]; err != nil || n.mtu != 9000 || n.metric != 30 {
+		t.Fatalf("TestNetworkProfiles failed: CreateNetwork %+v %v", n, err)
+	}
+
+	if err := d.CreateNetwork(&netApi.CreateNetworkRequest{
+		NetworkID: "9f3c1d2e",
+		Options:   map[string]interface{}{profileLabel: "db"},
+	}); err == nil {
+		t.Fatalf("TestNetworkProfiles failed: accepted unknown profile")
+	}
+	if err := d.SetNetworkProfiles(map[string]map[string]string{"web": {mtuLabel: "1"}}); err == nil {
+		t.Fatalf("TestNetworkProfiles failed: accepted invalid profile")
+	}
+}
+
+func TestDefaultPolicy(t *testing.T) {
+	netID := "c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c"
+	eIDs := []string{
+		"4b50fb7f12adb0da3e6662148e9b1bc43b507ad2fd8a0f187ff297cbc88aee05",
+		"8c1d7e2a9f3b4c5d6e7f8a9b0c1d2e3f4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d",
+	}
+
+	fw := newFakeIptables(containersChainName, containerRejectChainName)
+	d, _ := newNetDriver(newFakeNetlink(), fw, newFakeSysctls(), newFakeTc(), "0.1", "10.100.0.1", 1500, "")
+	if err := d.SetDefaultPolicy("10.2.0.0/16"); err != nil {
+		t.Fatalf("TestDefaultPolicy failed: %v", err)
+	}
+	d.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: netID})
+	for i, eID := range eIDs {
+		d.CreateEndpoint(&netApi.CreateEndpointRequest{
+			NetworkID:  netID,
+			EndpointID: eID,
+			Interface:  &netApi.EndpointInterface{Address: []string{"10.1.0.2/32", "10.1.0.3/32"}[i]},
+		})
+		d.Join(&netApi.JoinRequest{NetworkID: netID, EndpointID: eID})
+	}
+	chains := []string{
+		"CONTAINER-" + d.networks[netID].endpoints[eIDs[0]].hostInterfaceName,
+		"CONTAINER-" + d.networks[netID].endpoints[eIDs[1]].hostInterfaceName,
+	}
+	if len(fw.chains[chains[0]]) != 2 || len(fw.chains[chains[1]]) != 2 {
+		t.Fatalf("TestDefaultPolicy failed: default policy not applied %+v", fw.chains)
+	}
+
+	// An endpoint given its own policy keeps it
+	d.SetEndpointPolicy(eIDs[1], "10.3.0.0/16")
+	if err := d.SetDefaultPolicy("10.2.0.0/16,10.4.0.1-10.4.0.9"); err != nil {
+		t.Fatalf("TestDefaultPolicy failed: %v", err)
+	}
+	if len(fw.chains[chains[0]]) != 3 || len(fw.chains[chains[1]]) != 2 || fw.chains[chains[1]][0] != "-s 10.3.0.0/16 -j ACCEPT" {
+		t.Fatalf("TestDefaultPolicy failed: wrong policies after change %+v", fw.chains)
+	}
+
+	// A reload setting the same policy builds no chain
+	fw.failWith("-N", syscall.EPERM)
+	if err := d.SetDefaultPolicy("10.2.0.0/16, 10.4.0.1-10.4.0.9"); err != nil {
+		t.Fatalf("TestDefaultPolicy failed: same policy applied again %v", err)
+	}
+	if len(fw.chains) != 5 || len(fw.chains[chains[0]]) != 3 || len(fw.chains[containersChainName]) != 2 {
+		t.Fatalf("TestDefaultPolicy failed: chains changed by the same policy %+v", fw.chains)
+	}
+	fw.failWith("-N", nil)
+
+	// A policy failing halfway leaves the previous one in force
+	fw.failWith("-I", syscall.EPERM)
+	if err := d.SetDefaultPolicy("10.5.0.0/16"); err == nil {
+		t.Fatalf("TestDefaultPolicy failed: policy applied without jump")
+	}
+	if len(fw.chains) != 5 || len(fw.chains[chains[0]]) != 3 || len(fw.chains[containersChainName]) != 2 ||
+		d.networks[netID].endpoints[eIDs[0]].netFilter.String() != "allow 10.2.0.0/16,10.4.0.1-10.4.0.9" {
+		t.Fatalf("TestDefaultPolicy failed: previous policy not kept %+v", fw.chains)
+	}
+	fw.failWith("-I", nil)
+	if err := d.SetDefaultPolicy("10.5.0.0/16"); err != nil {
+		t.Fatalf("TestDefaultPolicy failed: %v", err)
+	}
+	if len(fw.chains) != 5 || len(fw.chains[chains[0]]) != 2 || fw.chains[chains[0]][0] != "-s 10.5.0.0/16 -j ACCEPT" ||
+		len(fw.chains[containersChainName]) != 2 {
+		t.Fatalf("TestDefaultPolicy failed: policy not replaced %+v", fw.chains)
+	}
+
+	if err := d.SetDefaultPolicy(""); err != nil {
+		t.Fatalf("TestDefaultPolicy failed: %v", err)
+	}
+	if fw.ChainExists(chains[0]) || len(fw.chains[containersChainName]) != 1 {
+		t.Fatalf("TestDefaultPolicy failed: default policy not removed %+v", fw.chains)
+	}
+	if err := d.SetDefaultPolicy("everyone"); err == nil {
+		t.Fatalf("TestDefaultPolicy failed: accepted invalid policy")
+	}
+}
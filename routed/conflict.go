@@ -0,0 +1,121 @@
+package routed
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	ConflictRefuse = "refuse"
+	ConflictWarn   = "warn"
+	ConflictOff    = "off"
+)
+
+// isPeerRoute reports whether route was learned from another host, as
+// opposed to the host routes this plugin installs towards local veths.
+func isPeerRoute(route *netlink.Route) bool {
+	if route.Gw != nil {
+		return true
+	}
+	return route.Protocol > syscall.RTPROT_STATIC && route.Protocol != aggregatedRouteProto
+}
+
+func isHostRouteFor(route *netlink.Route, ip net.IP) bool {
+	if route.Dst == nil || !route.Dst.IP.Equal(ip) {
+		return false
+	}
+	ones, bits := route.Dst.Mask.Size()
+	return ones == bits
+}
+
+// findPeerRoute looks in routes, a snapshot of the kernel routing table,
+// for a host route to ip learned from another host.
+func findPeerRoute(routes []netlink.Route, ip net.IP) *netlink.Route {
+	for i := range routes {
+		if isHostRouteFor(&routes[i], ip) && isPeerRoute(&routes[i]) {
+			return &routes[i]
+		}
+	}
+	return nil
+}
+
+// conflictWatcher reports allocated addresses that are also routed to
+// another host.
+type conflictWatcher struct {
+	nl       Netlink
+	pool     *routedPool
+	reported map[string]bool
+	m        sync.Mutex
+}
+
+func (w *conflictWatcher) report(route *netlink.Route) {
+	addr := route.Dst.String()
+
+	w.pool.m.Lock()
+	allocated := w.pool.allocatedIPs[addr] && !w.pool.gateway.IP.Equal(route.Dst.IP)
+	w.pool.m.Unlock()
+
+	w.m.Lock()
+	defer w.m.Unlock()
+	if !allocated {
+		delete(w.reported, addr)
+		return
+	}
+	if w.reported[addr] {
+		return
+	}
+	w.reported[addr] = true
+	log.WithFields(log.Fields{
+		"event":   "conflict",
+		"address": addr,
+	}).Warnf("conflictWatcher: address %s allocated locally is also routed via %s", addr, route.Gw)
+}
+
+func (w *conflictWatcher) clear(route *netlink.Route) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	delete(w.reported, route.Dst.String())
+}
+
+func (w *conflictWatcher) scan() error {
+	routes, err := w.nl.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	for i := range routes {
+		if routes[i].Dst != nil && isHostRouteFor(&routes[i], routes[i].Dst.IP) && isPeerRoute(&routes[i]) {
+			w.report(&routes[i])
+		}
+	}
+	return nil
+}
+
+func (w *conflictWatcher) run(done <-chan struct{}) error {
+	updates := make(chan netlink.RouteUpdate)
+	if err := w.nl.RouteSubscribe(updates, done); err != nil {
+		return fmt.Errorf("Unable to subscribe to route updates: %v", err)
+	}
+
+	if err := w.scan(); err != nil {
+		log.Warnf("conflictWatcher: initial scan failed: %v", err)
+	}
+
+	for update := range updates {
+		route := update.Route
+		if route.Dst == nil || !isHostRouteFor(&route, route.Dst.IP) || !isPeerRoute(&route) {
+			continue
+		}
+		switch update.Type {
+		case syscall.RTM_NEWROUTE:
+			w.report(&route)
+		case syscall.RTM_DELROUTE:
+			w.clear(&route)
+		}
+	}
+	return nil
+}
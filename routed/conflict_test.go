@@ -0,0 +1,66 @@
+package routed
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	ipamApi "github.com/docker/go-plugins-helpers/ipam"
+	"github.com/vishvananda/netlink"
+)
+
+func TestPeerRoute(t *testing.T) {
+	ip := net.ParseIP("10.1.2.3")
+	dst := ParseIpOrNet("10.1.2.3")
+
+	local := &netlink.Route{LinkIndex: 7, Dst: dst, Protocol: syscall.RTPROT_BOOT}
+	if !isHostRouteFor(local, ip) || isPeerRoute(local) {
+		t.Fatalf("TestPeerRoute failed: local route %+v", local)
+	}
+
+	aggregated := &netlink.Route{LinkIndex: 7, Dst: dst, Protocol: aggregatedRouteProto}
+	if isPeerRoute(aggregated) {
+		t.Fatalf("TestPeerRoute failed: aggregated route %+v", aggregated)
+	}
+
+	learned := &netlink.Route{LinkIndex: 2, Dst: dst, Gw: net.ParseIP("10.112.11.7"), Protocol: 11}
+	if !isHostRouteFor(learned, ip) || !isPeerRoute(learned) {
+		t.Fatalf("TestPeerRoute failed: learned route %+v", learned)
+	}
+
+	block := &netlink.Route{LinkIndex: 2, Dst: ParseIpOrNet("10.1.2.0/24"), Gw: net.ParseIP("10.112.11.7")}
+	if isHostRouteFor(block, net.ParseIP("10.1.2.0")) {
+		t.Fatalf("TestPeerRoute failed: block route %+v", block)
+	}
+}
+
+func TestConflictModes(t *testing.T) {
+	nl := newFakeNetlink()
+	uplink := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth1"}}
+	nl.LinkAdd(uplink)
+	// Another host announces 10.1.0.2
+	nl.RouteAdd(&netlink.Route{LinkIndex: uplink.Index, Dst: ParseIpOrNet("10.1.0.2"), Gw: net.ParseIP("10.0.0.2"), Protocol: syscall.RTPROT_ZEBRA})
+
+	d, _ := newIpamDriver(nl, "0.1", "10.100.0.1", "")
+	d.SetConflictMode(ConflictRefuse)
+	if _, err := d.RequestAddress(&ipamApi.RequestAddressRequest{PoolID: "routed", Address: "10.1.0.2"}); err == nil {
+		t.Fatalf("TestConflictModes failed: refuse mode allocated a routed address")
+	}
+	if _, err := d.RequestAddress(&ipamApi.RequestAddressRequest{PoolID: "routed", Address: "10.1.0.3"}); err != nil {
+		t.Fatalf("TestConflictModes failed: refuse mode %v", err)
+	}
+
+	d.SetConflictMode(ConflictWarn)
+	if _, err := d.RequestAddress(&ipamApi.RequestAddressRequest{PoolID: "routed", Address: "10.1.0.2"}); err != nil {
+		t.Fatalf("TestConflictModes failed: warn mode %v", err)
+	}
+
+	// The watcher finds the allocated address routed elsewhere
+	w := &conflictWatcher{nl: nl, pool: d.pool, reported: make(map[string]bool)}
+	if err := w.scan(); err != nil {
+		t.Fatalf("TestConflictModes failed: scan %v", err)
+	}
+	if len(w.reported) != 1 || !w.reported["10.1.0.2/32"] {
+		t.Fatalf("TestConflictModes failed: wrong conflicts %+v", w.reported)
+	}
+}
@@ -0,0 +1,215 @@
+package routed
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// Penalty added each time the route to an address is withdrawn
+	flapPenalty = 1000
+	// Penalty above which announcing the address is held back
+	suppressPenalty = 3000
+	// Penalty below which a held back address can be announced again
+	reusePenalty = 750
+	// Upper bound of the penalty, which bounds the time an address is held back
+	maxPenalty = 12000
+)
+
+// DampeningState is the flap state of an endpoint address.
+type DampeningState struct {
+	Address    string        `json:"address"`
+	Penalty    float64       `json:"penalty"`
+	Suppressed bool          `json:"suppressed"`
+	ReuseIn    time.Duration `json:"reuse_in"`
+}
+
+type byAddress []DampeningState
+
+func (s byAddress) Len() int           { return len(s) }
+func (s byAddress) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byAddress) Less(i, j int) bool { return s[i].Address < s[j].Address }
+
+type flapState struct {
+	penalty    float64
+	updated    time.Time
+	suppressed bool
+}
+
+// dampening tracks how often the route to each endpoint address is withdrawn
+// and holds back announcing addresses that flap. The penalty of an address
+// halves every halfLife.
+type dampening struct {
+	halfLife time.Duration
+	entries  map[string]*flapState
+	now      func() time.Time
+	m        sync.Mutex
+}
+
+func newDampening(halfLife time.Duration) *dampening {
+	return &dampening{
+		halfLife: halfLife,
+		entries:  make(map[string]*flapState),
+		now:      time.Now,
+	}
+}
+
+func (d *dampening) enabled() bool {
+	return d != nil && d.halfLife > 0
+}
+
+// decay brings the penalty of addr up to now and forgets the address once
+// it no longer has a penalty. Caller must hold the lock.
+func (d *dampening) decay(addr string, now time.Time) *flapState {
+	st, ok := d.entries[addr]
+	if !ok {
+		return nil
+	}
+	elapsed := now.Sub(st.updated)
+	st.penalty *= math.Pow(0.5, float64(elapsed)/float64(d.halfLife))
+	st.updated = now
+	if st.penalty < reusePenalty {
+		st.suppressed = false
+	}
+	if st.penalty < 1 {
+		delete(d.entries, addr)
+		return nil
+	}
+	return st
+}
+
+// reuseIn is the time until the penalty of st decays below the reuse level.
+func (d *dampening) reuseIn(st *flapState) time.Duration {
+	if !st.suppressed {
+		return 0
+	}
+	return time.Duration(float64(d.halfLife) * math.Log2(st.penalty/reusePenalty))
+}
+
+// withdrawn records the route to addr being withdrawn.
+func (d *dampening) withdrawn(addr string) {
+	if !d.enabled() {
+		return
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	now := d.now()
+	st := d.decay(addr, now)
+	if st == nil {
+		st = &flapState{updated: now}
+		d.entries[addr] = st
+	}
+	st.penalty = math.Min(st.penalty+flapPenalty, maxPenalty)
+	if st.penalty >= suppressPenalty {
+		st.suppressed = true
+	}
+}
+
+// announce returns how long announcing the route to addr must be held back,
+// zero if it can be announced now.
+func (d *dampening) announce(addr string) time.Duration {
+	if !d.enabled() {
+		return 0
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	st := d.decay(addr, d.now())
+	if st == nil {
+		return 0
+	}
+	return d.reuseIn(st)
+}
+
+func (d *dampening) snapshot() []DampeningState {
+	if !d.enabled() {
+		return nil
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	now := d.now()
+	states := []DampeningState{}
+	for addr := range d.entries {
+		st := d.decay(addr, now)
+		if st == nil {
+			continue
+		}
+		states = append(states, DampeningState{
+			Address:    addr,
+			Penalty:    st.penalty,
+			Suppressed: st.suppressed,
+			ReuseIn:    d.reuseIn(st),
+		})
+	}
+	sort.Sort(byAddress(states))
+	return states
+}
+
+// SetDampening enables holding back the routes of endpoint addresses that
+// are withdrawn too often. The penalty of each withdrawal halves every
+// halfLife, zero disables dampening.
+func (d *NetDriver) SetDampening(halfLife time.Duration) error {
+	if halfLife < 0 {
+		return fmt.Errorf("Invalid dampening half life %s", halfLife)
+	}
+	d.dampening = newDampening(halfLife)
+	return nil
+}
+
+// DampeningStates returns the addresses with a flap penalty.
+func (d *NetDriver) DampeningStates() []DampeningState {
+	return d.dampening.snapshot()
+}
+
+func (d *NetDriver) scheduleAnnounce(nid string, eid string, wait time.Duration) {
+	time.AfterFunc(wait, func() {
+		d.announceSuppressed(nid, eid)
+	})
+}
+
+// announceSuppressed installs the held back route of an endpoint of the
+// network nid once its address is no longer dampened.
+func (d *NetDriver) announceSuppressed(nid string, eid string) {
+	network, err := d.getNetwork(nid)
+	if err != nil {
+		return
+	}
+
+	network.m.Lock()
+	defer network.m.Unlock()
+
+	ep, ok := network.endpoints[eid]
+	if !ok || !ep.joined || !ep.suppressed {
+		return
+	}
+
+	if wait := d.dampening.announce(ep.ipv4Address.String()); wait > 0 {
+		d.scheduleAnnounce(nid, eid, wait)
+		return
+	}
+
+	link, err := d.nl.LinkByName(ep.hostInterfaceName)
+	if err != nil {
+		log.Errorf("announceSuppressed: Can't find host interface %s: %v", ep.hostInterfaceName, err)
+		return
+	}
+	ep.suppressed = false
+	if !ep.routable() {
+		return
+	}
+	if err := d.announceRoute(network, ep, link); err != nil {
+		ep.suppressed = true
+		return
+	}
+	log.Infof("announceSuppressed: Announced dampened route to %s", ep.ipv4Address)
+}
@@ -0,0 +1,46 @@
+package routed
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDampening(t *testing.T) {
+	addr := "10.1.2.3/32"
+	now := time.Unix(0, 0)
+
+	d := newDampening(time.Minute)
+	d.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		d.withdrawn(addr)
+		if wait := d.announce(addr); wait != 0 {
+			t.Fatalf("TestDampening failed: suppressed after %d flaps for %s", i+1, wait)
+		}
+	}
+
+	d.withdrawn(addr)
+	wait := d.announce(addr)
+	if wait != 2*time.Minute {
+		t.Fatalf("TestDampening failed: suppressed for %s, expected 2m", wait)
+	}
+
+	states := d.snapshot()
+	if len(states) != 1 || !states[0].Suppressed || states[0].Penalty != 3000 {
+		t.Fatalf("TestDampening failed: wrong state %+v", states)
+	}
+
+	now = now.Add(wait)
+	if wait := d.announce(addr); wait != 0 {
+		t.Fatalf("TestDampening failed: still suppressed for %s", wait)
+	}
+
+	now = now.Add(time.Hour)
+	if states := d.snapshot(); len(states) != 0 {
+		t.Fatalf("TestDampening failed: address not forgotten %+v", states)
+	}
+
+	if newDampening(0).announce(addr) != 0 {
+		t.Fatalf("TestDampening failed: disabled dampening suppressed address")
+	}
+}
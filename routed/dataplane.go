@@ -0,0 +1,282 @@
+package routed
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	dataplaneLabel  = labelPrefix + "dataplane"
+	ipvlanParent    = labelPrefix + "ipvlan.parent"
+	ipvlanModeLabel = labelPrefix + "ipvlan.mode"
+
+	vethDataplane   = "veth"
+	ipvlanDataplane = "ipvlan"
+
+	ipvlanPrefix = "ipvr"
+
+	// IPVLAN_MODE_L3S, not known by the vendored netlink
+	ipvlanModeL3S netlink.IPVlanMode = 2
+)
+
+// Dataplane creates the links connecting the containers of a network to the
+// host. The IPAM, the host routes and the filtering are shared by all of
+// them.
+type Dataplane interface {
+	// CreateLinks creates the links of an endpoint: the host side link the
+	// container route points to, and the container side link Docker moves
+	// into the sandbox.
+	CreateLinks(eid string) (hostIface netlink.Link, containerIface netlink.Link, err error)
+	// DeleteLinks removes the links of an endpoint found in the host
+	// namespace.
+	DeleteLinks(hostIfaceName string, containerIfaceName string) error
+	// SetsMac reports whether the container side link takes the endpoint MAC.
+	SetsMac() bool
+	// FilterTarget returns the name the filtering chain of an endpoint is
+	// derived from and the iptables match for traffic going to it.
+	FilterTarget(ep *routedEndpoint) (name string, match []string)
+	// SharesHostLink reports whether the endpoints share one host link.
+	// Traffic to them then doesn't go through the host FORWARD chain, and
+	// neither traffic limits nor ingress filtering apply.
+	SharesHostLink() bool
+	// HostLink returns the name of the host link shared by the endpoints,
+	// empty when they have links of their own.
+	HostLink() string
+	// Statistics returns the counters of the host side link of an endpoint,
+	// nil when the endpoint has no link of its own on the host.
+	Statistics(ep *routedEndpoint) (*netlink.LinkStatistics, error)
+	// Release removes the links shared by the endpoints of the network.
+	Release() error
+}
+
+// newDataplane returns the data plane selected by the options of a network,
+// veth pairs by default.
+func newDataplane(nl Netlink, netID string, vethPrefix string, labels map[string]string) (Dataplane, error) {
+	switch labels[dataplaneLabel] {
+	case "", vethDataplane:
+		return &vethPairs{nl: nl, prefix: vethPrefix}, nil
+	case ipvlanDataplane:
+		return newIpvlans(nl, netID, labels)
+	}
+	return nil, fmt.Errorf("Unknown dataplane %s", labels[dataplaneLabel])
+}
+
+func deleteLinkByName(nl Netlink, name string) error {
+	link, err := nl.LinkByName(name)
+	if err != nil {
+		// The link might have already been deleted by sandbox delete.
+		log.Debugf("deleteLinkByName: Can't find interface: %s, %v ", name, err)
+		return nil
+	}
+	log.Debugf("deleteLinkByName: Deleting interface %s", name)
+	return nl.LinkDel(link)
+}
+
+// vethPairs connects each container with a veth pair named after prefix.
+type vethPairs struct {
+	nl     Netlink
+	prefix string
+}
+
+func (v *vethPairs) CreateLinks(eid string) (netlink.Link, netlink.Link, error) {
+	// Generate host-side veth name
+	hostIfaceName, err := generateIfaceName(v.nl, v.prefix+string(eid)[:4])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Generate container-side veth name
+	containerIfaceName, err := generateIfaceName(v.nl, v.prefix+string(eid)[:4])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:   hostIfaceName,
+			TxQLen: 0,
+		},
+		PeerName: containerIfaceName,
+	}
+
+	log.Debugf("CreateLinks: Adding link %+v", veth)
+	if err := v.nl.LinkAdd(veth); err != nil {
+		log.Errorf("CreateLinks: Unable to add link %+v:%+v", veth, err)
+		return nil, nil, err
+	}
+
+	hostIface, err := v.nl.LinkByName(hostIfaceName)
+	if err != nil {
+		log.Errorf("CreateLinks: Can't find host interface %s", hostIfaceName)
+		v.nl.LinkDel(veth)
+		return nil, nil, err
+	}
+
+	containerIface, err := v.nl.LinkByName(containerIfaceName)
+	if err != nil {
+		log.Errorf("CreateLinks: Can't find container interface %s", containerIfaceName)
+		v.nl.LinkDel(hostIface)
+		return nil, nil, err
+	}
+
+	return hostIface, containerIface, nil
+}
+
+func (v *vethPairs) DeleteLinks(hostIfaceName string, containerIfaceName string) error {
+	// Deleting the host side takes the peer with it
+	return deleteLinkByName(v.nl, hostIfaceName)
+}
+
+func (v *vethPairs) SetsMac() bool {
+	return true
+}
+
+func (v *vethPairs) FilterTarget(ep *routedEndpoint) (string, []string) {
+	return ep.hostInterfaceName, []string{"-o", ep.hostInterfaceName}
+}
+
+func (v *vethPairs) SharesHostLink() bool {
+	return false
+}
+
+func (v *vethPairs) HostLink() string {
+	return ""
+}
+
+func (v *vethPairs) Statistics(ep *routedEndpoint) (*netlink.LinkStatistics, error) {
+	link, err := v.nl.LinkByName(ep.hostInterfaceName)
+	if err != nil {
+		return nil, err
+	}
+	return link.Attrs().Statistics, nil
+}
+
+func (v *vethPairs) Release() error {
+	return nil
+}
+
+// ipvlans connects each container with an ipvlan link on a parent interface.
+// The host reaches the containers through an ipvlan link of its own on the
+// same parent, which the container routes point to.
+type ipvlans struct {
+	nl       Netlink
+	parent   string
+	mode     netlink.IPVlanMode
+	hostName string
+}
+
+func newIpvlans(nl Netlink, netID string, labels map[string]string) (*ipvlans, error) {
+	i := &ipvlans{
+		nl:       nl,
+		parent:   labels[ipvlanParent],
+		hostName: ipvlanPrefix + "h" + netID[:6],
+	}
+	if i.parent == "" {
+		return nil, fmt.Errorf("The ipvlan dataplane needs a parent interface in %s", ipvlanParent)
+	}
+
+	switch strings.ToLower(labels[ipvlanModeLabel]) {
+	case "", "l3":
+		i.mode = netlink.IPVLAN_MODE_L3
+	case "l3s":
+		i.mode = ipvlanModeL3S
+	default:
+		return nil, fmt.Errorf("Invalid ipvlan mode %s", labels[ipvlanModeLabel])
+	}
+	return i, nil
+}
+
+func (i *ipvlans) addLink(name string) (netlink.Link, error) {
+	parent, err := i.nl.LinkByName(i.parent)
+	if err != nil {
+		return nil, fmt.Errorf("Can't find ipvlan parent interface %s: %v", i.parent, err)
+	}
+
+	ipvlan := &netlink.IPVlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        name,
+			ParentIndex: parent.Attrs().Index,
+		},
+		Mode: i.mode,
+	}
+
+	log.Debugf("CreateLinks: Adding link %+v", ipvlan)
+	if err := i.nl.LinkAdd(ipvlan); err != nil {
+		log.Errorf("CreateLinks: Unable to add link %+v:%+v", ipvlan, err)
+		return nil, err
+	}
+	return i.nl.LinkByName(name)
+}
+
+// hostLink returns the host ipvlan link, creating it on first use.
+func (i *ipvlans) hostLink() (netlink.Link, error) {
+	if link, err := i.nl.LinkByName(i.hostName); err == nil {
+		return link, nil
+	}
+
+	link, err := i.addLink(i.hostName)
+	if err != nil {
+		return nil, err
+	}
+	if err := i.nl.LinkSetUp(link); err != nil {
+		i.nl.LinkDel(link)
+		return nil, fmt.Errorf("could not set link up for host interface %s, %v", i.hostName, err)
+	}
+	log.Infof("CreateLinks: Created host ipvlan interface %s on %s", i.hostName, i.parent)
+	return link, nil
+}
+
+func (i *ipvlans) CreateLinks(eid string) (netlink.Link, netlink.Link, error) {
+	hostIface, err := i.hostLink()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	containerIfaceName, err := generateIfaceName(i.nl, ipvlanPrefix+string(eid)[:4])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	containerIface, err := i.addLink(containerIfaceName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return hostIface, containerIface, nil
+}
+
+func (i *ipvlans) DeleteLinks(hostIfaceName string, containerIfaceName string) error {
+	// The host link is shared by all the endpoints of the network
+	return deleteLinkByName(i.nl, containerIfaceName)
+}
+
+func (i *ipvlans) SetsMac() bool {
+	// ipvlan links share the MAC of their parent
+	return false
+}
+
+// FilterTarget names the chain after the container link. Ingress filtering
+// is refused on ipvlan networks, see errNoIngressFiltering.
+func (i *ipvlans) FilterTarget(ep *routedEndpoint) (string, []string) {
+	return ep.containerIfaceName, []string{"-d", ep.ipv4Address.String()}
+}
+
+func (i *ipvlans) SharesHostLink() bool {
+	return true
+}
+
+func (i *ipvlans) HostLink() string {
+	return i.hostName
+}
+
+func (i *ipvlans) Statistics(ep *routedEndpoint) (*netlink.LinkStatistics, error) {
+	// The host link is shared, the container link is in the sandbox
+	return nil, nil
+}
+
+func (i *ipvlans) Release() error {
+	return deleteLinkByName(i.nl, i.hostName)
+}
@@ -0,0 +1,95 @@
+package routed
+
+import (
+	"strings"
+	"testing"
+
+	netApi "github.com/docker/go-plugins-helpers/network"
+	"github.com/vishvananda/netlink"
+)
+
+func TestDataplane(t *testing.T) {
+	netID := "c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c"
+
+	dp, err := newDataplane(newFakeNetlink(), netID, vethPrefix, map[string]string{})
+	if _, ok := dp.(*vethPairs); !ok || err != nil {
+		t.Fatalf("TestDataplane failed: default dataplane %+v %v", dp, err)
+	}
+
+	dp, err = newDataplane(newFakeNetlink(), netID, vethPrefix, map[string]string{
+		"routed.dataplane":     "ipvlan",
+		"routed.ipvlan.parent": "eth1",
+		"routed.ipvlan.mode":   "L3S",
+	})
+	ipvlan, ok := dp.(*ipvlans)
+	if !ok || err != nil {
+		t.Fatalf("TestDataplane failed: ipvlan dataplane %+v %v", dp, err)
+	}
+	if ipvlan.parent != "eth1" || ipvlan.mode != ipvlanModeL3S || ipvlan.hostName != "ipvrhc56656" {
+		t.Fatalf("TestDataplane failed: wrong ipvlan dataplane %+v", ipvlan)
+	}
+	if ipvlan.SetsMac() {
+		t.Fatalf("TestDataplane failed: ipvlan sets MAC")
+	}
+
+	dp, err = newDataplane(newFakeNetlink(), netID, vethPrefix, map[string]string{
+		"routed.dataplane":     "ipvlan",
+		"routed.ipvlan.parent": "eth1",
+	})
+	if ipvlan, ok := dp.(*ipvlans); !ok || err != nil || ipvlan.mode != netlink.IPVLAN_MODE_L3 {
+		t.Fatalf("TestDataplane failed: default ipvlan mode %+v %v", dp, err)
+	}
+
+	for _, labels := range []map[string]string{
+		{"routed.dataplane": "macvlan"},
+		{"routed.dataplane": "ipvlan"},
+		{"routed.dataplane": "ipvlan", "routed.ipvlan.parent": "eth1", "routed.ipvlan.mode": "l2"},
+	} {
+		if _, err := newDataplane(newFakeNetlink(), netID, vethPrefix, labels); err == nil {
+			t.Fatalf("TestDataplane failed: accepted %v", labels)
+		}
+	}
+}
+
+func TestIpvlanFiltering(t *testing.T) {
+	netID := "c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c"
+	eID := "4b50fb7f12adb0da3e6662148e9b1bc43b507ad2fd8a0f187ff297cbc88aee05"
+	options := map[string]interface{}{"routed.dataplane": "ipvlan", "routed.ipvlan.parent": "eth1"}
+
+	nl := newFakeNetlink()
+	nl.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth1"}})
+	sc := newFakeSysctls()
+	d, _ := newNetDriver(nl, newFakeIptables(containersChainName, containerRejectChainName), sc, newFakeTc(), "0.1", "10.100.0.1", 1500, "")
+
+	// Traffic to ipvlan containers doesn't cross the FORWARD chain
+	d.SetDefaultPolicy("10.2.0.0/16")
+	if err := d.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: netID, Options: options}); err == nil {
+		t.Fatalf("TestIpvlanFiltering failed: ipvlan network created with a default policy")
+	}
+	d.SetDefaultPolicy("")
+	if err := d.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: netID, Options: options}); err != nil {
+		t.Fatalf("TestIpvlanFiltering failed: CreateNetwork %v", err)
+	}
+	if err := d.SetDefaultPolicy("10.2.0.0/16"); err == nil || d.policy.get() != nil {
+		t.Fatalf("TestIpvlanFiltering failed: default policy set on an ipvlan network")
+	}
+
+	d.CreateEndpoint(&netApi.CreateEndpointRequest{
+		NetworkID:  netID,
+		EndpointID: eID,
+		Interface:  &netApi.EndpointInterface{Address: "10.1.0.2/32"},
+	})
+	if _, err := d.Join(&netApi.JoinRequest{NetworkID: netID, EndpointID: eID}); err != nil {
+		t.Fatalf("TestIpvlanFiltering failed: Join %v", err)
+	}
+	if err := d.SetEndpointPolicy(eID, "10.3.0.0/16"); err == nil {
+		t.Fatalf("TestIpvlanFiltering failed: endpoint policy set on an ipvlan network")
+	}
+
+	// The shared host link keeps the host settings
+	for name := range sc.values {
+		if strings.Contains(name, ipvlanPrefix) {
+			t.Fatalf("TestIpvlanFiltering failed: set %s on the host link", name)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package routed
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	CheckPass = "pass"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+
+	pluginDir = "/run/docker/plugins"
+)
+
+// CheckResult is the outcome of a host check, with how to fix it when it
+// did not pass.
+type CheckResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+	Fix    string `json:"fix,omitempty"`
+}
+
+// routingDaemon is a routing daemon that can announce the container routes,
+// and how its configuration tells it to.
+type routingDaemon struct {
+	process string
+	configs []string
+	pattern string
+	fix     string
+}
+
+var routingDaemons = []routingDaemon{
+	{"ospfd", []string{"/etc/quagga/ospfd.conf", "/etc/frr/frr.conf"}, "redistribute kernel",
+		"add 'redistribute kernel' under 'router ospf'"},
+	{"bgpd", []string{"/etc/quagga/bgpd.conf", "/etc/frr/frr.conf"}, "redistribute kernel",
+		"add 'redistribute kernel' under 'router bgp'"},
+	{"bird", []string{"/etc/bird/bird.conf", "/etc/bird.conf"}, "learn",
+		"add 'learn;' to the kernel protocol and export its routes"},
+}
+
+// Doctor checks that the host can run routed networks, as set up by the
+// Vagrantfile and described in the README.
+type Doctor struct {
+	nl          Netlink
+	fw          Firewall
+	sc          Sysctls
+	gateway     string
+	gatewayMode string
+	// Host access, replaced in tests
+	readFile  func(path string) ([]byte, error)
+	processes func() ([]string, error)
+	lookPath  func(file string) (string, error)
+	exists    func(path string) bool
+}
+
+func NewDoctor(gateway string, gatewayMode string) *Doctor {
+	return newDoctor(hostNetlink{}, hostIptables{}, hostSysctls{}, gateway, gatewayMode)
+}
+
+func newDoctor(nl Netlink, fw Firewall, sc Sysctls, gateway string, gatewayMode string) *Doctor {
+	return &Doctor{
+		nl:          nl,
+		fw:          fw,
+		sc:          sc,
+		gateway:     gateway,
+		gatewayMode: gatewayMode,
+		readFile:    ioutil.ReadFile,
+		processes:   hostProcesses,
+		lookPath:    exec.LookPath,
+		exists: func(path string) bool {
+			_, err := os.Stat(path)
+			return err == nil
+		},
+	}
+}
+
+// hostProcesses returns the command names of the running processes.
+func hostProcesses() ([]string, error) {
+	paths, err := filepath.Glob("/proc/[0-9]*/comm")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, path := range paths {
+		if comm, err := ioutil.ReadFile(path); err == nil {
+			names = append(names, strings.TrimSpace(string(comm)))
+		}
+	}
+	return names, nil
+}
+
+// Run performs all the checks.
+func (d *Doctor) Run() []CheckResult {
+	return []CheckResult{
+		d.checkForwarding(),
+		d.checkChain(containersChainName, "iptables -N CONTAINERS && iptables -A CONTAINERS -j RETURN"),
+		d.checkChain(containerRejectChainName, "iptables -N CONTAINER-REJECT && iptables -A CONTAINER-REJECT -p tcp -j REJECT --reject-with tcp-reset && iptables -A CONTAINER-REJECT -j REJECT"),
+		d.checkForwardJump(),
+		d.checkGateway(),
+		d.checkUplinkProxyArp(),
+		d.checkRoutingDaemon(),
+		d.checkPluginDir(),
+		d.checkTc(),
+	}
+}
+
+// Healthy reports whether no check failed.
+func Healthy(results []CheckResult) bool {
+	for _, r := range results {
+		if r.Status == CheckFail {
+			return false
+		}
+	}
+	return true
+}
+
+func pass(name string, format string, args ...interface{}) CheckResult {
+	return CheckResult{Name: name, Status: CheckPass, Detail: fmt.Sprintf(format, args...)}
+}
+
+func failed(name string, status string, fix string, format string, args ...interface{}) CheckResult {
+	return CheckResult{Name: name, Status: status, Detail: fmt.Sprintf(format, args...), Fix: fix}
+}
+
+func (d *Doctor) checkForwarding() CheckResult {
+	name := "ip forwarding"
+	fix := "sysctl -w net.ipv4.ip_forward=1, or start the plugin with --host-sysctls fix"
+	value, err := d.sc.Get("net.ipv4.ip_forward")
+	if err != nil {
+		return failed(name, CheckFail, fix, "can't read net.ipv4.ip_forward: %v", err)
+	}
+	if value != "1" {
+		return failed(name, CheckFail, fix, "net.ipv4.ip_forward is %s", value)
+	}
+	return pass(name, "net.ipv4.ip_forward is 1")
+}
+
+func (d *Doctor) checkChain(chain string, fix string) CheckResult {
+	name := "iptables chain " + chain
+	if !d.fw.ChainExists(chain) {
+		return failed(name, CheckFail, fix, "chain %s is missing, ingress filtering can't be applied", chain)
+	}
+	return pass(name, "chain %s exists", chain)
+}
+
+func (d *Doctor) checkForwardJump() CheckResult {
+	name := "forwarded traffic filtering"
+	fix := "iptables -I FORWARD 4 -j CONTAINERS, after the rules accepting established traffic"
+	rules, err := listRules(d.fw, "filter", "FORWARD")
+	if err != nil {
+		return failed(name, CheckWarn, fix, "%v", err)
+	}
+	for _, rule := range rules {
+		if ruleOption(rule, "-j") == containersChainName {
+			return pass(name, "FORWARD jumps to %s", containersChainName)
+		}
+	}
+	return failed(name, CheckWarn, fix, "FORWARD doesn't jump to %s, containers are not filtered", containersChainName)
+}
+
+// hostAddress returns the name of the host link having the address ip, or
+// an empty string.
+func (d *Doctor) hostAddress(ip net.IP) (string, error) {
+	links, err := d.nl.LinkList()
+	if err != nil {
+		return "", err
+	}
+	for _, link := range links {
+		addrs, err := d.nl.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return "", err
+		}
+		for _, addr := range addrs {
+			if addr.IPNet.IP.Equal(ip) {
+				return link.Attrs().Name, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func (d *Doctor) checkGateway() CheckResult {
+	name := "gateway"
+	fix := "start the plugin with --gateway set to a unicast IPv4 address"
+	if d.gateway == "" {
+		return failed(name, CheckWarn, "run the doctor with the --gateway the plugin is started with", "gateway not given, not checked")
+	}
+	ip, err := parseGateway(d.gateway)
+	if err != nil {
+		return failed(name, CheckFail, fix, "%v", err)
+	}
+	if ip.IsUnspecified() || ip.IsLoopback() || ip.IsMulticast() || ip.Equal(net.IPv4bcast) {
+		return failed(name, CheckFail, fix, "gateway %s is not a unicast address", ip)
+	}
+	if err := checkGatewayMode(d.gatewayMode, d.gateway); err != nil {
+		return failed(name, CheckFail, "start the plugin with a gateway in "+linkLocalNet.String()+", or without --gateway", "%v", err)
+	}
+	if d.gatewayMode == GatewayLinkLocal {
+		return pass(name, "gateway %s is added to each host veth", ip)
+	}
+
+	iface, err := d.hostAddress(ip)
+	if err != nil {
+		return failed(name, CheckWarn, "", "can't list host addresses: %v", err)
+	}
+	if iface != "" {
+		return pass(name, "gateway %s is an address of %s", ip, iface)
+	}
+	return pass(name, "gateway %s is virtual, answered by proxy_arp on the host veths", ip)
+}
+
+// uplink returns the link of the default route.
+func (d *Doctor) uplink() (netlink.Link, error) {
+	routes, err := d.nl.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	links, err := d.nl.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	for _, route := range routes {
+		if route.Dst != nil {
+			continue
+		}
+		for _, link := range links {
+			if link.Attrs().Index == route.LinkIndex {
+				return link, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (d *Doctor) checkUplinkProxyArp() CheckResult {
+	name := "uplink proxy_arp"
+	link, err := d.uplink()
+	if err != nil {
+		return failed(name, CheckWarn, "", "can't find the default route: %v", err)
+	}
+	if link == nil {
+		return failed(name, CheckWarn, "add a default route through the uplink", "no default route, can't tell the uplink")
+	}
+
+	iface := link.Attrs().Name
+	setting := "net.ipv4.conf." + iface + ".proxy_arp"
+	fix := fmt.Sprintf("sysctl -w %s=1, and add it to /etc/sysctl.conf", setting)
+	value, err := d.sc.Get(setting)
+	if err != nil {
+		return failed(name, CheckWarn, fix, "can't read %s: %v", setting, err)
+	}
+	if value != "1" {
+		return failed(name, CheckWarn, fix, "%s is %s, hosts on the uplink without a route to the containers can't reach them", setting, value)
+	}
+	return pass(name, "%s is 1", setting)
+}
+
+func (d *Doctor) checkRoutingDaemon() CheckResult {
+	name := "routing daemon"
+	names, err := d.processes()
+	if err != nil {
+		return failed(name, CheckWarn, "", "can't list processes: %v", err)
+	}
+	running := make(map[string]bool)
+	for _, n := range names {
+		running[n] = true
+	}
+
+	// Any running daemon announcing the routes will do
+	var result *CheckResult
+	for _, daemon := range routingDaemons {
+		if !running[daemon.process] {
+			continue
+		}
+		var read []string
+		for _, config := range daemon.configs {
+			data, err := d.readFile(config)
+			if err != nil {
+				continue
+			}
+			if configHas(string(data), daemon.pattern) {
+				return pass(name, "%s redistributes kernel routes (%s)", daemon.process, config)
+			}
+			read = append(read, config)
+		}
+		if result != nil {
+			continue
+		}
+		if len(read) > 0 {
+			r := failed(name, CheckFail, daemon.fix+" in "+strings.Join(read, " or "),
+				"%s doesn't redistribute kernel routes, other hosts won't learn the container routes", daemon.process)
+			result = &r
+		} else {
+			r := failed(name, CheckWarn, "", "%s runs but none of %s could be read to check it redistributes kernel routes",
+				daemon.process, strings.Join(daemon.configs, ", "))
+			result = &r
+		}
+	}
+	if result != nil {
+		return *result
+	}
+	return failed(name, CheckFail, "run Quagga ospfd with 'redistribute kernel', see the README",
+		"no routing daemon runs, other hosts won't learn the container routes")
+}
+
+// configHas reports whether a line of a routing daemon configuration
+// contains pattern, outside of Quagga ! and BIRD # comments.
+func configHas(config string, pattern string) bool {
+	for _, line := range strings.Split(config, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "!") {
+			continue
+		}
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if strings.Contains(line, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Doctor) checkPluginDir() CheckResult {
+	name := "plugin directory"
+	if !d.exists(pluginDir) {
+		return failed(name, CheckFail, "mkdir -p "+pluginDir+", and mount it in the plugin container with -v "+pluginDir+":"+pluginDir,
+			"%s is missing, Docker can't find the plugin sockets", pluginDir)
+	}
+	return pass(name, "%s exists", pluginDir)
+}
+
+func (d *Doctor) checkTc() CheckResult {
+	name := "traffic control"
+	if _, err := d.lookPath("tc"); err != nil {
+		return failed(name, CheckWarn, "install iproute2", "tc is missing, traffic limits can't be applied")
+	}
+	return pass(name, "tc is installed")
+}
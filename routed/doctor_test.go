@@ -0,0 +1,134 @@
+package routed
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func testDoctor(gateway string, mode string) (*Doctor, *fakeNetlink, *fakeIptables, *fakeSysctls) {
+	nl := newFakeNetlink()
+	fw := newFakeIptables(containersChainName, containerRejectChainName, "FORWARD")
+	sc := newFakeSysctls()
+
+	d := newDoctor(nl, fw, sc, gateway, mode)
+	d.readFile = func(path string) ([]byte, error) {
+		if path == "/etc/quagga/ospfd.conf" {
+			return []byte("router ospf\n redistribute kernel\n"), nil
+		}
+		return nil, os.ErrNotExist
+	}
+	d.processes = func() ([]string, error) { return []string{"init", "zebra", "ospfd"}, nil }
+	d.lookPath = func(file string) (string, error) { return "/sbin/" + file, nil }
+	d.exists = func(path string) bool { return true }
+	return d, nl, fw, sc
+}
+
+func checkStatus(results []CheckResult) map[string]string {
+	status := make(map[string]string)
+	for _, r := range results {
+		status[r.Name] = r.Status
+	}
+	return status
+}
+
+func TestDoctor(t *testing.T) {
+	d, nl, fw, sc := testDoctor("10.100.0.1", GatewayProxyArp)
+	nl.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth0"}})
+	eth0, _ := nl.LinkByName("eth0")
+	nl.RouteAdd(&netlink.Route{LinkIndex: eth0.Attrs().Index, Gw: net.ParseIP("192.168.1.1")})
+	sc.Set("net.ipv4.conf.eth0.proxy_arp", "1")
+	fw.Raw("-A", "FORWARD", "-j", containersChainName)
+
+	results := d.Run()
+	for _, r := range results {
+		if r.Status != CheckPass {
+			t.Fatalf("TestDoctor failed: %+v", r)
+		}
+	}
+	if !Healthy(results) {
+		t.Fatalf("TestDoctor failed: healthy host not healthy")
+	}
+
+	// Host set up by hand, missing most of the Vagrantfile
+	d, _, _, sc = testDoctor("224.0.0.1", GatewayProxyArp)
+	sc.Set("net.ipv4.ip_forward", "0")
+	d.fw = newFakeIptables("FORWARD")
+	d.processes = func() ([]string, error) { return []string{"init"}, nil }
+	d.lookPath = func(file string) (string, error) { return "", fmt.Errorf("%s not found", file) }
+	d.exists = func(path string) bool { return false }
+
+	results = d.Run()
+	if Healthy(results) {
+		t.Fatalf("TestDoctor failed: broken host healthy")
+	}
+	for name, status := range map[string]string{
+		"ip forwarding":                   CheckFail,
+		"iptables chain CONTAINERS":       CheckFail,
+		"iptables chain CONTAINER-REJECT": CheckFail,
+		"forwarded traffic filtering":     CheckWarn,
+		"gateway":                         CheckFail,
+		"uplink proxy_arp":                CheckWarn,
+		"routing daemon":                  CheckFail,
+		"plugin directory":                CheckFail,
+		"traffic control":                 CheckWarn,
+	} {
+		if s := checkStatus(results)[name]; s != status {
+			t.Fatalf("TestDoctor failed: %s is %s instead of %s", name, s, status)
+		}
+	}
+	for _, r := range results {
+		if r.Status != CheckPass && r.Fix == "" {
+			t.Fatalf("TestDoctor failed: no fix for %+v", r)
+		}
+	}
+}
+
+func TestDoctorChecks(t *testing.T) {
+	d, nl, _, _ := testDoctor("10.100.0.1", GatewayProxyArp)
+	nl.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth1"}})
+	eth1, _ := nl.LinkByName("eth1")
+	gw, _ := netlink.ParseIPNet("10.100.0.1/24")
+	nl.AddrAdd(eth1, &netlink.Addr{IPNet: gw})
+	if r := d.checkGateway(); r.Status != CheckPass || r.Detail != "gateway 10.100.0.1 is an address of eth1" {
+		t.Fatalf("TestDoctorChecks failed: %+v", r)
+	}
+
+	d, _, _, _ = testDoctor("10.100.0.1", GatewayLinkLocal)
+	if r := d.checkGateway(); r.Status != CheckFail {
+		t.Fatalf("TestDoctorChecks failed: link-local mode with %s: %+v", d.gateway, r)
+	}
+
+	d, _, _, _ = testDoctor("10.100.0.1", GatewayProxyArp)
+	d.readFile = func(path string) ([]byte, error) { return []byte("router ospf\n"), nil }
+	if r := d.checkRoutingDaemon(); r.Status != CheckFail {
+		t.Fatalf("TestDoctorChecks failed: ospfd without redistribution: %+v", r)
+	}
+
+	// Redistribution commented out in one config, set in the next one
+	configs := map[string]string{
+		"/etc/quagga/ospfd.conf": "router ospf\n! redistribute kernel\n",
+		"/etc/frr/frr.conf":      "router ospf\n redistribute kernel\n",
+	}
+	d.readFile = func(path string) ([]byte, error) {
+		if config, ok := configs[path]; ok {
+			return []byte(config), nil
+		}
+		return nil, os.ErrNotExist
+	}
+	if r := d.checkRoutingDaemon(); r.Status != CheckPass || r.Detail != "ospfd redistributes kernel routes (/etc/frr/frr.conf)" {
+		t.Fatalf("TestDoctorChecks failed: frr.conf not checked: %+v", r)
+	}
+	delete(configs, "/etc/frr/frr.conf")
+	if r := d.checkRoutingDaemon(); r.Status != CheckFail {
+		t.Fatalf("TestDoctorChecks failed: commented out redistribution: %+v", r)
+	}
+
+	d, _, _, _ = testDoctor("", GatewayProxyArp)
+	if r := d.checkGateway(); r.Status != CheckWarn || r.Detail != "gateway not given, not checked" {
+		t.Fatalf("TestDoctorChecks failed: no gateway: %+v", r)
+	}
+}
@@ -0,0 +1,100 @@
+package routed
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	DrainNone     = "none"
+	DrainMetric   = "metric"
+	DrainWithdraw = "withdraw"
+
+	// Metric added to the host route of a draining endpoint, so that routes
+	// to the same address announced by other hosts are preferred.
+	drainRouteMetric = 4096
+)
+
+// SetDrain sets how the host route of an endpoint is taken down before its
+// interface is removed: not at all, by raising its metric or by withdrawing
+// it, and how long to wait afterwards for traffic to move elsewhere.
+func (d *NetDriver) SetDrain(mode string, grace time.Duration) error {
+	switch mode {
+	case DrainNone, DrainMetric, DrainWithdraw:
+	default:
+		return fmt.Errorf("Invalid drain mode %s", mode)
+	}
+	if grace < 0 {
+		return fmt.Errorf("Invalid drain grace period %s", grace)
+	}
+	d.drainMode = mode
+	d.drainGrace = grace
+	return nil
+}
+
+// drainEndpoint raises the metric of, or withdraws, the host route of an
+// endpoint. Caller must hold the network lock.
+func (d *NetDriver) drainEndpoint(network *routedNetwork, ep *routedEndpoint) error {
+	if d.drainMode == DrainNone || ep.hostInterfaceName == "" || !ep.routable() {
+		return nil
+	}
+
+	link, err := d.nl.LinkByName(ep.hostInterfaceName)
+	if err != nil {
+		return fmt.Errorf("Can't find host interface %s: %v", ep.hostInterfaceName, err)
+	}
+
+	route := d.hostRoute(network, ep.ipv4Address, link)
+
+	if d.drainMode == DrainMetric {
+		drained := d.hostRoute(network, ep.ipv4Address, link)
+		drained.Priority += drainRouteMetric
+		log.Debugf("drainEndpoint: Adding route %+v", drained)
+		if err := d.nl.RouteAdd(drained); err != nil {
+			return fmt.Errorf("Unable to add drain route to %s: %v", ep.ipv4Address, err)
+		}
+	}
+
+	log.Debugf("drainEndpoint: Deleting route %+v", route)
+	if err := d.nl.RouteDel(route); err != nil {
+		return fmt.Errorf("Unable to delete route to %s: %v", ep.ipv4Address, err)
+	}
+
+	log.Infof("drainEndpoint: Drained route to %s on %s", ep.ipv4Address, ep.hostInterfaceName)
+	return nil
+}
+
+func (d *NetDriver) waitDrain() {
+	if d.drainMode == DrainNone || d.drainGrace == 0 {
+		return
+	}
+	log.Infof("Drain: Waiting %s for traffic to move", d.drainGrace)
+	time.Sleep(d.drainGrace)
+}
+
+// Drain takes down the host routes of all joined endpoints in the same way
+// Leave does, and waits for the grace period once. Used on shutdown.
+func (d *NetDriver) Drain() {
+	if d.drainMode == DrainNone {
+		return
+	}
+
+	for _, network := range d.allNetworks() {
+		network.m.Lock()
+		for eid, ep := range network.endpoints {
+			if !ep.joined {
+				continue
+			}
+			ep.joined = false
+			ep.stopProbing()
+			if err := d.drainEndpoint(network, ep); err != nil {
+				log.Warnf("Drain: endpoint %s: %v", eid, err)
+			}
+		}
+		network.m.Unlock()
+	}
+
+	d.waitDrain()
+}
@@ -0,0 +1,669 @@
+package routed
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// fakeNetlink keeps links, addresses and routes in memory, standing for the
+// host kernel in tests.
+type fakeNetlink struct {
+	links     map[string]netlink.Link
+	addrs     map[int][]netlink.Addr
+	routes    []netlink.Route
+	neighs    []netlink.Neigh
+	sysctls   map[string]string
+	garps     []string
+	sandboxes map[string]*fakeNetlink
+	lastIndex int
+	// errors makes the named operations fail
+	errors map[string]error
+	m      sync.Mutex
+}
+
+func newFakeNetlink() *fakeNetlink {
+	return &fakeNetlink{
+		links:     make(map[string]netlink.Link),
+		addrs:     make(map[int][]netlink.Addr),
+		sysctls:   make(map[string]string),
+		sandboxes: make(map[string]*fakeNetlink),
+		errors:    make(map[string]error),
+	}
+}
+
+func (f *fakeNetlink) failWith(op string, err error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.errors[op] = err
+}
+
+func (f *fakeNetlink) addLink(link netlink.Link) {
+	f.lastIndex++
+	link.Attrs().Index = f.lastIndex
+	if link.Attrs().HardwareAddr == nil {
+		link.Attrs().HardwareAddr = net.HardwareAddr{0x02, 0, 0, 0, 0, byte(f.lastIndex)}
+	}
+	f.links[link.Attrs().Name] = link
+}
+
+// moveLink moves a link to the namespace of sandbox under a new name, as
+// Docker does with the container side link after Join.
+func (f *fakeNetlink) moveLink(name string, sandbox *fakeNetlink, newName string) error {
+	f.m.Lock()
+	link, ok := f.links[name]
+	delete(f.links, name)
+	f.m.Unlock()
+	if !ok {
+		return syscall.ENODEV
+	}
+
+	sandbox.m.Lock()
+	defer sandbox.m.Unlock()
+	link.Attrs().Name = newName
+	sandbox.addLink(link)
+	return nil
+}
+
+func (f *fakeNetlink) link(link netlink.Link) (netlink.Link, error) {
+	if l, ok := f.links[link.Attrs().Name]; ok {
+		return l, nil
+	}
+	return nil, syscall.ENODEV
+}
+
+func (f *fakeNetlink) hasIndex(index int) bool {
+	for _, link := range f.links {
+		if link.Attrs().Index == index {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeNetlink) LinkAdd(link netlink.Link) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if err := f.errors["LinkAdd"]; err != nil {
+		return err
+	}
+
+	if _, ok := f.links[link.Attrs().Name]; ok {
+		return syscall.EEXIST
+	}
+	switch l := link.(type) {
+	case *netlink.Veth:
+		if _, ok := f.links[l.PeerName]; ok {
+			return syscall.EEXIST
+		}
+		f.addLink(&netlink.Veth{
+			LinkAttrs: netlink.LinkAttrs{Name: l.PeerName, MTU: 1500},
+			PeerName:  l.Name,
+		})
+	case *netlink.IPVlan:
+		if !f.hasIndex(l.ParentIndex) {
+			return syscall.ENODEV
+		}
+	}
+	if link.Attrs().MTU == 0 {
+		link.Attrs().MTU = 1500
+	}
+	f.addLink(link)
+	return nil
+}
+
+func (f *fakeNetlink) LinkDel(link netlink.Link) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	l, err := f.link(link)
+	if err != nil {
+		return err
+	}
+	delete(f.links, l.Attrs().Name)
+	delete(f.addrs, l.Attrs().Index)
+	if veth, ok := l.(*netlink.Veth); ok {
+		if peer, ok := f.links[veth.PeerName]; ok {
+			delete(f.links, veth.PeerName)
+			delete(f.addrs, peer.Attrs().Index)
+		}
+	}
+
+	// Routes go away with their link
+	var routes []netlink.Route
+	for _, route := range f.routes {
+		if f.hasIndex(route.LinkIndex) || route.LinkIndex == 0 {
+			routes = append(routes, route)
+		}
+	}
+	f.routes = routes
+	return nil
+}
+
+func (f *fakeNetlink) LinkByName(name string) (netlink.Link, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if link, ok := f.links[name]; ok {
+		return link, nil
+	}
+	return nil, fmt.Errorf("Link %s not found", name)
+}
+
+func (f *fakeNetlink) LinkList() ([]netlink.Link, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	var links []netlink.Link
+	for _, link := range f.links {
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+func (f *fakeNetlink) setAttrs(op string, link netlink.Link, set func(attrs *netlink.LinkAttrs)) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if err := f.errors[op]; err != nil {
+		return err
+	}
+
+	l, err := f.link(link)
+	if err != nil {
+		return err
+	}
+	set(l.Attrs())
+	return nil
+}
+
+func (f *fakeNetlink) LinkSetUp(link netlink.Link) error {
+	return f.setAttrs("LinkSetUp", link, func(attrs *netlink.LinkAttrs) { attrs.Flags |= net.FlagUp })
+}
+
+func (f *fakeNetlink) LinkSetDown(link netlink.Link) error {
+	return f.setAttrs("LinkSetDown", link, func(attrs *netlink.LinkAttrs) { attrs.Flags &^= net.FlagUp })
+}
+
+func (f *fakeNetlink) LinkSetMTU(link netlink.Link, mtu int) error {
+	return f.setAttrs("LinkSetMTU", link, func(attrs *netlink.LinkAttrs) { attrs.MTU = mtu })
+}
+
+func (f *fakeNetlink) LinkSetHardwareAddr(link netlink.Link, hwaddr net.HardwareAddr) error {
+	return f.setAttrs("LinkSetHardwareAddr", link, func(attrs *netlink.LinkAttrs) { attrs.HardwareAddr = hwaddr })
+}
+
+func (f *fakeNetlink) LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error {
+	go func() {
+		<-done
+		close(ch)
+	}()
+	return nil
+}
+
+func (f *fakeNetlink) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if err := f.errors["AddrAdd"]; err != nil {
+		return err
+	}
+	l, err := f.link(link)
+	if err != nil {
+		return err
+	}
+	index := l.Attrs().Index
+	for _, a := range f.addrs[index] {
+		if a.IPNet.String() == addr.IPNet.String() {
+			return syscall.EEXIST
+		}
+	}
+	f.addrs[index] = append(f.addrs[index], *addr)
+	return nil
+}
+
+func (f *fakeNetlink) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	var addrs []netlink.Addr
+	for index, linkAddrs := range f.addrs {
+		if link == nil || link.Attrs().Index == index {
+			addrs = append(addrs, linkAddrs...)
+		}
+	}
+	return addrs, nil
+}
+
+func sameRoute(a *netlink.Route, b *netlink.Route) bool {
+	return a.Dst.String() == b.Dst.String() && a.Priority == b.Priority
+}
+
+func (f *fakeNetlink) RouteAdd(route *netlink.Route) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if err := f.errors["RouteAdd"]; err != nil {
+		return err
+	}
+
+	if route.LinkIndex != 0 && !f.hasIndex(route.LinkIndex) {
+		return syscall.ENODEV
+	}
+	for i := range f.routes {
+		if sameRoute(&f.routes[i], route) {
+			return syscall.EEXIST
+		}
+	}
+	f.routes = append(f.routes, *route)
+	return nil
+}
+
+func (f *fakeNetlink) RouteDel(route *netlink.Route) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if err := f.errors["RouteDel"]; err != nil {
+		return err
+	}
+
+	for i := range f.routes {
+		r := &f.routes[i]
+		if r.Dst.String() != route.Dst.String() ||
+			(route.LinkIndex != 0 && r.LinkIndex != route.LinkIndex) ||
+			(route.Priority != 0 && r.Priority != route.Priority) {
+			continue
+		}
+		f.routes = append(f.routes[:i], f.routes[i+1:]...)
+		return nil
+	}
+	return syscall.ESRCH
+}
+
+func (f *fakeNetlink) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	var routes []netlink.Route
+	for _, route := range f.routes {
+		if link == nil || route.LinkIndex == link.Attrs().Index {
+			routes = append(routes, route)
+		}
+	}
+	return routes, nil
+}
+
+// RouteGet looks up destination in the routes like the kernel would,
+// without policy routing.
+func (f *fakeNetlink) RouteGet(destination net.IP) ([]netlink.Route, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	route := lookupRoute(f.routes, destination)
+	if route == nil {
+		return nil, syscall.ENETUNREACH
+	}
+	if route.Type == syscall.RTN_BLACKHOLE {
+		return nil, syscall.EINVAL
+	}
+	return []netlink.Route{{
+		LinkIndex: route.LinkIndex,
+		Dst:       &net.IPNet{IP: destination, Mask: net.CIDRMask(32, 32)},
+		Gw:        route.Gw,
+	}}, nil
+}
+
+func (f *fakeNetlink) RouteSubscribe(ch chan<- netlink.RouteUpdate, done <-chan struct{}) error {
+	go func() {
+		<-done
+		close(ch)
+	}()
+	return nil
+}
+
+func (f *fakeNetlink) NeighSet(neigh *netlink.Neigh) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if !f.hasIndex(neigh.LinkIndex) {
+		return syscall.ENODEV
+	}
+	for i := range f.neighs {
+		if f.neighs[i].LinkIndex == neigh.LinkIndex && f.neighs[i].IP.Equal(neigh.IP) {
+			f.neighs[i] = *neigh
+			return nil
+		}
+	}
+	f.neighs = append(f.neighs, *neigh)
+	return nil
+}
+
+func (f *fakeNetlink) OpenSandbox(path string) (Sandbox, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if sandbox, ok := f.sandboxes[path]; ok {
+		return sandbox, nil
+	}
+	return nil, fmt.Errorf("no namespace at %s", path)
+}
+
+func (f *fakeNetlink) SetSysctl(name string, value string) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	f.sysctls[name] = value
+	return nil
+}
+
+func (f *fakeNetlink) SendGratuitousArp(link netlink.Link, ip net.IP) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if _, err := f.link(link); err != nil {
+		return err
+	}
+	f.garps = append(f.garps, link.Attrs().Name+" "+ip.String())
+	return nil
+}
+
+func (f *fakeNetlink) Close() {
+}
+
+// addSandbox creates the namespace of a container at path.
+func (f *fakeNetlink) addSandbox(path string) *fakeNetlink {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	sandbox := newFakeNetlink()
+	f.sandboxes[path] = sandbox
+	return sandbox
+}
+
+// findNeigh returns the neighbor entry of ip, if any.
+func (f *fakeNetlink) findNeigh(ip string) *netlink.Neigh {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	for i := range f.neighs {
+		if f.neighs[i].IP.String() == ip {
+			neigh := f.neighs[i]
+			return &neigh
+		}
+	}
+	return nil
+}
+
+// findRoute returns the route to dst, if any.
+func (f *fakeNetlink) findRoute(dst string) *netlink.Route {
+	routes, _ := f.RouteList(nil, netlink.FAMILY_V4)
+	for i := range routes {
+		if routes[i].Dst.String() == dst {
+			return &routes[i]
+		}
+	}
+	return nil
+}
+
+// fakeIptables keeps rules in memory, the chains of tables other than
+// filter being named table/chain.
+type fakeIptables struct {
+	chains map[string][]string
+	// errors makes the named commands, such as -A, fail in any table
+	errors map[string]error
+	m      sync.Mutex
+}
+
+// newFakeIptables returns a filter table with the given chains.
+func newFakeIptables(chains ...string) *fakeIptables {
+	f := &fakeIptables{
+		chains: map[string][]string{"mangle/PREROUTING": nil},
+		errors: make(map[string]error),
+	}
+	for _, chain := range chains {
+		f.chains[chain] = nil
+	}
+	return f
+}
+
+func (f *fakeIptables) failWith(cmd string, err error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.errors[cmd] = err
+}
+
+func (f *fakeIptables) Raw(args ...string) ([]byte, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	table := "filter"
+	if len(args) > 2 && args[0] == "-t" {
+		table, args = args[1], args[2:]
+	}
+	if len(args) > 0 && f.errors[args[0]] != nil {
+		return nil, f.errors[args[0]]
+	}
+	if len(args) > 0 && args[0] == "-S" {
+		return f.list(table, args[1:]), nil
+	}
+	if len(args) < 2 {
+		return nil, fmt.Errorf("fakeIptables: unsupported call %s", args)
+	}
+	cmd, chain := args[0], args[1]
+	if table != "filter" {
+		chain = table + "/" + chain
+	}
+	rules, ok := f.chains[chain]
+	if !ok && cmd != "-N" {
+		return nil, fmt.Errorf("fakeIptables: no chain %s", chain)
+	}
+
+	switch cmd {
+	case "-N":
+		if ok {
+			return nil, fmt.Errorf("fakeIptables: chain %s exists", chain)
+		}
+		f.chains[chain] = nil
+	case "-A":
+		f.chains[chain] = append(rules, strings.Join(args[2:], " "))
+	case "-I":
+		rule := strings.Join(args[3:], " ")
+		f.chains[chain] = append([]string{rule}, rules...)
+	case "-D":
+		rule := strings.Join(args[2:], " ")
+		for i := range rules {
+			if rules[i] == rule {
+				f.chains[chain] = append(rules[:i], rules[i+1:]...)
+				return nil, nil
+			}
+		}
+		return nil, fmt.Errorf("fakeIptables: no rule %s in %s", rule, chain)
+	case "-C":
+		rule := strings.Join(args[2:], " ")
+		for i := range rules {
+			if rules[i] == rule {
+				return nil, nil
+			}
+		}
+		return []byte("iptables: Bad rule (does a matching rule exist in that chain?)."), fmt.Errorf("exit status 1")
+	case "-F":
+		f.chains[chain] = nil
+	case "-X":
+		if len(rules) > 0 {
+			return nil, fmt.Errorf("fakeIptables: chain %s not empty", chain)
+		}
+		delete(f.chains, chain)
+	case "-E":
+		if len(args) < 3 {
+			return nil, fmt.Errorf("fakeIptables: unsupported call %s", args)
+		}
+		f.chains[args[2]] = rules
+		delete(f.chains, chain)
+		for name, jumps := range f.chains {
+			for i := range jumps {
+				jumps[i] = strings.Replace(jumps[i], "-j "+chain, "-j "+args[2], 1)
+			}
+			f.chains[name] = jumps
+		}
+	default:
+		return nil, fmt.Errorf("fakeIptables: unsupported call %s", args)
+	}
+	return nil, nil
+}
+
+// list prints the rules of a chain, or the chains of the table and their
+// rules, as iptables -S does. Caller must hold the lock.
+func (f *fakeIptables) list(table string, chain []string) []byte {
+	var names []string
+	for name := range f.chains {
+		if i := strings.Index(name, "/"); i >= 0 {
+			if name[:i] == table {
+				names = append(names, name[i+1:])
+			}
+		} else if table == "filter" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var lines []string
+	for _, name := range names {
+		if len(chain) > 0 && chain[0] != name {
+			continue
+		}
+		key := name
+		if table != "filter" {
+			key = table + "/" + name
+		}
+		if len(chain) == 0 {
+			lines = append(lines, "-N "+name)
+		}
+		for _, rule := range f.chains[key] {
+			lines = append(lines, "-A "+name+" "+rule)
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+func (f *fakeIptables) ChainExists(chain string) bool {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	_, ok := f.chains[chain]
+	return ok
+}
+
+// fakeSysctls keeps kernel parameters in memory.
+type fakeSysctls struct {
+	values map[string]string
+	m      sync.Mutex
+}
+
+func newFakeSysctls() *fakeSysctls {
+	return &fakeSysctls{values: map[string]string{"net.ipv4.ip_forward": "1"}}
+}
+
+func (f *fakeSysctls) Get(name string) (string, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	value, ok := f.values[name]
+	if !ok {
+		return "", &os.PathError{Op: "open", Path: sysctlPath(name), Err: syscall.ENOENT}
+	}
+	return value, nil
+}
+
+func (f *fakeSysctls) Set(name string, value string) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	f.values[name] = value
+	return nil
+}
+
+// fakeTc keeps the qdiscs of the links in memory.
+type fakeTc struct {
+	// Link name to qdisc handle, root or ingress, to its arguments
+	qdiscs  map[string]map[string]string
+	filters map[string][]string
+	m       sync.Mutex
+}
+
+func newFakeTc() *fakeTc {
+	return &fakeTc{
+		qdiscs:  make(map[string]map[string]string),
+		filters: make(map[string][]string),
+	}
+}
+
+func (f *fakeTc) Tc(args ...string) ([]byte, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if len(args) < 5 || args[2] != "dev" {
+		return nil, fmt.Errorf("fakeTc: unsupported call %s", args)
+	}
+	object, cmd, dev, handle := args[0], args[1], args[3], args[4]
+	qdiscs := f.qdiscs[dev]
+	if qdiscs == nil {
+		qdiscs = make(map[string]string)
+		f.qdiscs[dev] = qdiscs
+	}
+
+	switch {
+	case object == "qdisc" && cmd == "add":
+		if _, ok := qdiscs[handle]; ok {
+			return []byte("RTNETLINK answers: File exists"), syscall.EEXIST
+		}
+		qdiscs[handle] = strings.Join(args[5:], " ")
+	case object == "qdisc" && cmd == "replace":
+		qdiscs[handle] = strings.Join(args[5:], " ")
+	case object == "qdisc" && cmd == "del":
+		if _, ok := qdiscs[handle]; !ok {
+			return []byte("RTNETLINK answers: No such file or directory"), syscall.ENOENT
+		}
+		delete(qdiscs, handle)
+		if handle == "ingress" {
+			delete(f.filters, dev)
+		}
+	case object == "filter" && cmd == "add":
+		if _, ok := qdiscs["ingress"]; !ok {
+			return []byte("RTNETLINK answers: Invalid argument"), syscall.EINVAL
+		}
+		f.filters[dev] = append(f.filters[dev], strings.Join(args[4:], " "))
+	case object == "filter" && cmd == "replace":
+		if _, ok := qdiscs["ingress"]; !ok {
+			return []byte("RTNETLINK answers: Invalid argument"), syscall.EINVAL
+		}
+		filter := strings.Join(args[4:], " ")
+		for i, old := range f.filters[dev] {
+			if filterHandle(old) == filterHandle(filter) {
+				f.filters[dev][i] = filter
+				return nil, nil
+			}
+		}
+		f.filters[dev] = append(f.filters[dev], filter)
+	default:
+		return nil, fmt.Errorf("fakeTc: unsupported call %s", args)
+	}
+	return nil, nil
+}
+
+// filterHandle returns the handle given to a filter, empty when none is.
+func filterHandle(filter string) string {
+	fields := strings.Fields(filter)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "handle" {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,246 @@
+package routed
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// GarbageReport lists what CollectGarbage removed, or failed to.
+type GarbageReport struct {
+	Links  []string `json:"links"`
+	Routes []string `json:"routes"`
+	Chains []string `json:"chains"`
+	Rules  []string `json:"rules"`
+	Errors []string `json:"errors"`
+}
+
+func (r *GarbageReport) failed(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Warnf("CollectGarbage: %s", msg)
+	r.Errors = append(r.Errors, msg)
+}
+
+// listRules lists the rules of a chain as printed by iptables -S, each
+// without the leading -A and chain name.
+func listRules(fw Firewall, table string, chain string) ([][]string, error) {
+	output, err := fw.Raw("-t", table, "-S", chain)
+	if err != nil {
+		return nil, fmt.Errorf("Can't list chain %s: %v %s", chain, err, output)
+	}
+	var rules [][]string
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 2 && fields[0] == "-A" && fields[1] == chain {
+			rules = append(rules, fields[2:])
+		}
+	}
+	return rules, nil
+}
+
+// listChains lists the user defined chains of the filter table.
+func listChains(fw Firewall) ([]string, error) {
+	output, err := fw.Raw("-t", "filter", "-S")
+	if err != nil {
+		return nil, fmt.Errorf("Can't list chains: %v %s", err, output)
+	}
+	var chains []string
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "-N" {
+			chains = append(chains, fields[1])
+		}
+	}
+	return chains, nil
+}
+
+// ruleOption returns the value following option in a rule.
+func ruleOption(rule []string, option string) string {
+	for i := 0; i+1 < len(rule); i++ {
+		if rule[i] == option {
+			return rule[i+1]
+		}
+	}
+	return ""
+}
+
+// CollectGarbage removes the host state left by endpoints the driver no
+// longer knows on any of its networks: veths, host routes to container
+// addresses, filtering chains and traffic marking rules. Nothing is removed
+// when part of the host state can't be listed, since what is garbage can't
+// be told from what is not.
+func (d *NetDriver) CollectGarbage() *GarbageReport {
+	report := &GarbageReport{Links: []string{}, Routes: []string{}, Chains: []string{}, Rules: []string{}, Errors: []string{}}
+
+	links := make(map[string]bool)
+	routes := make(map[string]bool)
+	chains := make(map[string]bool)
+	marked := make(map[string]bool)
+	prefixes := make(map[string]bool)
+	hostLinks := make(map[string]bool)
+	// The networks are locked in the order of their IDs, and stay locked
+	// until the state of their endpoints is no longer needed
+	for _, network := range d.allNetworks() {
+		network.m.Lock()
+		defer network.m.Unlock()
+
+		prefixes[network.vethPrefix] = true
+		// The host link of the dataplane outlives the endpoints
+		if hostLink := network.dataplane.HostLink(); hostLink != "" {
+			links[hostLink] = true
+			hostLinks[hostLink] = true
+		}
+		for _, ep := range network.endpoints {
+			links[ep.hostInterfaceName] = true
+			links[ep.containerIfaceName] = true
+			routes[ep.hostInterfaceName+" "+ep.ipv4Address.String()] = true
+			if ep.netFilter != nil && ep.netFilter.chain != "" {
+				chains[ep.netFilter.chain] = true
+			}
+			if ep.qos != nil {
+				marked[ep.hostInterfaceName] = true
+			}
+		}
+	}
+
+	// Only the links named by this plugin are collected, others may belong
+	// to the host
+	routedName := func(name string) bool {
+		if strings.HasPrefix(name, vethPrefix) || strings.HasPrefix(name, ipvlanPrefix) {
+			return true
+		}
+		for prefix := range prefixes {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var staleLinks []netlink.Link
+	var routeLinks []string
+	staleRoutes := make(map[string][]netlink.Route)
+	all, err := d.nl.LinkList()
+	if err != nil {
+		report.failed("Can't list links: %v", err)
+	}
+	for _, link := range all {
+		name := link.Attrs().Name
+		ours := strings.HasPrefix(name, vethPrefix) || strings.HasPrefix(name, ipvlanPrefix) ||
+			(routedName(name) && link.Type() == "veth")
+		if !ours {
+			continue
+		}
+		if !links[name] {
+			staleLinks = append(staleLinks, link)
+			continue
+		}
+
+		linkRoutes, err := d.nl.RouteList(link, netlink.FAMILY_V4)
+		if err != nil {
+			report.failed("Can't list routes of %s: %v", name, err)
+			continue
+		}
+		for _, route := range linkRoutes {
+			if route.Dst == nil || routes[name+" "+route.Dst.String()] {
+				continue
+			}
+			if ones, _ := route.Dst.Mask.Size(); ones != 32 {
+				continue
+			}
+			if staleRoutes[name] == nil {
+				routeLinks = append(routeLinks, name)
+			}
+			staleRoutes[name] = append(staleRoutes[name], route)
+		}
+	}
+
+	names, err := listChains(d.fw)
+	if err != nil {
+		report.failed("%v", err)
+	}
+	jumps, err := listRules(d.fw, "filter", containersChainName)
+	if err != nil {
+		report.failed("%v", err)
+	}
+	rules, err := listRules(d.fw, "mangle", "PREROUTING")
+	if err != nil {
+		report.failed("%v", err)
+	}
+
+	if len(report.Errors) > 0 {
+		log.Warnf("CollectGarbage: Removed nothing, the host state couldn't be listed")
+		return report
+	}
+
+	for _, link := range staleLinks {
+		name := link.Attrs().Name
+		// Deleting one side of a veth deletes its peer
+		if _, err := d.nl.LinkByName(name); err != nil {
+			continue
+		}
+		if err := d.nl.LinkDel(link); err != nil {
+			report.failed("Can't delete link %s: %v", name, err)
+			continue
+		}
+		report.Links = append(report.Links, name)
+	}
+
+	for _, name := range routeLinks {
+		linkRoutes := staleRoutes[name]
+		for i := range linkRoutes {
+			route := &linkRoutes[i]
+			if err := d.nl.RouteDel(route); err != nil {
+				report.failed("Can't delete route to %s on %s: %v", route.Dst, name, err)
+				continue
+			}
+			report.Routes = append(report.Routes, fmt.Sprintf("%s dev %s", route.Dst, name))
+		}
+	}
+
+	for _, chain := range names {
+		if !strings.HasPrefix(chain, vethChainPrefix) || chain == containerRejectChainName || chains[chain] {
+			continue
+		}
+		d.removeChain(report, chain, jumps)
+	}
+
+	for _, rule := range rules {
+		iface := ruleOption(rule, "-i")
+		if ruleOption(rule, "-j") != "DSCP" || !routedName(iface) || hostLinks[iface] || marked[iface] {
+			continue
+		}
+		if _, err := d.fw.Raw(append([]string{"-t", "mangle", "-D", "PREROUTING"}, rule...)...); err != nil {
+			report.failed("Can't delete marking rule %s: %v", rule, err)
+			continue
+		}
+		report.Rules = append(report.Rules, "mangle PREROUTING "+strings.Join(rule, " "))
+	}
+
+	log.Infof("CollectGarbage: Removed %d links, %d routes, %d chains and %d rules",
+		len(report.Links), len(report.Routes), len(report.Chains), len(report.Rules))
+	return report
+}
+
+// removeChain removes a filtering chain and the jumps to it, among jumps.
+func (d *NetDriver) removeChain(report *GarbageReport, chain string, jumps [][]string) {
+	for _, rule := range jumps {
+		if ruleOption(rule, "-j") != chain {
+			continue
+		}
+		if _, err := d.fw.Raw(append([]string{"-D", containersChainName}, rule...)...); err != nil {
+			report.failed("Can't delete jump to %s: %v", chain, err)
+			return
+		}
+		report.Rules = append(report.Rules, containersChainName+" "+strings.Join(rule, " "))
+	}
+	for _, args := range [][]string{{"-F", chain}, {"-X", chain}} {
+		if _, err := d.fw.Raw(args...); err != nil {
+			report.failed("Can't remove chain %s: %v", chain, err)
+			return
+		}
+	}
+	report.Chains = append(report.Chains, chain)
+}
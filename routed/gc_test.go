@@ -0,0 +1,202 @@
+package routed
+
+import (
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+
+	netApi "github.com/docker/go-plugins-helpers/network"
+	"github.com/vishvananda/netlink"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	netID := "c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c"
+	eID := "4b50fb7f12adb0da3e6662148e9b1bc43b507ad2fd8a0f187ff297cbc88aee05"
+
+	nl := newFakeNetlink()
+	fw := newFakeIptables(containersChainName, containerRejectChainName)
+	d, _ := newNetDriver(nl, fw, newFakeSysctls(), newFakeTc(), "0.1", "10.100.0.1", 1500, "")
+	d.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: netID})
+	d.CreateEndpoint(&netApi.CreateEndpointRequest{
+		NetworkID:  netID,
+		EndpointID: eID,
+		Interface:  &netApi.EndpointInterface{Address: "10.1.0.2/32"},
+		Options:    map[string]interface{}{"routed.dscp": "ef"},
+	})
+	d.Join(&netApi.JoinRequest{NetworkID: netID, EndpointID: eID})
+	if err := d.SetEndpointPolicy(eID, "10.2.0.0/16"); err != nil {
+		t.Fatalf("TestCollectGarbage failed: SetEndpointPolicy %v", err)
+	}
+	ep := d.networks[netID].endpoints[eID]
+
+	// Left by an endpoint the driver forgot about
+	nl.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "vethrdead"}})
+	nl.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth1"}})
+	link, _ := nl.LinkByName(ep.hostInterfaceName)
+	_, stale, _ := net.ParseCIDR("10.1.0.7/32")
+	nl.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: stale})
+	stalePolicy := &netFilter{fw: fw, ifaceName: "vethrdead", match: []string{"-o", "vethrdead"}, config: &netFilterConfig{allowedNets: []*net.IPNet{stale}}}
+	stalePolicy.applyFiltering()
+	applyQos(newFakeTc(), fw, "vethrdead", &qosConfig{dscp: 10})
+	// Marking rules of host links are not ours
+	applyQos(newFakeTc(), fw, "eth1", &qosConfig{dscp: 10})
+
+	report := d.CollectGarbage()
+	if len(report.Errors) != 0 {
+		t.Fatalf("TestCollectGarbage failed: errors %+v", report.Errors)
+	}
+	if len(report.Links) != 1 || report.Links[0] != "vethrdead" ||
+		len(report.Routes) != 1 || report.Routes[0] != "10.1.0.7/32 dev "+ep.hostInterfaceName ||
+		len(report.Chains) != 1 || report.Chains[0] != "CONTAINER-vethrdead" || len(report.Rules) != 2 {
+		t.Fatalf("TestCollectGarbage failed: wrong report %+v", report)
+	}
+
+	// The endpoint is untouched
+	if _, err := nl.LinkByName(ep.hostInterfaceName); err != nil || nl.findRoute("10.1.0.2/32") == nil {
+		t.Fatalf("TestCollectGarbage failed: endpoint link or route removed")
+	}
+	if _, err := nl.LinkByName("eth1"); err != nil {
+		t.Fatalf("TestCollectGarbage failed: removed eth1")
+	}
+	if !fw.ChainExists("CONTAINER-"+ep.hostInterfaceName) || len(fw.chains[containersChainName]) != 1 ||
+		len(fw.chains["mangle/PREROUTING"]) != 2 {
+		t.Fatalf("TestCollectGarbage failed: wrong iptables state %+v", fw.chains)
+	}
+
+	if report := d.CollectGarbage(); len(report.Links)+len(report.Routes)+len(report.Chains)+len(report.Rules) != 0 {
+		t.Fatalf("TestCollectGarbage failed: removed more %+v", report)
+	}
+}
+
+func TestNetworksGarbage(t *testing.T) {
+	netIDs := []string{
+		"c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c",
+		"d56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c",
+	}
+	eIDs := []string{
+		"4b50fb7f12adb0da3e6662148e9b1bc43b507ad2fd8a0f187ff297cbc88aee05",
+		"9b50fb7f12adb0da3e6662148e9b1bc43b507ad2fd8a0f187ff297cbc88aee05",
+	}
+	addresses := []string{"10.1.0.2/32", "10.1.0.3/32"}
+	options := []map[string]interface{}{{}, {"routed.vethprefix": "rt"}}
+
+	nl := newFakeNetlink()
+	fw := newFakeIptables(containersChainName, containerRejectChainName)
+	d, _ := newNetDriver(nl, fw, newFakeSysctls(), newFakeTc(), "0.1", "10.100.0.1", 1500, "")
+	for i, netID := range netIDs {
+		d.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: netID, Options: options[i]})
+		d.CreateEndpoint(&netApi.CreateEndpointRequest{
+			NetworkID:  netID,
+			EndpointID: eIDs[i],
+			Interface:  &netApi.EndpointInterface{Address: addresses[i]},
+			Options:    map[string]interface{}{"routed.dscp": "ef"},
+		})
+		d.Join(&netApi.JoinRequest{NetworkID: netID, EndpointID: eIDs[i]})
+		if err := d.SetEndpointPolicy(eIDs[i], "10.2.0.0/16"); err != nil {
+			t.Fatalf("TestNetworksGarbage failed: SetEndpointPolicy %v", err)
+		}
+	}
+
+	// Left by an endpoint of the second network the driver forgot about
+	nl.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "rt4b50a1b2c3"}, PeerName: "rtpeer"})
+
+	// Nothing is removed while the chains can't be listed
+	fw.failWith("-S", syscall.EPERM)
+	if report := d.CollectGarbage(); len(report.Errors) == 0 || len(report.Links) != 0 {
+		t.Fatalf("TestNetworksGarbage failed: removed without listing %+v", report)
+	}
+	if _, err := nl.LinkByName("rt4b50a1b2c3"); err != nil {
+		t.Fatalf("TestNetworksGarbage failed: removed without listing %v", err)
+	}
+	fw.failWith("-S", nil)
+
+	report := d.CollectGarbage()
+	if len(report.Errors) != 0 || len(report.Links) != 1 || len(report.Routes)+len(report.Chains)+len(report.Rules) != 0 {
+		t.Fatalf("TestNetworksGarbage failed: wrong report %+v", report)
+	}
+	if _, err := nl.LinkByName("rt4b50a1b2c3"); err == nil {
+		t.Fatalf("TestNetworksGarbage failed: stale veth kept")
+	}
+	for i, netID := range netIDs {
+		ep := d.networks[netID].endpoints[eIDs[i]]
+		if _, err := nl.LinkByName(ep.hostInterfaceName); err != nil || nl.findRoute(addresses[i]) == nil {
+			t.Fatalf("TestNetworksGarbage failed: link or route of %s removed", ep.hostInterfaceName)
+		}
+		if !fw.ChainExists("CONTAINER-" + ep.hostInterfaceName) {
+			t.Fatalf("TestNetworksGarbage failed: chain of %s removed", ep.hostInterfaceName)
+		}
+	}
+	if len(fw.chains[containersChainName]) != 2 || len(fw.chains["mangle/PREROUTING"]) != 2 {
+		t.Fatalf("TestNetworksGarbage failed: wrong iptables state %+v", fw.chains)
+	}
+}
+
+func TestIpvlanGarbage(t *testing.T) {
+	netID := "c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c"
+	eID := "4b50fb7f12adb0da3e6662148e9b1bc43b507ad2fd8a0f187ff297cbc88aee05"
+	options := map[string]interface{}{"routed.dataplane": "ipvlan", "routed.ipvlan.parent": "eth1"}
+
+	nl := newFakeNetlink()
+	nl.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth1"}})
+	d, _ := newNetDriver(nl, newFakeIptables(containersChainName, containerRejectChainName), newFakeSysctls(), newFakeTc(), "0.1", "10.100.0.1", 1500, "")
+	d.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: netID, Options: options})
+	d.CreateEndpoint(&netApi.CreateEndpointRequest{
+		NetworkID:  netID,
+		EndpointID: eID,
+		Interface:  &netApi.EndpointInterface{Address: "10.1.0.2/32"},
+	})
+	d.Join(&netApi.JoinRequest{NetworkID: netID, EndpointID: eID})
+	d.Leave(&netApi.LeaveRequest{NetworkID: netID, EndpointID: eID})
+	d.DeleteEndpoint(&netApi.DeleteEndpointRequest{NetworkID: netID, EndpointID: eID})
+
+	// The shared host link stays with the network
+	if report := d.CollectGarbage(); len(report.Links) != 0 || len(report.Errors) != 0 {
+		t.Fatalf("TestIpvlanGarbage failed: wrong report %+v", report)
+	}
+	if _, err := nl.LinkByName("ipvrhc56656"); err != nil {
+		t.Fatalf("TestIpvlanGarbage failed: host link removed %v", err)
+	}
+}
+
+func TestEndpointPolicy(t *testing.T) {
+	netID := "c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c"
+	eID := "4b50fb7f12adb0da3e6662148e9b1bc43b507ad2fd8a0f187ff297cbc88aee05"
+
+	fw := newFakeIptables(containersChainName, containerRejectChainName)
+	d, _ := newNetDriver(newFakeNetlink(), fw, newFakeSysctls(), newFakeTc(), "0.1", "10.100.0.1", 1500, "")
+	d.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: netID})
+	d.CreateEndpoint(&netApi.CreateEndpointRequest{
+		NetworkID:  netID,
+		EndpointID: eID,
+		Interface:  &netApi.EndpointInterface{Address: "10.1.0.2/32"},
+	})
+	if err := d.SetEndpointPolicy(eID, "10.2.0.0/16"); err == nil {
+		t.Fatalf("TestEndpointPolicy failed: set policy of endpoint not joined")
+	}
+	d.Join(&netApi.JoinRequest{NetworkID: netID, EndpointID: eID})
+	chain := "CONTAINER-" + d.networks[netID].endpoints[eID].hostInterfaceName
+
+	if err := d.SetEndpointPolicy(eID, "10.2.0.0/16, 10.3.0.1-10.3.0.9"); err != nil {
+		t.Fatalf("TestEndpointPolicy failed: %v", err)
+	}
+	if len(fw.chains[chain]) != 3 || len(fw.chains[containersChainName]) != 1 {
+		t.Fatalf("TestEndpointPolicy failed: wrong rules %+v", fw.chains)
+	}
+	if err := d.SetEndpointPolicy(eID, "10.4.0.1"); err != nil || len(fw.chains[chain]) != 2 ||
+		d.networks[netID].endpoints[eID].netFilter.String() != "allow 10.4.0.1/32" {
+		t.Fatalf("TestEndpointPolicy failed: policy not replaced %v %+v", err, fw.chains)
+	}
+	fw.failWith("-A", syscall.EPERM)
+	if err := d.SetEndpointPolicy(eID, "10.5.0.1"); err == nil || !strings.Contains(err.Error(), "previous ingress policy allow 10.4.0.1/32") ||
+		len(fw.chains[chain]) != 2 || len(fw.chains) != 4 || d.networks[netID].endpoints[eID].netFilter.String() != "allow 10.4.0.1/32" {
+		t.Fatalf("TestEndpointPolicy failed: previous policy not kept %v %+v", err, fw.chains)
+	}
+	fw.failWith("-A", nil)
+	if err := d.SetEndpointPolicy(eID, "nowhere"); err == nil {
+		t.Fatalf("TestEndpointPolicy failed: accepted invalid policy")
+	}
+	if err := d.SetEndpointPolicy(eID, ""); err != nil || fw.ChainExists(chain) || len(fw.chains[containersChainName]) != 0 {
+		t.Fatalf("TestEndpointPolicy failed: policy not removed %v %+v", err, fw.chains)
+	}
+}
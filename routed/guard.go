@@ -0,0 +1,125 @@
+package routed
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// routeGuard decides whether a container address may be routed from this
+// host. Besides the configured lists it always refuses the gateway and
+// addresses overlapping subnets of the host's own interfaces, as a route
+// for them would be spread to the whole cluster by the routing protocol.
+// The subnet holding the gateway is the one containers are meant to be
+// routed from, only the host address in it is refused.
+type routeGuard struct {
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+	m       sync.Mutex
+}
+
+func parsePrefixList(prefixes string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, prefix := range strings.Split(prefixes, ",") {
+		prefix = strings.TrimSpace(prefix)
+		if prefix == "" {
+			continue
+		}
+		ipNet := ParseIpOrNet(prefix)
+		if ipNet == nil {
+			return nil, fmt.Errorf("Could not parse IP or CIDR %s", prefix)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func (g *routeGuard) update(allowed string, denied string) error {
+	allowedNets, err := parsePrefixList(allowed)
+	if err != nil {
+		return fmt.Errorf("Invalid allowed routes: %v", err)
+	}
+	deniedNets, err := parsePrefixList(denied)
+	if err != nil {
+		return fmt.Errorf("Invalid denied routes: %v", err)
+	}
+
+	g.m.Lock()
+	defer g.m.Unlock()
+	g.allowed = allowedNets
+	g.denied = deniedNets
+
+	log.Infof("routeGuard: allowed routes %s, denied routes %s", g.allowed, g.denied)
+	return nil
+}
+
+func overlaps(a *net.IPNet, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// checkPrefixes validates ip against the configured allow and deny lists.
+func (g *routeGuard) checkPrefixes(ip *net.IPNet) error {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	for _, denied := range g.denied {
+		if overlaps(denied, ip) {
+			return fmt.Errorf("address %s is in denied prefix %s", ip, denied)
+		}
+	}
+
+	if len(g.allowed) == 0 {
+		return nil
+	}
+	for _, allowed := range g.allowed {
+		if allowed.Contains(ip.IP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("address %s is not in any allowed prefix", ip)
+}
+
+// checkHost validates ip against the gateway and the host interface subnets,
+// but the one holding the gateway.
+func checkHost(nl Netlink, ip *net.IPNet, gateway string) error {
+	gw := net.ParseIP(gateway)
+	if gw != nil && gw.Equal(ip.IP) {
+		return fmt.Errorf("address %s is the gateway", ip)
+	}
+
+	addrs, err := nl.AddrList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("can't list host addresses: %v", err)
+	}
+	for _, addr := range addrs {
+		if addr.IPNet.IP.Equal(ip.IP) {
+			return fmt.Errorf("address %s is host address %s", ip, addr.IPNet)
+		}
+		if gw != nil && addr.IPNet.Contains(gw) {
+			continue
+		}
+		if overlaps(addr.IPNet, ip) {
+			return fmt.Errorf("address %s overlaps host address %s", ip, addr.IPNet)
+		}
+	}
+	return nil
+}
+
+func (g *routeGuard) check(nl Netlink, ip *net.IPNet, gateway string) error {
+	err := g.checkPrefixes(ip)
+	if err == nil {
+		err = checkHost(nl, ip, gateway)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":   "security",
+			"address": ip.String(),
+		}).Errorf("routeGuard: refused route: %v", err)
+		return fmt.Errorf("Route guard refused %s: %v", ip, err)
+	}
+	return nil
+}
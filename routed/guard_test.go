@@ -0,0 +1,61 @@
+package routed
+
+import (
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestRouteGuard(t *testing.T) {
+	g := &routeGuard{}
+
+	if err := g.update("10.1.0.0/16", "10.1.255.0/24, 10.1.0.1"); err != nil {
+		t.Fatalf("TestRouteGuard failed: update %v", err)
+	}
+
+	for addr, ok := range map[string]bool{
+		"10.1.2.3":   true,
+		"10.1.0.1":   false,
+		"10.1.255.7": false,
+		"10.2.0.1":   false,
+	} {
+		err := g.checkPrefixes(ParseIpOrNet(addr))
+		if ok != (err == nil) {
+			t.Fatalf("TestRouteGuard failed: address %s allowed %v: %v", addr, ok, err)
+		}
+	}
+
+	if err := g.update("", "10.1.0.0/33"); err == nil {
+		t.Fatalf("TestRouteGuard failed: accepted invalid prefix")
+	}
+}
+
+func TestRouteGuardHost(t *testing.T) {
+	nl := newFakeNetlink()
+	nl.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth1"}})
+	nl.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "br0"}})
+	eth1, _ := nl.LinkByName("eth1")
+	br0, _ := nl.LinkByName("br0")
+	hostAddr, _ := netlink.ParseIPNet("192.168.1.10/24")
+	nl.AddrAdd(eth1, &netlink.Addr{IPNet: hostAddr})
+	// The gateway sits on a host interface whose subnet covers the pool
+	gwAddr, _ := netlink.ParseIPNet("10.1.0.1/16")
+	nl.AddrAdd(br0, &netlink.Addr{IPNet: gwAddr})
+
+	for addr, ok := range map[string]bool{
+		"10.1.2.3":     true,
+		"10.1.0.1":     false,
+		"192.168.1.20": false,
+		"192.168.1.10": false,
+	} {
+		err := checkHost(nl, ParseIpOrNet(addr), "10.1.0.1")
+		if ok != (err == nil) {
+			t.Fatalf("TestRouteGuardHost failed: address %s allowed %v: %v", addr, ok, err)
+		}
+	}
+
+	// Without the gateway on it the subnet belongs to the host
+	if err := checkHost(nl, ParseIpOrNet("10.1.2.3"), "10.100.0.1"); err == nil {
+		t.Fatalf("TestRouteGuardHost failed: allowed address in host subnet")
+	}
+}
@@ -0,0 +1,141 @@
+package routed
+
+import (
+	"time"
+
+	ipamApi "github.com/docker/go-plugins-helpers/ipam"
+	netApi "github.com/docker/go-plugins-helpers/network"
+)
+
+// SetMetrics records the calls to iptables, the failed Join steps and the
+// reconciler repairs in m, and adds the endpoints and their traffic to its
+// scrapes.
+func (d *NetDriver) SetMetrics(m *Metrics) {
+	d.metrics = m
+	d.fw = timedFirewall{Firewall: d.fw, metrics: m}
+	m.collect(d.collectMetrics)
+}
+
+func (d *NetDriver) collectMetrics(s *scrape) {
+	drift := d.drift.snapshot()
+	for _, kind := range []string{driftLinkMissing, driftLinkDown, driftMtu, driftRouteMissing} {
+		s.counter("routed_reconcile_drift_total", metricLabels("kind", kind), float64(drift[kind]))
+	}
+
+	for _, network := range d.allNetworks() {
+		network.m.Lock()
+		joined := 0
+		for _, ep := range network.endpoints {
+			if ep.joined {
+				joined++
+			}
+		}
+		labels := metricLabels("network", network.id)
+		s.gauge("routed_network_endpoints", labels, float64(len(network.endpoints)))
+		s.gauge("routed_network_joined_endpoints", labels, float64(joined))
+		network.m.Unlock()
+	}
+
+	for _, st := range d.EndpointStatistics() {
+		labels := metricLabels("endpoint", st.EndpointID, "address", st.Address, "iface", st.HostInterface)
+		s.counter("routed_endpoint_rx_bytes", labels, float64(st.RxBytes))
+		s.counter("routed_endpoint_tx_bytes", labels, float64(st.TxBytes))
+		s.counter("routed_endpoint_rx_packets", labels, float64(st.RxPackets))
+		s.counter("routed_endpoint_tx_packets", labels, float64(st.TxPackets))
+		s.counter("routed_endpoint_rx_dropped", labels, float64(st.RxDropped))
+		s.counter("routed_endpoint_tx_dropped", labels, float64(st.TxDropped))
+		s.counter("routed_endpoint_rx_errors", labels, float64(st.RxErrors))
+		s.counter("routed_endpoint_tx_errors", labels, float64(st.TxErrors))
+	}
+}
+
+// SetMetrics adds the usage of the pool to the scrapes of m.
+func (d *IpamDriver) SetMetrics(m *Metrics) {
+	d.metrics = m
+	m.collect(d.collectMetrics)
+}
+
+func (d *IpamDriver) collectMetrics(s *scrape) {
+	d.pool.m.Lock()
+	defer d.pool.m.Unlock()
+
+	ones, bits := d.pool.subnet.Mask.Size()
+	labels := metricLabels("pool", d.pool.id, "subnet", d.pool.subnet.String())
+	s.gauge("routed_pool_addresses", labels, float64(uint64(1)<<uint(bits-ones)))
+	s.gauge("routed_pool_allocated_addresses", labels, float64(len(d.pool.allocatedIPs)))
+}
+
+// InstrumentNetDriver returns d with the calls made by Docker counted and
+// timed in the metrics set on d.
+func InstrumentNetDriver(d *NetDriver) netApi.Driver {
+	return instrumentedNetDriver{d}
+}
+
+type instrumentedNetDriver struct {
+	*NetDriver
+}
+
+func (d instrumentedNetDriver) CreateNetwork(r *netApi.CreateNetworkRequest) (err error) {
+	defer d.metrics.observeCall("CreateNetwork", time.Now(), &err)
+	return d.NetDriver.CreateNetwork(r)
+}
+
+func (d instrumentedNetDriver) DeleteNetwork(r *netApi.DeleteNetworkRequest) (err error) {
+	defer d.metrics.observeCall("DeleteNetwork", time.Now(), &err)
+	return d.NetDriver.DeleteNetwork(r)
+}
+
+func (d instrumentedNetDriver) CreateEndpoint(r *netApi.CreateEndpointRequest) (res *netApi.CreateEndpointResponse, err error) {
+	defer d.metrics.observeCall("CreateEndpoint", time.Now(), &err)
+	return d.NetDriver.CreateEndpoint(r)
+}
+
+func (d instrumentedNetDriver) DeleteEndpoint(r *netApi.DeleteEndpointRequest) (err error) {
+	defer d.metrics.observeCall("DeleteEndpoint", time.Now(), &err)
+	return d.NetDriver.DeleteEndpoint(r)
+}
+
+func (d instrumentedNetDriver) EndpointInfo(r *netApi.InfoRequest) (res *netApi.InfoResponse, err error) {
+	defer d.metrics.observeCall("EndpointInfo", time.Now(), &err)
+	return d.NetDriver.EndpointInfo(r)
+}
+
+func (d instrumentedNetDriver) Join(r *netApi.JoinRequest) (res *netApi.JoinResponse, err error) {
+	defer d.metrics.observeCall("Join", time.Now(), &err)
+	return d.NetDriver.Join(r)
+}
+
+func (d instrumentedNetDriver) Leave(r *netApi.LeaveRequest) (err error) {
+	defer d.metrics.observeCall("Leave", time.Now(), &err)
+	return d.NetDriver.Leave(r)
+}
+
+// InstrumentIpamDriver returns d with the calls made by Docker counted and
+// timed in the metrics set on d.
+func InstrumentIpamDriver(d *IpamDriver) ipamApi.Ipam {
+	return instrumentedIpamDriver{d}
+}
+
+type instrumentedIpamDriver struct {
+	*IpamDriver
+}
+
+func (d instrumentedIpamDriver) RequestPool(r *ipamApi.RequestPoolRequest) (res *ipamApi.RequestPoolResponse, err error) {
+	defer d.metrics.observeCall("RequestPool", time.Now(), &err)
+	return d.IpamDriver.RequestPool(r)
+}
+
+func (d instrumentedIpamDriver) ReleasePool(r *ipamApi.ReleasePoolRequest) (err error) {
+	defer d.metrics.observeCall("ReleasePool", time.Now(), &err)
+	return d.IpamDriver.ReleasePool(r)
+}
+
+func (d instrumentedIpamDriver) RequestAddress(r *ipamApi.RequestAddressRequest) (res *ipamApi.RequestAddressResponse, err error) {
+	defer d.metrics.observeCall("RequestAddress", time.Now(), &err)
+	return d.IpamDriver.RequestAddress(r)
+}
+
+func (d instrumentedIpamDriver) ReleaseAddress(r *ipamApi.ReleaseAddressRequest) (err error) {
+	defer d.metrics.observeCall("ReleaseAddress", time.Now(), &err)
+	return d.IpamDriver.ReleaseAddress(r)
+}
@@ -25,13 +25,26 @@ type routedPool struct {
 
 type IpamDriver struct {
 	ipamApi.Ipam
-	version string
-	pool    *routedPool
+	nl           Netlink
+	version      string
+	pool         *routedPool
+	aggregate    *hostAggregate
+	conflictMode string
+	metrics      *Metrics
 }
 
-func NewIpamDriver(version string, gateway string) (*IpamDriver, error) {
+func NewIpamDriver(version string, gateway string, aggregate string) (*IpamDriver, error) {
+	return newIpamDriver(hostNetlink{}, version, gateway, aggregate)
+}
+
+func newIpamDriver(nl Netlink, version string, gateway string, aggregate string) (*IpamDriver, error) {
 	log.Debugf("NewIpamDriver: Initializing ipam routed driver version %+v", version)
 
+	agg, err := parseAggregate(aggregate)
+	if err != nil {
+		return nil, err
+	}
+
 	net, _ := netlink.ParseIPNet(network)
 	gw, _ := netlink.ParseIPNet(fmt.Sprintf("%s/32", gateway))
 
@@ -42,16 +55,41 @@ func NewIpamDriver(version string, gateway string) (*IpamDriver, error) {
 		gateway:      gw,
 	}
 
-	pool.allocatedIPs[gateway] = true
+	pool.allocatedIPs[fmt.Sprintf("%s/32", gateway)] = true
 
 	d := &IpamDriver{
-		version: version,
-		pool:    pool,
+		nl:           nl,
+		version:      version,
+		pool:         pool,
+		aggregate:    agg,
+		conflictMode: ConflictWarn,
 	}
 
 	return d, nil
 }
 
+// SetConflictMode sets what RequestAddress does when the requested address
+// is already routed to another host: refuse it, warn about it or not check.
+func (d *IpamDriver) SetConflictMode(mode string) error {
+	switch mode {
+	case ConflictRefuse, ConflictWarn, ConflictOff:
+		d.conflictMode = mode
+		return nil
+	}
+	return fmt.Errorf("Invalid conflict mode %s", mode)
+}
+
+// WatchConflicts reports addresses allocated on this host that show up as
+// routed to another host, until done is closed.
+func (d *IpamDriver) WatchConflicts(done <-chan struct{}) error {
+	w := &conflictWatcher{
+		nl:       d.nl,
+		pool:     d.pool,
+		reported: make(map[string]bool),
+	}
+	return w.run(done)
+}
+
 func (driver *IpamDriver) GetCapabilities() (*ipamApi.CapabilitiesResponse, error) {
 	res := &ipamApi.CapabilitiesResponse{
 		RequiresMACAddress: false,
@@ -70,17 +108,40 @@ func (driver *IpamDriver) GetDefaultAddressSpaces() (*ipamApi.AddressSpacesRespo
 }
 
 func (d *IpamDriver) RequestPool(r *ipamApi.RequestPoolRequest) (*ipamApi.RequestPoolResponse, error) {
-	log.Debugf("RequestPool: %+v", r)
+	cl := newCallLog("RequestPool")
+	cl.Debugf("RequestPool: request %+v", r)
+
+	// The network driver takes the same routed.gateway option
+	var gw *net.IPNet
+	if value, ok := r.Options[gatewayLabel]; ok {
+		ip, err := parseGateway(value)
+		if err != nil {
+			cl.Errorf("RequestPool: %v", err)
+			return nil, err
+		}
+		gw = &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+	}
 
 	ip, _ := netlink.ParseIPNet(r.Pool)
 
+	d.pool.m.Lock()
 	if ip != nil {
 		d.pool.subnet = ip
 	}
-
+	if gw != nil {
+		d.pool.allocatedIPs[gw.String()] = true
+	} else {
+		gw = d.pool.gateway
+	}
 	cidr := d.pool.subnet.String()
+	outside := d.aggregate != nil && !d.pool.subnet.Contains(d.aggregate.block.IP)
 	id := d.pool.id
-	gateway := d.pool.gateway.String()
+	d.pool.m.Unlock()
+
+	if outside {
+		cl.Warnf("RequestPool: aggregate %s is outside of pool %s", d.aggregate, cidr)
+	}
+	gateway := gw.String()
 
 	res := &ipamApi.RequestPoolResponse{
 		PoolID: id,
@@ -88,29 +149,49 @@ func (d *IpamDriver) RequestPool(r *ipamApi.RequestPoolRequest) (*ipamApi.Reques
 		Data:   map[string]string{netlabel.Gateway: gateway},
 	}
 
-	log.Infof("RequestPool: responded with %+v", res)
-	log.Infof("RequestPool: subnet is %v, gateway is %v", d.pool.subnet.String(),
-		d.pool.gateway.String())
+	cl.with(fieldPool, id)
+	cl.Debugf("RequestPool: response %+v", res)
+	cl.Infof("RequestPool: subnet is %s, gateway is %s", cidr, gateway)
 	return res, nil
 }
 
 func (d *IpamDriver) ReleasePool(r *ipamApi.ReleasePoolRequest) error {
-	log.Debugf("ReleasePool: request %+v", r)
+	cl := newCallLog("ReleasePool").with(fieldPool, r.PoolID)
+	cl.Debugf("ReleasePool: request %+v", r)
 
-	log.Infof("ReleasePool: PoolID %s ", r.PoolID)
+	cl.Infof("ReleasePool: released pool")
 	return nil
 }
 
 func (d *IpamDriver) RequestAddress(r *ipamApi.RequestAddressRequest) (*ipamApi.RequestAddressResponse, error) {
-	log.Debugf("RequestAddress: request %+v", r)
+	cl := newCallLog("RequestAddress").with(fieldPool, r.PoolID).with(fieldAddress, r.Address)
+	cl.Debugf("RequestAddress: request %+v", r)
 
 	if r.Options["RequestAddressType"] == netlabel.Gateway {
 		return nil, fmt.Errorf("RequestAddress: can't change gateway")
 	}
 
+	// The routing table is read before taking the pool lock, the other
+	// calls on the pool don't wait for the dump
+	var routes []netlink.Route
+	var routesErr error
+	if d.conflictMode != ConflictOff {
+		routes, routesErr = d.nl.RouteList(nil, netlink.FAMILY_V4)
+	}
+
 	d.pool.m.Lock()
 	defer d.pool.m.Unlock()
 
+	if r.Address == "" && d.aggregate != nil {
+		ip := d.pool.nextFree(d.aggregate)
+		if ip == nil {
+			return nil, fmt.Errorf("RequestAddress: no free address left in aggregate %s", d.aggregate)
+		}
+		r.Address = ip.String()
+		cl.with(fieldAddress, r.Address)
+		cl.Debugf("RequestAddress: picked %s from aggregate %s", r.Address, d.aggregate)
+	}
+
 	addr := fmt.Sprintf("%s/32", r.Address)
 
 	ip, _ := netlink.ParseIPNet(addr)
@@ -123,19 +204,33 @@ func (d *IpamDriver) RequestAddress(r *ipamApi.RequestAddressRequest) (*ipamApi.
 		return nil, fmt.Errorf("RequestAddress: address %s already allocated", addr)
 	}
 
+	if d.conflictMode != ConflictOff {
+		if routesErr != nil {
+			cl.Warnf("RequestAddress: can't check routes for %s: %v", addr, routesErr)
+		} else if route := findPeerRoute(routes, ip.IP); route != nil {
+			if d.conflictMode == ConflictRefuse {
+				return nil, fmt.Errorf("RequestAddress: address %s already routed via %s", addr, route.Gw)
+			}
+			cl.Warnf("RequestAddress: address %s already routed via %s", addr, route.Gw)
+		}
+	}
+
 	d.pool.allocatedIPs[addr] = true
 
 	res := &ipamApi.RequestAddressResponse{
 		Address: addr,
 	}
 
-	log.Infof("RequestAddress: response %+v", res)
+	// CreateEndpoint and Join of the address log the same ID
+	cl.with(fieldCorrelation, addressCorrelations.start(ip.IP.String()))
+	cl.Infof("RequestAddress: allocated %s", addr)
 
 	return res, nil
 }
 
 func (d *IpamDriver) ReleaseAddress(r *ipamApi.ReleaseAddressRequest) error {
-	log.Debugf("ReleaseAddress: request %+v", r)
+	cl := newCallLog("ReleaseAddress").with(fieldPool, r.PoolID).with(fieldAddress, r.Address)
+	cl.Debugf("ReleaseAddress: request %+v", r)
 
 	d.pool.m.Lock()
 	defer d.pool.m.Unlock()
@@ -144,6 +239,21 @@ func (d *IpamDriver) ReleaseAddress(r *ipamApi.ReleaseAddressRequest) error {
 
 	delete(d.pool.allocatedIPs, ip)
 
-	log.Infof("ReleaseAddress: %s from %s", r.Address, r.PoolID)
+	cl.with(fieldCorrelation, addressCorrelations.end(r.Address))
+	cl.Infof("ReleaseAddress: released %s", r.Address)
 	return nil
 }
+
+// nextFree returns the first address of the aggregate not yet allocated.
+// Caller must hold the pool lock.
+func (p *routedPool) nextFree(agg *hostAggregate) net.IP {
+	var free net.IP
+	agg.addresses(func(ip net.IP) bool {
+		if !p.allocatedIPs[fmt.Sprintf("%s/32", ip)] {
+			free = ip
+			return false
+		}
+		return true
+	})
+	return free
+}
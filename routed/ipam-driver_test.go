@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	ipamApi "github.com/docker/go-plugins-helpers/ipam"
+	"github.com/docker/libnetwork/netlabel"
 )
 
 func TestPool(t *testing.T) {
@@ -12,7 +13,7 @@ func TestPool(t *testing.T) {
 	gateway := "10.100.0.1"
 	subnet := "10.1.0.0/16"
 
-	d, err := NewIpamDriver(version, gateway)
+	d, err := newIpamDriver(newFakeNetlink(), version, gateway, "")
 
 	if err != nil {
 		t.Fatalf("TestPool failed: could not create driver - %v", err)
@@ -31,6 +32,37 @@ func TestPool(t *testing.T) {
 		t.Fatalf("TestPool failed: RequestPool wrong subnet %s", d.pool.subnet.String())
 	}
 
+	res, err := d.RequestPool(&ipamApi.RequestPoolRequest{
+		Pool:         subnet,
+		AddressSpace: "Testlocal",
+		Options:      map[string]string{"routed.gateway": "10.200.0.1"},
+	})
+
+	if err != nil || res.Data[netlabel.Gateway] != "10.200.0.1/32" || !d.pool.allocatedIPs["10.200.0.1/32"] {
+		t.Fatalf("TestPool failed: RequestPool wrong gateway %+v %v", res, err)
+	}
+
+	// An invalid gateway leaves the pool alone
+	if _, err := d.RequestPool(&ipamApi.RequestPoolRequest{
+		Pool:    "10.2.0.0/16",
+		Options: map[string]string{"routed.gateway": "nowhere"},
+	}); err == nil || d.pool.subnet.String() != subnet {
+		t.Fatalf("TestPool failed: RequestPool with invalid gateway %s %v", d.pool.subnet, err)
+	}
+
+	// The pool is read while it is requested again
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			d.RequestPool(&ipamApi.RequestPoolRequest{Pool: subnet})
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		d.Pools()
+	}
+	<-done
+
 	err = d.ReleasePool(&ipamApi.ReleasePoolRequest{
 		PoolID: subnet,
 	})
@@ -45,7 +77,7 @@ func TestAddress(t *testing.T) {
 	gateway := "10.100.0.1"
 	address := "10.1.0.2"
 
-	d, err := NewIpamDriver(version, gateway)
+	d, err := newIpamDriver(newFakeNetlink(), version, gateway, "")
 
 	if err != nil {
 		t.Fatalf("TestAddress failed : %v", err)
@@ -78,3 +110,38 @@ func TestAddress(t *testing.T) {
 		t.Fatalf("TestAddress failed: ReleaseAddress for address %s: %+v", address, err)
 	}
 }
+
+func TestAggregateAddress(t *testing.T) {
+	version := "0.1"
+	gateway := "10.1.3.1"
+	aggregate := "10.1.3.0/30"
+
+	d, err := newIpamDriver(newFakeNetlink(), version, gateway, aggregate)
+
+	if err != nil {
+		t.Fatalf("TestAggregateAddress failed: could not create driver - %v", err)
+	}
+
+	// 10.1.3.0 and 10.1.3.3 are not usable and 10.1.3.1 is the gateway
+	res, err := d.RequestAddress(&ipamApi.RequestAddressRequest{
+		PoolID: "routed",
+	})
+
+	if err != nil || res.Address != "10.1.3.2/32" {
+		t.Fatalf("TestAggregateAddress failed: RequestAddress got %+v: %v", res, err)
+	}
+
+	_, err = d.RequestAddress(&ipamApi.RequestAddressRequest{
+		PoolID: "routed",
+	})
+
+	if err == nil {
+		t.Fatalf("TestAggregateAddress failed: RequestAddress allocated beyond aggregate %s", aggregate)
+	}
+
+	_, err = newIpamDriver(newFakeNetlink(), version, gateway, "10.1.3.1/32")
+
+	if err == nil {
+		t.Fatalf("TestAggregateAddress failed: accepted single address aggregate")
+	}
+}
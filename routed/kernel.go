@@ -0,0 +1,312 @@
+package routed
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/libnetwork/iptables"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// Netlink is the set of link, address and route operations the network
+// driver performs on the host.
+type Netlink interface {
+	LinkAdd(link netlink.Link) error
+	LinkDel(link netlink.Link) error
+	LinkByName(name string) (netlink.Link, error)
+	LinkList() ([]netlink.Link, error)
+	LinkSetUp(link netlink.Link) error
+	LinkSetDown(link netlink.Link) error
+	LinkSetMTU(link netlink.Link, mtu int) error
+	LinkSetHardwareAddr(link netlink.Link, hwaddr net.HardwareAddr) error
+	LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error
+	AddrAdd(link netlink.Link, addr *netlink.Addr) error
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	RouteAdd(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+	RouteList(link netlink.Link, family int) ([]netlink.Route, error)
+	// RouteGet returns the route the kernel would use to reach destination.
+	RouteGet(destination net.IP) ([]netlink.Route, error)
+	RouteSubscribe(ch chan<- netlink.RouteUpdate, done <-chan struct{}) error
+	// OpenSandbox returns the operations on the network namespace of a
+	// container, at the path Docker gives as sandbox key.
+	OpenSandbox(path string) (Sandbox, error)
+}
+
+// Sandbox is the set of operations the network driver performs in the
+// network namespace of a container.
+type Sandbox interface {
+	LinkList() ([]netlink.Link, error)
+	RouteList(link netlink.Link, family int) ([]netlink.Route, error)
+	NeighSet(neigh *netlink.Neigh) error
+	// SetSysctl sets a kernel parameter of the namespace.
+	SetSysctl(name string, value string) error
+	// SendGratuitousArp announces that ip is on link.
+	SendGratuitousArp(link netlink.Link, ip net.IP) error
+	// Close releases the namespace.
+	Close()
+}
+
+// Firewall is the set of iptables operations the network driver performs
+// on the host.
+type Firewall interface {
+	// Raw runs iptables with the given arguments.
+	Raw(args ...string) ([]byte, error)
+	// ChainExists reports whether a chain exists in the filter table.
+	ChainExists(chain string) bool
+}
+
+// Sysctls reads and writes kernel parameters of the host, named as for the
+// sysctl command.
+type Sysctls interface {
+	Get(name string) (string, error)
+	Set(name string, value string) error
+}
+
+// TrafficControl configures queueing disciplines and filters of the host.
+type TrafficControl interface {
+	// Tc runs tc with the given arguments.
+	Tc(args ...string) ([]byte, error)
+}
+
+// hostNetlink performs the netlink operations on the host kernel.
+type hostNetlink struct{}
+
+func (hostNetlink) LinkAdd(link netlink.Link) error {
+	return netlink.LinkAdd(link)
+}
+
+func (hostNetlink) LinkDel(link netlink.Link) error {
+	return netlink.LinkDel(link)
+}
+
+func (hostNetlink) LinkByName(name string) (netlink.Link, error) {
+	return netlink.LinkByName(name)
+}
+
+func (hostNetlink) LinkList() ([]netlink.Link, error) {
+	return netlink.LinkList()
+}
+
+func (hostNetlink) LinkSetUp(link netlink.Link) error {
+	return netlink.LinkSetUp(link)
+}
+
+func (hostNetlink) LinkSetDown(link netlink.Link) error {
+	return netlink.LinkSetDown(link)
+}
+
+func (hostNetlink) LinkSetMTU(link netlink.Link, mtu int) error {
+	return netlink.LinkSetMTU(link, mtu)
+}
+
+func (hostNetlink) LinkSetHardwareAddr(link netlink.Link, hwaddr net.HardwareAddr) error {
+	return netlink.LinkSetHardwareAddr(link, hwaddr)
+}
+
+func (hostNetlink) LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error {
+	return netlink.LinkSubscribe(ch, done)
+}
+
+func (hostNetlink) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	return netlink.AddrAdd(link, addr)
+}
+
+func (hostNetlink) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	return netlink.AddrList(link, family)
+}
+
+func (hostNetlink) RouteAdd(route *netlink.Route) error {
+	return netlink.RouteAdd(route)
+}
+
+func (hostNetlink) RouteDel(route *netlink.Route) error {
+	return netlink.RouteDel(route)
+}
+
+func (hostNetlink) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	return netlink.RouteList(link, family)
+}
+
+func (hostNetlink) RouteGet(destination net.IP) ([]netlink.Route, error) {
+	return netlink.RouteGet(destination)
+}
+
+func (hostNetlink) RouteSubscribe(ch chan<- netlink.RouteUpdate, done <-chan struct{}) error {
+	return netlink.RouteSubscribe(ch, done)
+}
+
+func (hostNetlink) OpenSandbox(path string) (Sandbox, error) {
+	ns, err := netns.GetFromPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		ns.Close()
+		return nil, err
+	}
+	return &hostSandbox{ns, h}, nil
+}
+
+// hostSandbox performs the operations in a container namespace.
+type hostSandbox struct {
+	ns netns.NsHandle
+	h  *netlink.Handle
+}
+
+// do runs fn with the calling thread in the namespace, for the operations
+// that are not netlink requests.
+func (s *hostSandbox) do(fn func() error) (err error) {
+	runtime.LockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer origin.Close()
+
+	if err := netns.Set(s.ns); err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer func() {
+		// A thread left in the container namespace stays locked, the
+		// runtime then terminates it with the goroutine instead of running
+		// other goroutines on it.
+		if restoreErr := netns.Set(origin); restoreErr != nil {
+			log.Errorf("do: Couldn't return to the host namespace: %v", restoreErr)
+			if err == nil {
+				err = restoreErr
+			}
+			return
+		}
+		runtime.UnlockOSThread()
+	}()
+
+	return fn()
+}
+
+func (s *hostSandbox) LinkList() ([]netlink.Link, error) {
+	return s.h.LinkList()
+}
+
+func (s *hostSandbox) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	return s.h.RouteList(link, family)
+}
+
+func (s *hostSandbox) NeighSet(neigh *netlink.Neigh) error {
+	return s.h.NeighSet(neigh)
+}
+
+func (s *hostSandbox) SetSysctl(name string, value string) error {
+	// /proc/sys/net shows the namespace of the thread opening the file
+	return s.do(func() error {
+		return hostSysctls{}.Set(name, value)
+	})
+}
+
+func (s *hostSandbox) SendGratuitousArp(link netlink.Link, ip net.IP) error {
+	frame := gratuitousArp(link.Attrs().HardwareAddr, ip)
+	if frame == nil {
+		return fmt.Errorf("can't announce %s from %s", ip, link.Attrs().HardwareAddr)
+	}
+
+	return s.do(func() error {
+		proto := htons(syscall.ETH_P_ARP)
+		fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(proto))
+		if err != nil {
+			return err
+		}
+		defer syscall.Close(fd)
+
+		addr := &syscall.SockaddrLinklayer{
+			Protocol: proto,
+			Ifindex:  link.Attrs().Index,
+			Halen:    6,
+		}
+		copy(addr.Addr[:], broadcastMac)
+		return syscall.Sendto(fd, frame, 0, addr)
+	})
+}
+
+func (s *hostSandbox) Close() {
+	s.h.Delete()
+	s.ns.Close()
+}
+
+var broadcastMac = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// gratuitousArp builds the ethernet frame of an ARP request for ip sent by
+// ip itself, which updates the neighbor caches of the segment.
+func gratuitousArp(mac net.HardwareAddr, ip net.IP) []byte {
+	ip = ip.To4()
+	if len(mac) != 6 || ip == nil {
+		return nil
+	}
+
+	frame := make([]byte, 0, 42)
+	frame = append(frame, broadcastMac...)
+	frame = append(frame, mac...)
+	frame = append(frame, 0x08, 0x06) // ARP
+	frame = append(frame, 0x00, 0x01) // ethernet
+	frame = append(frame, 0x08, 0x00) // IPv4
+	frame = append(frame, 6, 4)
+	frame = append(frame, 0x00, 0x01) // request
+	frame = append(frame, mac...)
+	frame = append(frame, ip...)
+	frame = append(frame, 0, 0, 0, 0, 0, 0)
+	frame = append(frame, ip...)
+	return frame
+}
+
+// hostIptables runs iptables on the host.
+type hostIptables struct{}
+
+func (hostIptables) Raw(args ...string) ([]byte, error) {
+	return iptables.Raw(args...)
+}
+
+func (hostIptables) ChainExists(chain string) bool {
+	_, err := iptables.Raw("-t", string(iptables.Filter), "-n", "-L", chain)
+	return err == nil
+}
+
+// hostSysctls accesses the kernel parameters through /proc/sys.
+type hostSysctls struct{}
+
+func sysctlPath(name string) string {
+	return "/proc/sys/" + strings.Replace(name, ".", "/", -1)
+}
+
+func (hostSysctls) Get(name string) (string, error) {
+	value, err := ioutil.ReadFile(sysctlPath(name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(value)), nil
+}
+
+func (hostSysctls) Set(name string, value string) error {
+	return ioutil.WriteFile(sysctlPath(name), []byte(value), 0644)
+}
+
+// hostTc runs tc on the host.
+type hostTc struct{}
+
+func (hostTc) Tc(args ...string) ([]byte, error) {
+	return exec.Command("tc", args...).CombinedOutput()
+}
@@ -0,0 +1,31 @@
+package routed
+
+import (
+	"strings"
+
+	"github.com/docker/libnetwork/netlabel"
+)
+
+const (
+	labelPrefix = "routed."
+)
+
+// routedLabels collects the routed.* options of a network or an endpoint,
+// whether given directly or as generic driver options.
+func routedLabels(options map[string]interface{}) map[string]string {
+	labels := make(map[string]string)
+
+	collect := func(opts map[string]interface{}) {
+		for key, value := range opts {
+			if str, ok := value.(string); ok && strings.HasPrefix(key, labelPrefix) {
+				labels[key] = str
+			}
+		}
+	}
+
+	collect(options)
+	if generic, ok := options[netlabel.GenericData].(map[string]interface{}); ok {
+		collect(generic)
+	}
+	return labels
+}
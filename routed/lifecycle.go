@@ -0,0 +1,227 @@
+package routed
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	ipamApi "github.com/docker/go-plugins-helpers/ipam"
+	netApi "github.com/docker/go-plugins-helpers/network"
+)
+
+const (
+	// DefaultStateFile is where the state is written on shutdown unless told
+	// otherwise
+	DefaultStateFile = "/var/lib/routed/state.json"
+)
+
+// PluginSocket returns the path of the socket Docker finds a plugin named
+// name at, as the plugin helpers create it.
+func PluginSocket(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(pluginDir, name+".sock")
+}
+
+// Gate lets the plugin calls through until it is closed, and tells when the
+// calls in progress are over.
+type Gate struct {
+	active int
+	closed bool
+	idle   chan struct{}
+	m      sync.Mutex
+}
+
+func NewGate() *Gate {
+	return &Gate{idle: make(chan struct{})}
+}
+
+func (g *Gate) enter() error {
+	g.m.Lock()
+	defer g.m.Unlock()
+	if g.closed {
+		return fmt.Errorf("The routed plugin is shutting down")
+	}
+	g.active++
+	return nil
+}
+
+func (g *Gate) leave() {
+	g.m.Lock()
+	defer g.m.Unlock()
+	g.active--
+	if g.closed && g.active == 0 {
+		close(g.idle)
+	}
+}
+
+// Close refuses the calls from now on and waits up to timeout for the calls
+// in progress to return. It returns the number of calls still in progress.
+func (g *Gate) Close(timeout time.Duration) int {
+	g.m.Lock()
+	if !g.closed {
+		g.closed = true
+		if g.active == 0 {
+			close(g.idle)
+		}
+	}
+	g.m.Unlock()
+
+	select {
+	case <-g.idle:
+		return 0
+	case <-time.After(timeout):
+	}
+	g.m.Lock()
+	defer g.m.Unlock()
+	return g.active
+}
+
+// GateNetDriver returns d with its calls going through g.
+func GateNetDriver(d netApi.Driver, g *Gate) netApi.Driver {
+	return gatedNetDriver{d, g}
+}
+
+type gatedNetDriver struct {
+	netApi.Driver
+	gate *Gate
+}
+
+func (d gatedNetDriver) CreateNetwork(r *netApi.CreateNetworkRequest) error {
+	if err := d.gate.enter(); err != nil {
+		return err
+	}
+	defer d.gate.leave()
+	return d.Driver.CreateNetwork(r)
+}
+
+func (d gatedNetDriver) DeleteNetwork(r *netApi.DeleteNetworkRequest) error {
+	if err := d.gate.enter(); err != nil {
+		return err
+	}
+	defer d.gate.leave()
+	return d.Driver.DeleteNetwork(r)
+}
+
+func (d gatedNetDriver) CreateEndpoint(r *netApi.CreateEndpointRequest) (*netApi.CreateEndpointResponse, error) {
+	if err := d.gate.enter(); err != nil {
+		return nil, err
+	}
+	defer d.gate.leave()
+	return d.Driver.CreateEndpoint(r)
+}
+
+func (d gatedNetDriver) DeleteEndpoint(r *netApi.DeleteEndpointRequest) error {
+	if err := d.gate.enter(); err != nil {
+		return err
+	}
+	defer d.gate.leave()
+	return d.Driver.DeleteEndpoint(r)
+}
+
+func (d gatedNetDriver) EndpointInfo(r *netApi.InfoRequest) (*netApi.InfoResponse, error) {
+	if err := d.gate.enter(); err != nil {
+		return nil, err
+	}
+	defer d.gate.leave()
+	return d.Driver.EndpointInfo(r)
+}
+
+func (d gatedNetDriver) Join(r *netApi.JoinRequest) (*netApi.JoinResponse, error) {
+	if err := d.gate.enter(); err != nil {
+		return nil, err
+	}
+	defer d.gate.leave()
+	return d.Driver.Join(r)
+}
+
+func (d gatedNetDriver) Leave(r *netApi.LeaveRequest) error {
+	if err := d.gate.enter(); err != nil {
+		return err
+	}
+	defer d.gate.leave()
+	return d.Driver.Leave(r)
+}
+
+// GateIpamDriver returns d with its calls going through g.
+func GateIpamDriver(d ipamApi.Ipam, g *Gate) ipamApi.Ipam {
+	return gatedIpamDriver{d, g}
+}
+
+type gatedIpamDriver struct {
+	ipamApi.Ipam
+	gate *Gate
+}
+
+func (d gatedIpamDriver) RequestPool(r *ipamApi.RequestPoolRequest) (*ipamApi.RequestPoolResponse, error) {
+	if err := d.gate.enter(); err != nil {
+		return nil, err
+	}
+	defer d.gate.leave()
+	return d.Ipam.RequestPool(r)
+}
+
+func (d gatedIpamDriver) ReleasePool(r *ipamApi.ReleasePoolRequest) error {
+	if err := d.gate.enter(); err != nil {
+		return err
+	}
+	defer d.gate.leave()
+	return d.Ipam.ReleasePool(r)
+}
+
+func (d gatedIpamDriver) RequestAddress(r *ipamApi.RequestAddressRequest) (*ipamApi.RequestAddressResponse, error) {
+	if err := d.gate.enter(); err != nil {
+		return nil, err
+	}
+	defer d.gate.leave()
+	return d.Ipam.RequestAddress(r)
+}
+
+func (d gatedIpamDriver) ReleaseAddress(r *ipamApi.ReleaseAddressRequest) error {
+	if err := d.gate.enter(); err != nil {
+		return err
+	}
+	defer d.gate.leave()
+	return d.Ipam.ReleaseAddress(r)
+}
+
+// State is the pools, networks and endpoints of the plugin when it stopped.
+type State struct {
+	Time     time.Time      `json:"time"`
+	Version  string         `json:"version"`
+	Pools    []PoolState    `json:"pools"`
+	Networks []NetworkState `json:"networks"`
+}
+
+// WriteState writes the state of the drivers to path as JSON. The file is
+// replaced at once, so it is never left half written.
+func WriteState(path string, ipam *IpamDriver, net *NetDriver) error {
+	state := &State{
+		Time:     time.Now(),
+		Version:  net.version,
+		Pools:    ipam.Pools(),
+		Networks: net.Networks(),
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("Can't write state: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("Can't write state: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Can't write state: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package routed
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ipamApi "github.com/docker/go-plugins-helpers/ipam"
+	netApi "github.com/docker/go-plugins-helpers/network"
+)
+
+func TestGate(t *testing.T) {
+	netID := "c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c"
+
+	d, _ := newNetDriver(newFakeNetlink(), newFakeIptables(), newFakeSysctls(), newFakeTc(), "0.1", "10.100.0.1", 1500, "")
+	g := NewGate()
+	driver := GateNetDriver(d, g)
+	if err := driver.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: netID}); err != nil {
+		t.Fatalf("TestGate failed: CreateNetwork %v", err)
+	}
+
+	// A call in progress holds the shutdown until it returns
+	g.enter()
+	left := make(chan struct{})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		g.leave()
+		close(left)
+	}()
+	if active := g.Close(time.Second); active != 0 {
+		t.Fatalf("TestGate failed: %d calls in progress", active)
+	}
+	select {
+	case <-left:
+	default:
+		t.Fatalf("TestGate failed: Close returned before the call")
+	}
+
+	if err := driver.DeleteNetwork(&netApi.DeleteNetworkRequest{NetworkID: netID}); err == nil {
+		t.Fatalf("TestGate failed: call accepted after Close")
+	}
+	if d.networks[netID] == nil {
+		t.Fatalf("TestGate failed: refused call reached the driver")
+	}
+
+	// A call that never returns times out
+	g = NewGate()
+	g.enter()
+	if active := g.Close(10 * time.Millisecond); active != 1 {
+		t.Fatalf("TestGate failed: %d calls in progress instead of 1", active)
+	}
+}
+
+func TestWriteState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routed")
+	if err != nil {
+		t.Fatalf("TestWriteState failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lib", "state.json")
+
+	id, _ := newIpamDriver(newFakeNetlink(), "0.1", "10.100.0.1", "")
+	id.RequestPool(&ipamApi.RequestPoolRequest{Pool: "10.1.0.0/16"})
+	nd, _ := newNetDriver(newFakeNetlink(), newFakeIptables(), newFakeSysctls(), newFakeTc(), "0.1", "10.100.0.1", 1500, "")
+	nd.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: "c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c"})
+
+	if err := WriteState(path, id, nd); err != nil {
+		t.Fatalf("TestWriteState failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("TestWriteState failed: %v", err)
+	}
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatalf("TestWriteState failed: %v", err)
+	}
+	if state.Version != "0.1" || len(state.Pools) != 1 || len(state.Networks) != 1 {
+		t.Fatalf("TestWriteState failed: wrong state %s", data)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("TestWriteState failed: temporary file left")
+	}
+}
@@ -0,0 +1,163 @@
+package routed
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Fields of the handler logs
+const (
+	fieldNetwork     = "network_id"
+	fieldEndpoint    = "endpoint_id"
+	fieldPool        = "pool_id"
+	fieldAddress     = "address"
+	fieldHostIface   = "host_iface"
+	fieldCorrelation = "correlation_id"
+	fieldStep        = "step"
+	fieldDuration    = "duration"
+)
+
+var handlerFields = []string{fieldNetwork, fieldEndpoint, fieldPool, fieldAddress, fieldHostIface, fieldCorrelation}
+
+// With the JSON format every handler line carries all the handler fields,
+// empty when they don't apply, so that the lines share one schema.
+var logAllFields = false
+
+// SetLogFormat sets the format of the logs, text or json.
+func SetLogFormat(format string) error {
+	switch format {
+	case LogFormatText:
+		log.SetFormatter(&log.TextFormatter{})
+		logAllFields = false
+	case LogFormatJSON:
+		log.SetFormatter(&log.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+		logAllFields = true
+	default:
+		return fmt.Errorf("Invalid log format %s, must be %s or %s", format, LogFormatText, LogFormatJSON)
+	}
+	return nil
+}
+
+// callLog logs the lines of a plugin call with the fields identifying what
+// it works on, the step it is at and the time since it started.
+type callLog struct {
+	step   string
+	start  time.Time
+	fields log.Fields
+}
+
+func newCallLog(step string) *callLog {
+	return &callLog{step: step, start: time.Now(), fields: log.Fields{}}
+}
+
+// with sets a field of the following lines.
+func (l *callLog) with(key string, value string) *callLog {
+	l.fields[key] = value
+	return l
+}
+
+// withEndpoint sets the fields of an endpoint.
+func (l *callLog) withEndpoint(eid string, ep *routedEndpoint) *callLog {
+	l.with(fieldEndpoint, eid)
+	if ep == nil {
+		return l
+	}
+	l.with(fieldAddress, ep.ipv4Address.IP.String())
+	l.with(fieldHostIface, ep.hostInterfaceName)
+	return l.with(fieldCorrelation, ep.correlationID)
+}
+
+// at returns the entry of a line logged at step. A nil callLog logs without
+// fields.
+func (l *callLog) at(step string) *log.Entry {
+	if l == nil {
+		return log.NewEntry(log.StandardLogger())
+	}
+	fields := log.Fields{}
+	if logAllFields {
+		for _, key := range handlerFields {
+			fields[key] = ""
+		}
+	}
+	for key, value := range l.fields {
+		if value != "" || logAllFields {
+			fields[key] = value
+		}
+	}
+	fields[fieldStep] = step
+	fields[fieldDuration] = time.Since(l.start).Seconds()
+	return log.WithFields(fields)
+}
+
+func (l *callLog) Debugf(format string, args ...interface{}) {
+	l.at(l.step).Debugf(format, args...)
+}
+
+func (l *callLog) Infof(format string, args ...interface{}) {
+	l.at(l.step).Infof(format, args...)
+}
+
+func (l *callLog) Warnf(format string, args ...interface{}) {
+	l.at(l.step).Warnf(format, args...)
+}
+
+func (l *callLog) Errorf(format string, args ...interface{}) {
+	l.at(l.step).Errorf(format, args...)
+}
+
+// correlations holds, by container address, the ID tying together the calls
+// made for it: RequestAddress, CreateEndpoint and Join, until the address is
+// released. The IPAM and network drivers run in the same process.
+type correlations struct {
+	ids map[string]string
+	m   sync.Mutex
+}
+
+var addressCorrelations = &correlations{ids: make(map[string]string)}
+
+// start gives a new ID to an address.
+func (c *correlations) start(address string) string {
+	id := newCorrelationID()
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.ids[address] = id
+	return id
+}
+
+// get returns the ID of an address, or a new one not kept when the address
+// didn't come from this plugin's IPAM driver.
+func (c *correlations) get(address string) string {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if id, ok := c.ids[address]; ok {
+		return id
+	}
+	return newCorrelationID()
+}
+
+// end returns the ID of an address released and forgets it.
+func (c *correlations) end(address string) string {
+	c.m.Lock()
+	defer c.m.Unlock()
+	id := c.ids[address]
+	delete(c.ids, address)
+	return id
+}
+
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,88 @@
+package routed
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	ipamApi "github.com/docker/go-plugins-helpers/ipam"
+	netApi "github.com/docker/go-plugins-helpers/network"
+)
+
+func TestJSONLogs(t *testing.T) {
+	netID := "c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c"
+	eID := "4b50fb7f12adb0da3e6662148e9b1bc43b507ad2fd8a0f187ff297cbc88aee05"
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	level := log.GetLevel()
+	log.SetLevel(log.DebugLevel)
+	if err := SetLogFormat(LogFormatJSON); err != nil {
+		t.Fatalf("TestJSONLogs failed: %v", err)
+	}
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetLevel(level)
+		SetLogFormat(LogFormatText)
+	}()
+
+	id, _ := newIpamDriver(newFakeNetlink(), "0.1", "10.100.0.1", "")
+	id.SetConflictMode(ConflictOff)
+	id.RequestAddress(&ipamApi.RequestAddressRequest{PoolID: "routed", Address: "10.1.0.2"})
+
+	d, _ := newNetDriver(newFakeNetlink(), newFakeIptables(containersChainName, containerRejectChainName), newFakeSysctls(), newFakeTc(), "0.1", "10.100.0.1", 1500, "")
+	d.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: netID})
+	d.CreateEndpoint(&netApi.CreateEndpointRequest{
+		NetworkID:  netID,
+		EndpointID: eID,
+		Interface:  &netApi.EndpointInterface{Address: "10.1.0.2/32"},
+	})
+	if _, err := d.Join(&netApi.JoinRequest{NetworkID: netID, EndpointID: eID}); err != nil {
+		t.Fatalf("TestJSONLogs failed: Join %v", err)
+	}
+	id.ReleaseAddress(&ipamApi.ReleaseAddressRequest{PoolID: "routed", Address: "10.1.0.2"})
+
+	correlations := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("TestJSONLogs failed: %v in %s", err, line)
+		}
+		step, ok := entry[fieldStep].(string)
+		if !ok {
+			continue
+		}
+		for _, key := range append(handlerFields, fieldDuration) {
+			if _, ok := entry[key]; !ok {
+				t.Fatalf("TestJSONLogs failed: no %s in %s", key, line)
+			}
+		}
+		if entry[fieldAddress] == "10.1.0.2" {
+			correlations[step] = entry[fieldCorrelation].(string)
+		}
+		if step == "add route" && (entry[fieldEndpoint] != eID || entry[fieldHostIface] == "") {
+			t.Fatalf("TestJSONLogs failed: Join step without endpoint fields %s", line)
+		}
+	}
+
+	cid := correlations["RequestAddress"]
+	if cid == "" {
+		t.Fatalf("TestJSONLogs failed: RequestAddress without correlation ID %+v", correlations)
+	}
+	for _, step := range []string{"CreateEndpoint", "Join", "add route", "ReleaseAddress"} {
+		if correlations[step] != cid {
+			t.Fatalf("TestJSONLogs failed: %s has correlation ID %q instead of %q", step, correlations[step], cid)
+		}
+	}
+
+	// Released addresses get a new ID
+	if addressCorrelations.get("10.1.0.2") == cid {
+		t.Fatalf("TestJSONLogs failed: correlation ID kept after release")
+	}
+	if err := SetLogFormat("xml"); err == nil {
+		t.Fatalf("TestJSONLogs failed: accepted log format xml")
+	}
+}
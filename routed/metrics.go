@@ -0,0 +1,289 @@
+package routed
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	counterMetric   = "counter"
+	gaugeMetric     = "gauge"
+	histogramMetric = "histogram"
+)
+
+// Bounds of the latency histograms, in seconds
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var metricHelp = map[string]string{
+	"routed_calls_total":               "Calls made by Docker to the plugin.",
+	"routed_call_errors_total":         "Calls made by Docker to the plugin that failed.",
+	"routed_call_duration_seconds":     "Time taken by the calls made by Docker to the plugin.",
+	"routed_step_failures_total":       "Failed steps of the endpoint setup, by transaction and step.",
+	"routed_iptables_duration_seconds": "Time taken by iptables calls.",
+	"routed_reconcile_drift_total":     "Differences between the endpoints and the kernel state repaired by the reconciler, by kind.",
+	"routed_pool_addresses":            "Addresses of the pool.",
+	"routed_pool_allocated_addresses":  "Addresses of the pool allocated to containers or the gateway.",
+	"routed_network_endpoints":         "Endpoints of the network.",
+	"routed_network_joined_endpoints":  "Endpoints of the network joined to a container.",
+	"routed_endpoint_rx_bytes":         "Bytes sent by the container, as counted by its host veth.",
+	"routed_endpoint_tx_bytes":         "Bytes received by the container, as counted by its host veth.",
+	"routed_endpoint_rx_packets":       "Packets sent by the container, as counted by its host veth.",
+	"routed_endpoint_tx_packets":       "Packets received by the container, as counted by its host veth.",
+	"routed_endpoint_rx_dropped":       "Packets sent by the container dropped by its host veth.",
+	"routed_endpoint_tx_dropped":       "Packets to the container dropped by its host veth.",
+	"routed_endpoint_rx_errors":        "Receive errors of the host veth of the container.",
+	"routed_endpoint_tx_errors":        "Transmit errors of the host veth of the container.",
+}
+
+type histogram struct {
+	// Observations up to each bound of latencyBuckets, not cumulated
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Metrics holds the counters and histograms of the plugin, and serves them
+// along with the gauges read from the drivers at scrape time in the
+// Prometheus text format. A nil Metrics records nothing.
+type Metrics struct {
+	counters   map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+	collectors []func(s *scrape)
+	m          sync.Mutex
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		counters:   make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+	}
+}
+
+// metricLabels formats name and value pairs as the labels of a sample.
+func metricLabels(pairs ...string) string {
+	var labels []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, pairs[i], value))
+	}
+	return strings.Join(labels, ",")
+}
+
+func (m *Metrics) add(name string, labels string, value float64) {
+	if m == nil {
+		return
+	}
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	series, ok := m.counters[name]
+	if !ok {
+		series = make(map[string]float64)
+		m.counters[name] = series
+	}
+	series[labels] += value
+}
+
+func (m *Metrics) observe(name string, labels string, seconds float64) {
+	if m == nil {
+		return
+	}
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	series, ok := m.histograms[name]
+	if !ok {
+		series = make(map[string]*histogram)
+		m.histograms[name] = series
+	}
+	h, ok := series[labels]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		series[labels] = h
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// observeCall records a call made by Docker, started at start, and whether
+// it failed. Meant to be deferred with the address of the returned error.
+func (m *Metrics) observeCall(call string, start time.Time, err *error) {
+	labels := metricLabels("call", call)
+	m.add("routed_calls_total", labels, 1)
+	if *err != nil {
+		m.add("routed_call_errors_total", labels, 1)
+	}
+	m.observe("routed_call_duration_seconds", labels, time.Since(start).Seconds())
+}
+
+func (m *Metrics) stepFailed(transaction string, step string) {
+	m.add("routed_step_failures_total", metricLabels("transaction", transaction, "step", step), 1)
+}
+
+// collect registers a function adding the current value of gauges to each
+// scrape.
+func (m *Metrics) collect(fn func(s *scrape)) {
+	if m == nil {
+		return
+	}
+	m.m.Lock()
+	defer m.m.Unlock()
+	m.collectors = append(m.collectors, fn)
+}
+
+type sample struct {
+	name   string
+	labels string
+	value  float64
+}
+
+type family struct {
+	kind    string
+	samples []sample
+}
+
+// scrape gathers the samples of the metrics, by family.
+type scrape struct {
+	families map[string]*family
+}
+
+func (s *scrape) add(name string, kind string, sampleName string, labels string, value float64) {
+	f, ok := s.families[name]
+	if !ok {
+		f = &family{kind: kind}
+		s.families[name] = f
+	}
+	f.samples = append(f.samples, sample{name: sampleName, labels: labels, value: value})
+}
+
+func (s *scrape) gauge(name string, labels string, value float64) {
+	s.add(name, gaugeMetric, name, labels, value)
+}
+
+func (s *scrape) counter(name string, labels string, value float64) {
+	s.add(name, counterMetric, name, labels, value)
+}
+
+func sortedLabels(series map[string]float64) []string {
+	var labels []string
+	for l := range series {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+func (m *Metrics) scrape() *scrape {
+	s := &scrape{families: make(map[string]*family)}
+
+	m.m.Lock()
+	for name, series := range m.counters {
+		for _, labels := range sortedLabels(series) {
+			s.counter(name, labels, series[labels])
+		}
+	}
+	for name, series := range m.histograms {
+		var labels []string
+		for l := range series {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+		for _, l := range labels {
+			h := series[l]
+			sep := ""
+			if l != "" {
+				sep = ","
+			}
+			var cumulated uint64
+			for i, bound := range latencyBuckets {
+				cumulated += h.counts[i]
+				le := l + sep + metricLabels("le", strconv.FormatFloat(bound, 'g', -1, 64))
+				s.add(name, histogramMetric, name+"_bucket", le, float64(cumulated))
+			}
+			s.add(name, histogramMetric, name+"_bucket", l+sep+metricLabels("le", "+Inf"), float64(h.count))
+			s.add(name, histogramMetric, name+"_sum", l, h.sum)
+			s.add(name, histogramMetric, name+"_count", l, float64(h.count))
+		}
+	}
+	collectors := m.collectors
+	m.m.Unlock()
+
+	// Collectors take the locks of the drivers
+	for _, fn := range collectors {
+		fn(s)
+	}
+	return s
+}
+
+func (m *Metrics) writeText(w io.Writer) error {
+	s := m.scrape()
+
+	var names []string
+	for name := range s.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	b := bufio.NewWriter(w)
+	for _, name := range names {
+		f := s.families[name]
+		if help, ok := metricHelp[name]; ok {
+			fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+		}
+		fmt.Fprintf(b, "# TYPE %s %s\n", name, f.kind)
+		for _, smp := range f.samples {
+			value := strconv.FormatFloat(smp.value, 'g', -1, 64)
+			if smp.labels == "" {
+				fmt.Fprintf(b, "%s %s\n", smp.name, value)
+			} else {
+				fmt.Fprintf(b, "%s{%s} %s\n", smp.name, smp.labels, value)
+			}
+		}
+	}
+	return b.Flush()
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := m.writeText(w); err != nil {
+		log.Warnf("Metrics: Couldn't write metrics: %v", err)
+	}
+}
+
+// ServeMetrics serves the metrics on /metrics to the connections accepted by
+// l, bound to a host:port.
+func ServeMetrics(m *Metrics, l net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	log.Infof("ServeMetrics: Serving metrics on %s", l.Addr())
+	return http.Serve(l, mux)
+}
+
+// timedFirewall records the time taken by the calls to a Firewall.
+type timedFirewall struct {
+	Firewall
+	metrics *Metrics
+}
+
+func (f timedFirewall) Raw(args ...string) ([]byte, error) {
+	start := time.Now()
+	output, err := f.Firewall.Raw(args...)
+	f.metrics.observe("routed_iptables_duration_seconds", "", time.Since(start).Seconds())
+	return output, err
+}
@@ -0,0 +1,106 @@
+package routed
+
+import (
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+
+	ipamApi "github.com/docker/go-plugins-helpers/ipam"
+	netApi "github.com/docker/go-plugins-helpers/network"
+	"github.com/vishvananda/netlink"
+)
+
+func TestMetricsText(t *testing.T) {
+	m := NewMetrics()
+	m.add("routed_calls_total", metricLabels("call", "Join"), 2)
+	m.observe("routed_call_duration_seconds", metricLabels("call", "Join"), 0.02)
+	m.observe("routed_call_duration_seconds", metricLabels("call", "Join"), 20)
+	m.collect(func(s *scrape) {
+		s.gauge("routed_network_endpoints", metricLabels("network", `a"b`), 3)
+	})
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, nil)
+	for _, line := range []string{
+		"# TYPE routed_call_duration_seconds histogram",
+		`routed_call_duration_seconds_bucket{call="Join",le="0.01"} 0`,
+		`routed_call_duration_seconds_bucket{call="Join",le="0.025"} 1`,
+		`routed_call_duration_seconds_bucket{call="Join",le="10"} 1`,
+		`routed_call_duration_seconds_bucket{call="Join",le="+Inf"} 2`,
+		`routed_call_duration_seconds_sum{call="Join"} 20.02`,
+		`routed_call_duration_seconds_count{call="Join"} 2`,
+		"# TYPE routed_calls_total counter",
+		`routed_calls_total{call="Join"} 2`,
+		`routed_network_endpoints{network="a\"b"} 3`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Fatalf("TestMetricsText failed: no %q in\n%s", line, w.Body.String())
+		}
+	}
+
+	// Drivers without metrics record nothing
+	var none *Metrics
+	none.add("routed_calls_total", "", 1)
+	none.stepFailed("Join", "add route")
+}
+
+func TestDriverMetrics(t *testing.T) {
+	netID := "c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c"
+	eID := "4b50fb7f12adb0da3e6662148e9b1bc43b507ad2fd8a0f187ff297cbc88aee05"
+	failedID := "9b50fb7f12adb0da3e6662148e9b1bc43b507ad2fd8a0f187ff297cbc88aee05"
+	m := NewMetrics()
+
+	id, _ := newIpamDriver(newFakeNetlink(), "0.1", "10.100.0.1", "")
+	id.SetConflictMode(ConflictOff)
+	id.SetMetrics(m)
+	ipam := InstrumentIpamDriver(id)
+	ipam.RequestAddress(&ipamApi.RequestAddressRequest{PoolID: "routed", Address: "10.1.0.2"})
+	ipam.RequestAddress(&ipamApi.RequestAddressRequest{PoolID: "routed", Address: "10.1.0.2"})
+
+	nl := newFakeNetlink()
+	nd, _ := newNetDriver(nl, newFakeIptables(), newFakeSysctls(), newFakeTc(), "0.1", "10.100.0.1", 1500, "")
+	nd.SetMetrics(m)
+	driver := InstrumentNetDriver(nd)
+	driver.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: netID})
+	driver.CreateEndpoint(&netApi.CreateEndpointRequest{
+		NetworkID:  netID,
+		EndpointID: eID,
+		Interface:  &netApi.EndpointInterface{Address: "10.1.0.2/32"},
+		Options:    map[string]interface{}{"routed.dscp": "ef"},
+	})
+	driver.CreateEndpoint(&netApi.CreateEndpointRequest{
+		NetworkID:  netID,
+		EndpointID: failedID,
+		Interface:  &netApi.EndpointInterface{Address: "10.1.0.3/32"},
+	})
+	if _, err := driver.Join(&netApi.JoinRequest{NetworkID: netID, EndpointID: eID}); err != nil {
+		t.Fatalf("TestDriverMetrics failed: Join %v", err)
+	}
+	link, _ := nl.LinkByName(nd.networks[netID].endpoints[eID].hostInterfaceName)
+	link.Attrs().Statistics = &netlink.LinkStatistics{RxBytes: 100}
+	nl.failWith("RouteAdd", syscall.EPERM)
+	driver.Join(&netApi.JoinRequest{NetworkID: netID, EndpointID: failedID})
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, nil)
+	for _, line := range []string{
+		`routed_calls_total{call="RequestAddress"} 2`,
+		`routed_call_errors_total{call="RequestAddress"} 1`,
+		`routed_pool_allocated_addresses{pool="routed",subnet="10.46.0.0/16"} 2`,
+		`routed_pool_addresses{pool="routed",subnet="10.46.0.0/16"} 65536`,
+		`routed_calls_total{call="Join"} 2`,
+		`routed_call_errors_total{call="Join"} 1`,
+		`routed_call_duration_seconds_count{call="Join"} 2`,
+		`routed_step_failures_total{transaction="Join",step="add route"} 1`,
+		`routed_iptables_duration_seconds_count 2`,
+		`routed_network_endpoints{network="` + netID + `"} 2`,
+		`routed_network_joined_endpoints{network="` + netID + `"} 1`,
+		`routed_reconcile_drift_total{kind="route-missing"} 0`,
+		`routed_endpoint_rx_bytes{endpoint="` + eID + `",address="10.1.0.2",iface="` + link.Attrs().Name + `"} 100`,
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Fatalf("TestDriverMetrics failed: no %q in\n%s", line, w.Body.String())
+		}
+	}
+}
@@ -3,12 +3,13 @@ package routed
 import (
 	"fmt"
 	"net"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	netApi "github.com/docker/go-plugins-helpers/network"
-	"github.com/docker/libnetwork/netlabel"
 	"github.com/docker/libnetwork/netutils"
 	"github.com/docker/libnetwork/types"
 	"github.com/vishvananda/netlink"
@@ -19,12 +20,20 @@ const (
 	vethPrefix     = "vethr"
 	ethPrefix      = "eth"
 	defaultGwIface = "eth0"
+	// Length of the generated interface names
+	ifaceNameLen = 12
 )
 
 type routedNetwork struct {
-	id        string
-	endpoints map[string]*routedEndpoint
-	m         sync.Mutex
+	id          string
+	gateway     string
+	gatewayMode string
+	mtu         int
+	vethPrefix  string
+	metric      int
+	dataplane   Dataplane
+	endpoints   map[string]*routedEndpoint
+	m           sync.Mutex
 }
 
 type routedEndpoint struct {
@@ -33,111 +42,354 @@ type routedEndpoint struct {
 	macAddress         net.HardwareAddr
 	ipv4Address        *net.IPNet
 	netFilter          *netFilter
+	defaultPolicy      bool
+	joined             bool
+	suppressed         bool
+	readiness          *readinessProbe
+	sandbox            *sandboxConfig
+	qos                *qosConfig
+	traffic            *EndpointStats
+	sandboxKey         string
+	correlationID      string
+	ready              bool
+	stopProbe          chan struct{}
+}
+
+// routable reports whether the host route of a joined endpoint should be
+// installed: it is neither dampened nor waiting for its readiness probe.
+func (ep *routedEndpoint) routable() bool {
+	return !ep.suppressed && (ep.readiness == nil || ep.ready)
+}
+
+// routeState describes whether the host route of an endpoint is installed,
+// or why it is not.
+func (ep *routedEndpoint) routeState() string {
+	switch {
+	case !ep.joined:
+		return "detached"
+	case ep.suppressed:
+		return "dampened"
+	case !ep.routable():
+		return "waiting for readiness"
+	}
+	return "announced"
 }
 
 type NetDriver struct {
 	netApi.Driver
-	version string
-	gateway string
-	mtu     int
-	network *routedNetwork
+	nl          Netlink
+	fw          Firewall
+	sysctl      Sysctls
+	tc          TrafficControl
+	version     string
+	gateway     string
+	gatewayMode string
+	mtu         int
+	aggregate   *hostAggregate
+	guard       *routeGuard
+	profiles    *networkProfiles
+	policy      *defaultPolicy
+	drift       driftCounters
+	drainMode   string
+	drainGrace  time.Duration
+	dampening   *dampening
+	// networks are added and removed by CreateNetwork and DeleteNetwork
+	// while the other calls and the background loops run, see getNetwork
+	networks map[string]*routedNetwork
+	networkM sync.Mutex
+	metrics  *Metrics
+	startup  *actionLog
+}
+
+func NewNetDriver(version string, gateway string, mtu int, aggregate string) (*NetDriver, error) {
+	return newNetDriver(hostNetlink{}, hostIptables{}, hostSysctls{}, hostTc{}, version, gateway, mtu, aggregate)
 }
 
-func NewNetDriver(version string, gateway string, mtu int) (*NetDriver, error) {
+// newNetDriver creates a driver changing the host network state through nl,
+// fw, sc and tc.
+func newNetDriver(nl Netlink, fw Firewall, sc Sysctls, tc TrafficControl, version string, gateway string, mtu int, aggregate string) (*NetDriver, error) {
 	log.Debugf("NewNetDriver: Initializing routed driver version %+v", version)
 
-	links, err := netlink.LinkList()
+	agg, err := parseAggregate(aggregate)
+	if err != nil {
+		return nil, err
+	}
+
+	startup := &actionLog{}
+	links, err := nl.LinkList()
 	if err != nil {
 		log.Errorf("NewNetDriver: Can't get list of net devices: %s", err)
 		return nil, err
 	}
 	// clean up old interfaces
-	for _, lnk := range links {
-		if strings.HasPrefix(lnk.Attrs().Name, vethPrefix) {
-			if err := netlink.LinkDel(lnk); err != nil {
-				log.Errorf("NewNetDriver: veth couldn't be deleted: %s", lnk.Attrs().Name)
-			} else {
-				log.Infof("NewNetDriver: veth cleaned up: %s", lnk.Attrs().Name)
-			}
+	removeStaleLinks(nl, links, startup, func(link netlink.Link) bool {
+		name := link.Attrs().Name
+		return strings.HasPrefix(name, vethPrefix) || strings.HasPrefix(name, ipvlanPrefix)
+	})
+
+	if agg != nil {
+		if err := agg.install(nl); err != nil {
+			log.Errorf("NewNetDriver: %v", err)
+			return nil, err
 		}
+		startup.record("Announced aggregate %s", agg)
 	}
 
 	d := &NetDriver{
-		version: version,
-		mtu:     mtu,
-		gateway: gateway,
+		nl:          nl,
+		fw:          fw,
+		sysctl:      sc,
+		tc:          tc,
+		version:     version,
+		mtu:         mtu,
+		gateway:     gateway,
+		gatewayMode: GatewayProxyArp,
+		aggregate:   agg,
+		guard:       &routeGuard{},
+		profiles:    &networkProfiles{},
+		policy:      &defaultPolicy{},
+		drainMode:   DrainNone,
+		networks:    make(map[string]*routedNetwork),
+		startup:     startup,
 	}
 
 	return d, nil
 }
 
+// SetRouteGuard sets the comma separated lists of prefixes container
+// addresses must be in, and must not overlap, to be routed from this host.
+// An empty allowed list allows any address.
+func (d *NetDriver) SetRouteGuard(allowed string, denied string) error {
+	return d.guard.update(allowed, denied)
+}
+
+// SetGatewayMode sets how containers reach their gateway by default: through
+// proxy_arp on the host, or a link-local gateway address on each host veth.
+func (d *NetDriver) SetGatewayMode(mode string) error {
+	if err := checkGatewayMode(mode, d.gateway); err != nil {
+		return err
+	}
+	d.gatewayMode = mode
+	return nil
+}
+
 func (d *NetDriver) GetCapabilities() (*netApi.CapabilitiesResponse, error) {
 	res := &netApi.CapabilitiesResponse{Scope: netApi.LocalScope}
 	log.Debugf("GetCapabilities: responded with %+v", res)
 	return res, nil
 }
 
+// removeStaleLinks deletes the links left by a previous run, the ones of
+// links selected by match, and records it in startup.
+func removeStaleLinks(nl Netlink, links []netlink.Link, startup *actionLog, match func(link netlink.Link) bool) {
+	for _, lnk := range links {
+		if !match(lnk) {
+			continue
+		}
+		if err := nl.LinkDel(lnk); err != nil {
+			log.Errorf("removeStaleLinks: veth couldn't be deleted: %s", lnk.Attrs().Name)
+		} else {
+			log.Infof("removeStaleLinks: veth cleaned up: %s", lnk.Attrs().Name)
+			startup.record("Removed stale interface %s", lnk.Attrs().Name)
+		}
+	}
+}
+
+// ipamGateway returns the gateway address the IPAM driver gave a network,
+// empty when there is none.
+func ipamGateway(data []*netApi.IPAMData) string {
+	if len(data) == 0 || data[0] == nil || data[0].Gateway == "" {
+		return ""
+	}
+	if ip, _, err := net.ParseCIDR(data[0].Gateway); err == nil {
+		return ip.String()
+	}
+	return data[0].Gateway
+}
+
 func (d *NetDriver) CreateNetwork(r *netApi.CreateNetworkRequest) error {
-	log.Debugf("CreateNetwork: request %+v", r)
-	d.network = &routedNetwork{id: r.NetworkID, endpoints: make(map[string]*routedEndpoint)}
-	log.Infof("CreateNetwork: NetworkID %s", r.NetworkID)
+	cl := newCallLog("CreateNetwork").with(fieldNetwork, r.NetworkID)
+	cl.Debugf("CreateNetwork: request %+v", r)
+
+	// A gateway given to the IPAM driver with --ipam-opt routed.gateway
+	// needn't be given to the network again
+	labels := routedLabels(r.Options)
+	if gw := ipamGateway(r.IPv4Data); gw != "" && gw != d.gateway {
+		if _, ok := labels[gatewayLabel]; !ok {
+			labels[gatewayLabel] = gw
+		}
+	}
+
+	network, err := d.newRoutedNetwork(r.NetworkID, labels)
+	if err != nil {
+		cl.Errorf("CreateNetwork: %v", err)
+		return err
+	}
+
+	shared, err := d.addNetwork(network)
+	if err != nil {
+		cl.Errorf("CreateNetwork: %v", err)
+		return err
+	}
+
+	// Veths with the default prefixes are cleaned up at startup, those of a
+	// network prefix once it is known, unless another network uses them
+	if network.vethPrefix != vethPrefix && !shared {
+		if links, err := d.nl.LinkList(); err != nil {
+			cl.Warnf("CreateNetwork: Can't get list of net devices: %v", err)
+		} else {
+			removeStaleLinks(d.nl, links, d.startup, func(link netlink.Link) bool {
+				return isNetworkVeth(link, network.vethPrefix)
+			})
+		}
+	}
+
+	cl.Infof("CreateNetwork: gateway %s, mtu %d, metric %d", network.gateway, network.mtu, network.metric)
 	return nil
 }
 
 func (d *NetDriver) DeleteNetwork(r *netApi.DeleteNetworkRequest) error {
-	log.Debugf("DeleteNetwork: request %+v", r)
-	d.network = nil
-	log.Infof("DeleteNetwork: NetworkID %s", r.NetworkID)
+	cl := newCallLog("DeleteNetwork").with(fieldNetwork, r.NetworkID)
+	cl.Debugf("DeleteNetwork: request %+v", r)
+	network, err := d.removeNetwork(r.NetworkID)
+	if err != nil {
+		cl.Errorf("DeleteNetwork: %v", err)
+		return err
+	}
+	if err := network.dataplane.Release(); err != nil {
+		cl.Warnf("DeleteNetwork: Couldn't release dataplane links: %v", err)
+	}
+	cl.Infof("DeleteNetwork: deleted network")
 	return nil
 }
 
 func (d *NetDriver) CreateEndpoint(r *netApi.CreateEndpointRequest) (*netApi.CreateEndpointResponse, error) {
-	log.Debugf("CreateEndpoint: request %+v", r)
+	cl := newCallLog("CreateEndpoint").with(fieldNetwork, r.NetworkID).with(fieldEndpoint, r.EndpointID)
+	cl.Debugf("CreateEndpoint: request %+v", r)
 
 	eid := r.EndpointID
 	ifInfo := r.Interface
 
-	network := d.network
+	network, err := d.getNetwork(r.NetworkID)
+	if err != nil {
+		cl.Errorf("CreateEndpoint: %v", err)
+		return nil, err
+	}
 	network.m.Lock()
 	defer network.m.Unlock()
 
-	log.Debugf("CreateEndpoint: Requested Interface %+v", ifInfo)
-	addr, _ := netlink.ParseIPNet(ifInfo.Address)
+	cl.Debugf("CreateEndpoint: Requested Interface %+v", ifInfo)
+	addr, err := netlink.ParseIPNet(ifInfo.Address)
+	if err != nil {
+		cl.Errorf("CreateEndpoint: Invalid address %s: %v", ifInfo.Address, err)
+		return nil, fmt.Errorf("Invalid endpoint address %s: %v", ifInfo.Address, err)
+	}
+
+	// Ties the endpoint to the RequestAddress of its address
+	correlationID := addressCorrelations.get(addr.IP.String())
+	cl.with(fieldAddress, addr.IP.String()).with(fieldCorrelation, correlationID)
+
+	labels := routedLabels(r.Options)
+	readiness, err := parseReadinessProbe(labels)
+	if err != nil {
+		cl.Errorf("CreateEndpoint: %v", err)
+		return nil, err
+	}
+
+	sandbox, err := parseSandboxConfig(labels)
+	if err != nil {
+		cl.Errorf("CreateEndpoint: %v", err)
+		return nil, err
+	}
+	// The container link is found in the sandbox by its MAC
+	if sandbox != nil && !network.dataplane.SetsMac() {
+		return nil, fmt.Errorf("Container namespace settings need the %s dataplane", vethDataplane)
+	}
+
+	qos, err := parseQos(labels)
+	if err != nil {
+		cl.Errorf("CreateEndpoint: %v", err)
+		return nil, err
+	}
+	if qos != nil && network.dataplane.SharesHostLink() {
+		return nil, fmt.Errorf("Traffic limits need the %s dataplane", vethDataplane)
+	}
+
 	ep := &routedEndpoint{
-		ipv4Address: addr,
+		ipv4Address:   addr,
+		readiness:     readiness,
+		sandbox:       sandbox,
+		qos:           qos,
+		correlationID: correlationID,
+	}
+
+	// Elect the MAC now so Docker knows the one Join will set. Docker
+	// refuses a MAC in the response when the request already had one.
+	var res *netApi.CreateEndpointResponse
+	if network.dataplane.SetsMac() {
+		var imac net.HardwareAddr
+		if ifInfo.MacAddress != "" {
+			if imac, err = net.ParseMAC(ifInfo.MacAddress); err != nil {
+				cl.Errorf("CreateEndpoint: Invalid MAC address %s: %v", ifInfo.MacAddress, err)
+				return nil, fmt.Errorf("Invalid endpoint MAC address %s: %v", ifInfo.MacAddress, err)
+			}
+		}
+		ep.macAddress = electMacAddress(imac, addr.IP)
+		if imac == nil {
+			res = &netApi.CreateEndpointResponse{
+				Interface: &netApi.EndpointInterface{MacAddress: ep.macAddress.String()},
+			}
+		}
 	}
-	d.network.endpoints[eid] = ep
-	log.Infof("CreateEndpoint: created endpoint %s", eid)
 
-	return nil, nil
+	network.endpoints[eid] = ep
+	cl.Infof("CreateEndpoint: created endpoint")
+
+	return res, nil
 }
 
 func (d *NetDriver) DeleteEndpoint(r *netApi.DeleteEndpointRequest) error {
-	log.Debugf("DeleteEndpoint: request %+v", r)
-
 	eid := r.EndpointID
-	network := d.network
-	ep := network.endpoints[eid]
+	network, err := d.getNetwork(r.NetworkID)
+	if err != nil {
+		return err
+	}
 
 	network.m.Lock()
 	defer network.m.Unlock()
 
+	ep := network.endpoints[eid]
+	cl := newCallLog("DeleteEndpoint").with(fieldNetwork, r.NetworkID).withEndpoint(eid, ep)
+	cl.Debugf("DeleteEndpoint: request %+v", r)
+	if ep == nil {
+		cl.Warnf("DeleteEndpoint: unknown endpoint")
+		return nil
+	}
+
 	delete(network.endpoints, eid)
-	log.Infof("DeleteEndpoint: deleted endpoint %s", eid)
+	cl.Infof("DeleteEndpoint: deleted endpoint")
+
+	ep.stopProbing()
+	if ep.hostInterfaceName != "" && ep.routable() {
+		d.dampening.withdrawn(ep.ipv4Address.String())
+	}
+
+	// The qdiscs go away with the veth, but not the marking rule
+	if ep.hostInterfaceName != "" {
+		if err := removeQos(d.tc, d.fw, ep.hostInterfaceName, ep.qos); err != nil {
+			cl.Warnf("DeleteEndpoint: Couldn't remove traffic limits: %v", err)
+		}
+	}
 
-	// Try removal of link. Discard error: link pair might have
-	// already been deleted by sandbox delete.
-	link, err := netlink.LinkByName(ep.hostInterfaceName)
-	if err == nil {
-		log.Debugf("DeleteEndpoint: Deleting host interface %s", ep.hostInterfaceName)
-		netlink.LinkDel(link)
-	} else {
-		log.Debugf("DeleteEndpoint: Can't find host interface: %s, %v ", ep.hostInterfaceName, err)
+	// Try removal of links, they might have already been deleted by
+	// sandbox delete.
+	if err := network.dataplane.DeleteLinks(ep.hostInterfaceName, ep.containerIfaceName); err != nil {
+		cl.Warnf("DeleteEndpoint: Couldn't delete interfaces: %v", err)
 	}
 
 	if ep.netFilter != nil {
 		if err := ep.netFilter.removeFiltering(); err != nil {
-			log.Warnf("DeleteEndpoint: Couldn't remove net filter rules for iface %s, %v", ep.hostInterfaceName, err)
+			cl.Warnf("DeleteEndpoint: Couldn't remove net filter rules: %v", err)
 		}
 	}
 
@@ -145,137 +397,234 @@ func (d *NetDriver) DeleteEndpoint(r *netApi.DeleteEndpointRequest) error {
 }
 
 func (d *NetDriver) EndpointInfo(r *netApi.InfoRequest) (*netApi.InfoResponse, error) {
-	log.Debugf("EndpointInfo: reuqest %+v:", r)
-	res := &netApi.InfoResponse{Value: map[string]string{}}
+	network, err := d.getNetwork(r.NetworkID)
+	if err != nil {
+		return nil, err
+	}
+	network.m.Lock()
+	defer network.m.Unlock()
+
+	ep, ok := network.endpoints[r.EndpointID]
+	cl := newCallLog("EndpointInfo").with(fieldNetwork, r.NetworkID).withEndpoint(r.EndpointID, ep)
+	cl.Debugf("EndpointInfo: request %+v", r)
+	if !ok {
+		return nil, fmt.Errorf("Endpoint %s not found", r.EndpointID)
+	}
+
+	value := map[string]string{
+		"ipv4Address": ep.ipv4Address.String(),
+		"routeState":  ep.routeState(),
+		"filtering":   ep.netFilter.String(),
+	}
+	if ep.macAddress != nil {
+		value["macAddress"] = ep.macAddress.String()
+	}
+	if ep.readiness != nil {
+		value["readiness"] = ep.readiness.String()
+	}
+	if ep.hostInterfaceName != "" {
+		value["hostInterface"] = ep.hostInterfaceName
+		value["containerInterface"] = ep.containerIfaceName
+	}
+	if stats := network.readStats(r.EndpointID, ep); stats != nil {
+		stats.info(value)
+	}
+
+	res := &netApi.InfoResponse{Value: value}
 	return res, nil
 }
 
 func (d *NetDriver) Join(r *netApi.JoinRequest) (*netApi.JoinResponse, error) {
-	log.Debugf("Join: request %+v", r)
-
 	eid := r.EndpointID
-	network := d.network
 	options := r.Options
-
-	network.m.Lock()
-	defer network.m.Unlock()
-
-	ep := d.network.endpoints[eid]
-
-	// Generate host-side veth name
-	hostIfaceName, err := generateIfaceName(vethPrefix + string(eid)[:4])
+	network, err := d.getNetwork(r.NetworkID)
 	if err != nil {
 		return nil, err
 	}
 
-	// Generate container-side veth name
-	containerIfaceName, err := generateIfaceName(vethPrefix + string(eid)[:4])
-	if err != nil {
-		return nil, err
-	}
+	network.m.Lock()
+	defer network.m.Unlock()
 
-	veth := &netlink.Veth{
-		LinkAttrs: netlink.LinkAttrs{
-			Name:   hostIfaceName,
-			TxQLen: 0,
-		},
-		PeerName: containerIfaceName,
+	ep := network.endpoints[eid]
+	cl := newCallLog("Join").with(fieldNetwork, r.NetworkID).withEndpoint(eid, ep)
+	cl.Debugf("Join: request %+v", r)
+	if ep == nil {
+		cl.Errorf("Join: unknown endpoint")
+		return nil, fmt.Errorf("Endpoint %s not found", eid)
 	}
 
-	// create veth
-	log.Debugf("Join: Adding link %+v", veth)
-	if err := netlink.LinkAdd(veth); err != nil {
-		log.Errorf("Join: Unable to add link %+v:%+v", veth, err)
+	if err := d.guard.check(d.nl, ep.ipv4Address, network.gateway); err != nil {
+		cl.Errorf("Join: %v", err)
 		return nil, err
 	}
 
-	hostIface, _ := netlink.LinkByName(hostIfaceName)
-	if err != nil {
-		log.Errorf("Join: Can't find host interface %s", hostIfaceName)
-		return nil, err
-	}
-	defer func() {
+	var hostIface, containerIface netlink.Link
+	var hostIfaceName, containerIfaceName string
+	tx := newTransaction("Join", d.metrics, cl)
+
+	err = tx.run("create links", func() error {
+		var err error
+		hostIface, containerIface, err = network.dataplane.CreateLinks(eid)
 		if err != nil {
-			log.Infof("Join: Deleting host interface %s", hostIfaceName)
-			netlink.LinkDel(hostIface)
+			return err
 		}
-	}()
-
-	containerIface, _ := netlink.LinkByName(containerIfaceName)
+		hostIfaceName = hostIface.Attrs().Name
+		containerIfaceName = containerIface.Attrs().Name
+		ep.hostInterfaceName = hostIfaceName
+		ep.containerIfaceName = containerIfaceName
+		cl.with(fieldHostIface, hostIfaceName)
+		return nil
+	}, func() error {
+		ep.hostInterfaceName = ""
+		ep.containerIfaceName = ""
+		cl.at("create links").Infof("Join: Deleting interfaces %s %s", hostIfaceName, containerIfaceName)
+		return network.dataplane.DeleteLinks(hostIfaceName, containerIfaceName)
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		if err != nil {
-			log.Infof("Join: Deleting container interface %s", containerIfaceName)
-			netlink.LinkDel(containerIface)
-		}
-	}()
-
-	if d.mtu != 0 {
-		log.Debugf("Join: Setting mtu %+v on %+v", d.mtu, veth)
 
-		if err := netlink.LinkSetMTU(hostIface, d.mtu); err != nil {
-			log.Errorf("Join: Error setting the MTU %s", err)
+	// The settings of the links go away with them, they need no undo. A
+	// host link shared by the endpoints keeps the settings of the host.
+	if !network.dataplane.SharesHostLink() {
+		err = tx.run("set sysctls", func() error {
+			return applySysctls(d.sysctl, vethSysctlProfile(hostIfaceName, network.gatewayMode))
+		}, nil)
+		if err != nil {
 			return nil, err
 		}
+	}
 
-		if err := netlink.LinkSetMTU(containerIface, d.mtu); err != nil {
-			log.Errorf("Join: Error setting the MTU %s", err)
+	if network.mtu != 0 {
+		err = tx.run("set MTU", func() error {
+			cl.at("set MTU").Debugf("Join: Setting mtu %d on %s", network.mtu, containerIfaceName)
+			if err := d.nl.LinkSetMTU(hostIface, network.mtu); err != nil {
+				return err
+			}
+			return d.nl.LinkSetMTU(containerIface, network.mtu)
+		}, nil)
+		if err != nil {
 			return nil, err
 		}
 	}
 
-	// Down the interface before configuring mac address.
-	if err := netlink.LinkSetDown(containerIface); err != nil {
-		log.Errorf("Join: could not set link down for container interface %s, %v", containerIfaceName, err)
-		return nil, err
-	}
+	// Set the sbox's MAC elected in CreateEndpoint
+	if network.dataplane.SetsMac() {
+		err = tx.run("set MAC", func() error {
+			// Down the interface before configuring mac address.
+			if err := d.nl.LinkSetDown(containerIface); err != nil {
+				return fmt.Errorf("could not set link down for container interface %s, %v", containerIfaceName, err)
+			}
 
-	var imac net.HardwareAddr
-	if opt, ok := options[netlabel.MacAddress]; ok {
-		if mac, ok := opt.(net.HardwareAddr); ok {
-			log.Debugf("Join: Using Mac Address %s", mac)
-			imac = mac
+			mac := ep.macAddress
+			if err := d.nl.LinkSetHardwareAddr(containerIface, mac); err != nil {
+				return fmt.Errorf("could not set mac address %s for container interface %s, %v", mac, containerIfaceName, err)
+			}
+			return nil
+		}, nil)
+		if err != nil {
+			return nil, err
 		}
 	}
-	// Set the sbox's MAC. If specified, use the one configured by user, otherwise generate one based on IP.
-	mac := electMacAddress(imac, ep.ipv4Address.IP)
 
-	err = netlink.LinkSetHardwareAddr(containerIface, mac)
+	// Up the host interface after finishing all netlink configuration
+	err = tx.run("set link up", func() error {
+		cl.at("set link up").Debugf("Join: Bringing links up %s %s", hostIfaceName, containerIfaceName)
+		if err := d.nl.LinkSetUp(hostIface); err != nil {
+			return fmt.Errorf("could not set link up for host interface %s, %v", hostIfaceName, err)
+		}
+		if err := d.nl.LinkSetUp(containerIface); err != nil {
+			return fmt.Errorf("could not set link up for container interface %s, %v", containerIfaceName, err)
+		}
+		return nil
+	}, nil)
 	if err != nil {
-		log.Errorf("Join: could not set mac address %s for container interface %s, %v", mac, containerIfaceName, err)
 		return nil, err
 	}
 
-	log.Debugf("Join: Bringing link up %+v", veth)
-	// Up the host interface after finishing all netlink configuration
-	if err := netlink.LinkSetUp(hostIface); err != nil {
-		log.Errorf("Join: could not set link up for host interface %s, %v", hostIfaceName, err)
+	err = tx.run("apply traffic limits", func() error {
+		return applyQos(d.tc, d.fw, hostIfaceName, ep.qos)
+	}, func() error {
+		return removeQos(d.tc, d.fw, hostIfaceName, ep.qos)
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	if err := netlink.LinkSetUp(containerIface); err != nil {
-		log.Errorf("Join: could not set link up for host interface %s, %v", containerIfaceName, err)
-		return nil, err
+	// Without proxy_arp the host veth answers for the gateway itself
+	if network.gatewayMode == GatewayLinkLocal {
+		err = tx.run("add gateway address", func() error {
+			gw, _ := netlink.ParseIPNet(network.gateway + "/32")
+			return d.nl.AddrAdd(hostIface, &netlink.Addr{IPNet: gw, Scope: int(netlink.SCOPE_LINK)})
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// Configure routes
-	routeAdd(ep.ipv4Address, hostIface)
+	ep.sandboxKey = r.SandboxKey
+	ep.ready = false
+
+	// Configure routes, unless the address flaps too often or the endpoint
+	// has to pass its readiness probe first
+	routeAdded, probeRouteAdded := false, false
+	err = tx.run("add route", func() error {
+		if wait := d.dampening.announce(ep.ipv4Address.String()); wait > 0 {
+			cl.at("add route").Warnf("Join: route to %s is dampened, holding it back for %s", ep.ipv4Address, wait)
+			ep.suppressed = true
+			d.scheduleAnnounce(network.id, eid, wait)
+		}
+		if ep.readiness != nil {
+			cl.at("add route").Infof("Join: route to %s waits for readiness probe %s", ep.ipv4Address, ep.readiness)
+			if err := d.nl.RouteAdd(d.probeRoute(network, ep.ipv4Address, hostIface)); err != nil {
+				return fmt.Errorf("Unable to add probe route to %s: %v", ep.ipv4Address, err)
+			}
+			probeRouteAdded = true
+			ep.stopProbe = make(chan struct{})
+			go d.probe(network.id, eid, ep, ep.stopProbe)
+			return nil
+		}
+		if !ep.routable() {
+			return nil
+		}
+		if err := d.routeAdd(d.hostRoute(network, ep.ipv4Address, hostIface)); err != nil {
+			return err
+		}
+		routeAdded = true
+		return nil
+	}, func() error {
+		// The endpoint is not joined yet, a pending announce or probe
+		// result leaves it alone
+		ep.stopProbing()
+		ep.suppressed = false
+		if probeRouteAdded {
+			if err := d.nl.RouteDel(d.probeRoute(network, ep.ipv4Address, hostIface)); err != nil {
+				return err
+			}
+		}
+		if !routeAdded {
+			return nil
+		}
+		return d.nl.RouteDel(d.hostRoute(network, ep.ipv4Address, hostIface))
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	//for _, ipa := range ep.ipAliases {
 	//	routeAdd(ipa, iface)
 	//}
 
-	ep.hostInterfaceName = hostIfaceName
-	ep.containerIfaceName = containerIfaceName
-
 	// Configure firewall rules
-	ep.netFilter = NewNetFilter(hostIfaceName, options)
-	if err := ep.netFilter.applyFiltering(); err != nil {
-		log.Errorf("Join: could not add net filtering %v", err)
+	filterName, filterMatch := network.dataplane.FilterTarget(ep)
+	netFilter := NewNetFilter(d.fw, filterName, filterMatch, options)
+	netFilter.config = d.policy.get()
+	err = tx.run("apply filtering", netFilter.applyFiltering, netFilter.removeFiltering)
+	if err != nil {
 		return nil, err
 	}
+	ep.netFilter = netFilter
+	ep.defaultPolicy = true
 
 	respIface := netApi.InterfaceName{
 		SrcName:   containerIfaceName,
@@ -283,7 +632,7 @@ func (d *NetDriver) Join(r *netApi.JoinRequest) (*netApi.JoinResponse, error) {
 	}
 
 	gwRoute := &netApi.StaticRoute{
-		Destination: fmt.Sprintf("%s/32", d.gateway),
+		Destination: fmt.Sprintf("%s/32", network.gateway),
 		RouteType:   types.CONNECTED,
 		NextHop:     "",
 	}
@@ -291,7 +640,7 @@ func (d *NetDriver) Join(r *netApi.JoinRequest) (*netApi.JoinResponse, error) {
 	defaultRoute := &netApi.StaticRoute{
 		Destination: "0.0.0.0/0",
 		RouteType:   types.NEXTHOP,
-		NextHop:     d.gateway,
+		NextHop:     network.gateway,
 	}
 
 	res := &netApi.JoinResponse{
@@ -300,16 +649,144 @@ func (d *NetDriver) Join(r *netApi.JoinRequest) (*netApi.JoinResponse, error) {
 		StaticRoutes:          []*netApi.StaticRoute{gwRoute, defaultRoute},
 	}
 
-	log.Infof("Join: response %+v", res)
+	ep.joined = true
+
+	// Configure the container namespace once Docker moved the link there
+	setup := &sandboxSetup{
+		sandboxKey: r.SandboxKey,
+		mac:        ep.macAddress,
+		ip:         ep.ipv4Address.IP,
+	}
+	if network.gatewayMode == GatewayLinkLocal || (ep.sandbox != nil && ep.sandbox.gatewayNeighbor) {
+		setup.neighs = []*netlink.Neigh{{
+			IP:           net.ParseIP(network.gateway),
+			HardwareAddr: hostIface.Attrs().HardwareAddr,
+			State:        netlink.NUD_PERMANENT,
+		}}
+	}
+	if ep.sandbox != nil {
+		setup.sysctls = ep.sandbox.sysctls
+		setup.gratuitousArp = ep.sandbox.gratuitousArp
+	}
+	if !setup.empty() {
+		go d.setupSandbox(eid, setup)
+	}
+
+	cl.Debugf("Join: response %+v", res)
+	cl.Infof("Join: joined endpoint, route %s", ep.routeState())
 
 	return res, nil
 }
 
 func (d *NetDriver) Leave(r *netApi.LeaveRequest) error {
-	log.Debugf("Leave: request %+v", r)
+	network, err := d.getNetwork(r.NetworkID)
+	if err != nil {
+		return err
+	}
+	network.m.Lock()
+
+	// The sandbox is going away with the container side of the veth, stop
+	// reconciling the endpoint.
+	ep, ok := network.endpoints[r.EndpointID]
+	cl := newCallLog("Leave").with(fieldNetwork, r.NetworkID).withEndpoint(r.EndpointID, ep)
+	cl.Debugf("Leave: request %+v", r)
+	if !ok || !ep.joined {
+		network.m.Unlock()
+		return nil
+	}
+	ep.joined = false
+	ep.stopProbing()
+
+	err = d.drainEndpoint(network, ep)
+	network.m.Unlock()
+
+	if err != nil {
+		cl.Warnf("Leave: Couldn't drain endpoint: %v", err)
+		return nil
+	}
+
+	// Keep the interface until traffic moved to other hosts, without
+	// blocking other requests.
+	d.waitDrain()
+	cl.Infof("Leave: left endpoint")
 	return nil
 }
 
+// getNetwork returns the network with the given ID. The calls and loops
+// working on a network look it up once and keep using what they got.
+func (d *NetDriver) getNetwork(id string) (*routedNetwork, error) {
+	d.networkM.Lock()
+	defer d.networkM.Unlock()
+	network, ok := d.networks[id]
+	if !ok {
+		return nil, fmt.Errorf("Network %s not found", id)
+	}
+	return network, nil
+}
+
+// allNetworks returns the networks of the driver, ordered by ID.
+func (d *NetDriver) allNetworks() []*routedNetwork {
+	d.networkM.Lock()
+	defer d.networkM.Unlock()
+	all := make([]*routedNetwork, 0, len(d.networks))
+	for _, network := range d.networks {
+		all = append(all, network)
+	}
+	sort.Sort(networksByID(all))
+	return all
+}
+
+// addNetwork adds a network to the driver, and reports whether another
+// network already names its veths with the same prefix.
+func (d *NetDriver) addNetwork(network *routedNetwork) (bool, error) {
+	d.networkM.Lock()
+	defer d.networkM.Unlock()
+	if _, ok := d.networks[network.id]; ok {
+		return false, fmt.Errorf("Network %s already exists", network.id)
+	}
+	shared := false
+	for _, other := range d.networks {
+		if other.vethPrefix == network.vethPrefix {
+			shared = true
+		}
+	}
+	d.networks[network.id] = network
+	return shared, nil
+}
+
+// removeNetwork removes the network with the given ID from the driver and
+// returns it.
+func (d *NetDriver) removeNetwork(id string) (*routedNetwork, error) {
+	d.networkM.Lock()
+	defer d.networkM.Unlock()
+	network, ok := d.networks[id]
+	if !ok {
+		return nil, fmt.Errorf("Network %s not found", id)
+	}
+	delete(d.networks, id)
+	return network, nil
+}
+
+// endpointNetwork returns the network having the endpoint eid, for the
+// calls only given the endpoint.
+func (d *NetDriver) endpointNetwork(eid string) (*routedNetwork, error) {
+	for _, network := range d.allNetworks() {
+		network.m.Lock()
+		_, ok := network.endpoints[eid]
+		network.m.Unlock()
+		if ok {
+			return network, nil
+		}
+	}
+	return nil, fmt.Errorf("Endpoint %s not found", eid)
+}
+
+type networksByID []*routedNetwork
+
+func (s networksByID) Len() int           { return len(s) }
+func (s networksByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s networksByID) Less(i, j int) bool { return s[i].id < s[j].id }
+
 func electMacAddress(mac net.HardwareAddr, ip net.IP) net.HardwareAddr {
 	if mac != nil {
 		return mac
@@ -329,14 +806,26 @@ func generateMacAddr(ip net.IP) net.HardwareAddr {
 	return hw
 }
 
-func routeAdd(ip *net.IPNet, iface netlink.Link) error {
-	route := netlink.Route{
+// hostRoute builds the host route towards a container address, with the
+// metric of the network. Addresses covered by the host aggregate are tagged
+// so that they are not announced.
+func (d *NetDriver) hostRoute(network *routedNetwork, ip *net.IPNet, iface netlink.Link) *netlink.Route {
+	route := &netlink.Route{
 		LinkIndex: iface.Attrs().Index,
 		Dst:       ip,
+		Priority:  network.metric,
+	}
+	if d.aggregate.contains(ip.IP) {
+		route.Protocol = aggregatedRouteProto
 	}
+	return route
+}
+
+func (d *NetDriver) routeAdd(route *netlink.Route) error {
 	log.Debugf("routeAdd: Adding route %+v", route)
-	if err := netlink.RouteAdd(&route); err != nil {
+	if err := d.nl.RouteAdd(route); err != nil {
 		log.Errorf("routeAdd: Unable to add route %+v: %+v", route, err)
+		return fmt.Errorf("Unable to add route to %s: %v", route.Dst, err)
 	}
 	return nil
 }
@@ -348,15 +837,22 @@ func (ein *ErrIfaceName) Error() string {
 	return "failed to find name for new interface"
 }
 
-func generateIfaceName(vethPrefix string) (string, error) {
-	vethLen := 12 - len(vethPrefix)
+// isNetworkVeth reports whether link is a veth named by generateIfaceName
+// with a network veth prefix.
+func isNetworkVeth(link netlink.Link, prefix string) bool {
+	name := link.Attrs().Name
+	return link.Type() == "veth" && strings.HasPrefix(name, prefix) && len(name) == ifaceNameLen
+}
+
+func generateIfaceName(nl Netlink, vethPrefix string) (string, error) {
+	vethLen := ifaceNameLen - len(vethPrefix)
 	for i := 0; i < 3; i++ {
 		name, err := netutils.GenerateRandomName(vethPrefix, vethLen)
 		if err != nil {
 			continue
 		}
-		if _, err := net.InterfaceByName(name); err != nil {
-			if strings.Contains(err.Error(), "no such") {
+		if _, err := nl.LinkByName(name); err != nil {
+			if strings.Contains(err.Error(), "not found") {
 				return name, nil
 			}
 			return "", err
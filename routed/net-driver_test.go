@@ -1,9 +1,16 @@
 package routed
 
 import (
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	netApi "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/vishvananda/netlink"
 )
 
 func TestNetwork(t *testing.T) {
@@ -12,7 +19,7 @@ func TestNetwork(t *testing.T) {
 	mtu := 1500
 	netID := "c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c"
 
-	d, err := NewNetDriver(version, gateway, mtu)
+	d, err := newNetDriver(newFakeNetlink(), newFakeIptables(), newFakeSysctls(), newFakeTc(), version, gateway, mtu, "")
 
 	if err != nil {
 		t.Fatalf("TestNetwork failed: could not create driver - %v", err)
@@ -26,8 +33,12 @@ func TestNetwork(t *testing.T) {
 		t.Fatalf("TestNetwork failed: CreateNetwork %v", err)
 	}
 
-	if d.network.id != netID {
-		t.Fatalf("TestNetwork failed: wrong netId %s", d.network.id)
+	if n := d.networks[netID]; n == nil || n.id != netID {
+		t.Fatalf("TestNetwork failed: wrong network %+v", n)
+	}
+
+	if err := d.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: netID}); err == nil {
+		t.Fatalf("TestNetwork failed: network created twice")
 	}
 
 	err = d.DeleteNetwork(&netApi.DeleteNetworkRequest{
@@ -38,8 +49,115 @@ func TestNetwork(t *testing.T) {
 		t.Fatalf("TestNetwork failed: DeleteNetwork %v", err)
 	}
 
-	if d.network != nil {
-		t.Fatalf("TestNetwork failed: d.network not null")
+	if len(d.networks) != 0 {
+		t.Fatalf("TestNetwork failed: networks left %+v", d.networks)
+	}
+
+	if err := d.DeleteNetwork(&netApi.DeleteNetworkRequest{NetworkID: netID}); err == nil {
+		t.Fatalf("TestNetwork failed: deleted unknown network")
+	}
+}
+
+func TestNetworkReplaced(t *testing.T) {
+	netID := "c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c"
+
+	d, _ := newNetDriver(newFakeNetlink(), newFakeIptables(), newFakeSysctls(), newFakeTc(), "0.1", "10.100.0.1", 1500, "")
+
+	// The background loops read the network while Docker replaces it
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			d.reconcile(nil)
+			d.Networks()
+			d.EndpointStatistics()
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		d.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: netID})
+		d.DeleteNetwork(&netApi.DeleteNetworkRequest{NetworkID: netID})
+	}
+	close(done)
+	<-stopped
+
+	if _, err := d.Join(&netApi.JoinRequest{NetworkID: netID, EndpointID: "4b50fb7f"}); err == nil {
+		t.Fatalf("TestNetworkReplaced failed: Join accepted without network")
+	}
+}
+
+func TestNetworks(t *testing.T) {
+	netIDs := []string{
+		"c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c",
+		"d56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c",
+	}
+	eIDs := []string{
+		"4b50fb7f12adb0da3e6662148e9b1bc43b507ad2fd8a0f187ff297cbc88aee05",
+		"9b50fb7f12adb0da3e6662148e9b1bc43b507ad2fd8a0f187ff297cbc88aee05",
+	}
+	addresses := []string{"10.1.0.2", "10.1.0.3"}
+	gateways := []string{"10.200.0.1", "10.201.0.1"}
+	mtus := []int{9000, 1400}
+
+	nl := newFakeNetlink()
+	d, _ := newNetDriver(nl, newFakeIptables(), newFakeSysctls(), newFakeTc(), "0.1", "10.100.0.1", 1500, "")
+
+	for i, netID := range netIDs {
+		err := d.CreateNetwork(&netApi.CreateNetworkRequest{
+			NetworkID: netID,
+			Options:   map[string]interface{}{"routed.gateway": gateways[i], "routed.mtu": strconv.Itoa(mtus[i])},
+		})
+		if err != nil {
+			t.Fatalf("TestNetworks failed: CreateNetwork %v", err)
+		}
+		d.CreateEndpoint(&netApi.CreateEndpointRequest{
+			NetworkID:  netID,
+			EndpointID: eIDs[i],
+			Interface:  &netApi.EndpointInterface{Address: addresses[i] + "/32"},
+		})
+		res, err := d.Join(&netApi.JoinRequest{NetworkID: netID, EndpointID: eIDs[i]})
+		if err != nil || res.StaticRoutes[1].NextHop != gateways[i] {
+			t.Fatalf("TestNetworks failed: Join %+v %v", res, err)
+		}
+	}
+
+	for i, netID := range netIDs {
+		hostIface, _ := nl.LinkByName(d.networks[netID].endpoints[eIDs[i]].hostInterfaceName)
+		if hostIface == nil || hostIface.Attrs().MTU != mtus[i] {
+			t.Fatalf("TestNetworks failed: wrong host interface %+v", hostIface)
+		}
+	}
+
+	// An endpoint is only known to its network
+	if _, err := d.EndpointInfo(&netApi.InfoRequest{NetworkID: netIDs[1], EndpointID: eIDs[0]}); err == nil {
+		t.Fatalf("TestNetworks failed: endpoint found on another network")
+	}
+
+	if err := d.DeleteNetwork(&netApi.DeleteNetworkRequest{NetworkID: netIDs[0]}); err != nil {
+		t.Fatalf("TestNetworks failed: DeleteNetwork %v", err)
+	}
+	if _, err := d.EndpointInfo(&netApi.InfoRequest{NetworkID: netIDs[0], EndpointID: eIDs[0]}); err == nil {
+		t.Fatalf("TestNetworks failed: endpoint of deleted network found")
+	}
+
+	states := d.Networks()
+	if len(states) != 1 || states[0].ID != netIDs[1] || states[0].Gateway != gateways[1] || states[0].MTU != mtus[1] ||
+		len(states[0].Endpoints) != 1 || states[0].Endpoints[0].ID != eIDs[1] {
+		t.Fatalf("TestNetworks failed: wrong networks %+v", states)
+	}
+	if route := nl.findRoute(addresses[1] + "/32"); route == nil {
+		t.Fatalf("TestNetworks failed: route of the other network removed")
+	}
+	if err := d.Leave(&netApi.LeaveRequest{NetworkID: netIDs[1], EndpointID: eIDs[1]}); err != nil {
+		t.Fatalf("TestNetworks failed: Leave %v", err)
+	}
+	if err := d.Leave(&netApi.LeaveRequest{NetworkID: netIDs[0], EndpointID: eIDs[0]}); err == nil {
+		t.Fatalf("TestNetworks failed: Leave accepted on deleted network")
 	}
 }
 
@@ -52,7 +170,8 @@ func TestEndpoint(t *testing.T) {
 	address := "10.1.0.2/32"
 	sandBoxKey := "/var/run/docker/netns/68b0caca5d0c"
 
-	d, err := NewNetDriver(version, gateway, mtu)
+	nl := newFakeNetlink()
+	d, err := newNetDriver(nl, newFakeIptables(), newFakeSysctls(), newFakeTc(), version, gateway, mtu, "")
 
 	if err != nil {
 		t.Fatalf("TestCreateSandbox failed: could not create driver - %v", err)
@@ -66,7 +185,7 @@ func TestEndpoint(t *testing.T) {
 		t.Fatalf("TestCreateSandbox failed: %v", err)
 	}
 
-	_, err = d.CreateEndpoint(&netApi.CreateEndpointRequest{
+	epRes, err := d.CreateEndpoint(&netApi.CreateEndpointRequest{
 		NetworkID:  netID,
 		EndpointID: eID,
 		Interface:  &netApi.EndpointInterface{Address: address},
@@ -76,7 +195,11 @@ func TestEndpoint(t *testing.T) {
 		t.Fatalf("TestCreateSandbox failed: %v", err)
 	}
 
-	ep := d.network.endpoints[eID]
+	if epRes == nil || epRes.Interface.MacAddress != "02:42:0a:01:00:02" {
+		t.Fatalf("TestCreateSandbox failed: wrong endpoint response %+v", epRes)
+	}
+
+	ep := d.networks[netID].endpoints[eID]
 
 	if ep == nil || ep.ipv4Address.String() != address {
 		t.Fatalf("TestCreateSandbox failed: wrong Endpoint %v", ep)
@@ -96,6 +219,31 @@ func TestEndpoint(t *testing.T) {
 		t.Fatalf("TestCreateSandbox failed: wrong join response %+v", res)
 	}
 
+	hostIface, err := nl.LinkByName(ep.hostInterfaceName)
+	if err != nil || hostIface.Attrs().Flags&net.FlagUp == 0 || hostIface.Attrs().MTU != mtu {
+		t.Fatalf("TestCreateSandbox failed: wrong host interface %+v", hostIface)
+	}
+
+	containerIface, err := nl.LinkByName(res.InterfaceName.SrcName)
+	if err != nil || containerIface.Attrs().HardwareAddr.String() != "02:42:0a:01:00:02" {
+		t.Fatalf("TestCreateSandbox failed: wrong container interface %+v", containerIface)
+	}
+
+	route := nl.findRoute(address)
+	if route == nil || route.LinkIndex != hostIface.Attrs().Index {
+		t.Fatalf("TestCreateSandbox failed: wrong route %+v", route)
+	}
+
+	hostIface.Attrs().Statistics = &netlink.LinkStatistics{RxBytes: 1234}
+	info, err := d.EndpointInfo(&netApi.InfoRequest{NetworkID: netID, EndpointID: eID})
+	if err != nil {
+		t.Fatalf("TestCreateSandbox failed: %v", err)
+	}
+	if info.Value["hostInterface"] != ep.hostInterfaceName || info.Value["macAddress"] != "02:42:0a:01:00:02" ||
+		info.Value["routeState"] != "announced" || info.Value["rxBytes"] != "1234" {
+		t.Fatalf("TestCreateSandbox failed: wrong endpoint info %+v", info.Value)
+	}
+
 	err = d.Leave(&netApi.LeaveRequest{
 		NetworkID:  netID,
 		EndpointID: eID,
@@ -104,4 +252,279 @@ func TestEndpoint(t *testing.T) {
 	if err != nil {
 		t.Fatalf("TestCreateSandbox failed: %v", err)
 	}
+
+	err = d.DeleteEndpoint(&netApi.DeleteEndpointRequest{
+		NetworkID:  netID,
+		EndpointID: eID,
+	})
+
+	if err != nil {
+		t.Fatalf("TestCreateSandbox failed: %v", err)
+	}
+
+	if links, _ := nl.LinkList(); len(links) != 0 {
+		t.Fatalf("TestCreateSandbox failed: links left %+v", links)
+	}
+
+	if route := nl.findRoute(address); route != nil {
+		t.Fatalf("TestCreateSandbox failed: route left %+v", route)
+	}
+}
+
+func TestNetFilter(t *testing.T) {
+	fw := newFakeIptables(containersChainName, containerRejectChainName)
+	config, err := NetFilterConfigParse("10.2.0.0/16, 10.3.0.1-10.3.0.9")
+	if err != nil {
+		t.Fatalf("TestNetFilter failed: %v", err)
+	}
+
+	n := &netFilter{fw: fw, ifaceName: "vethr1234", match: []string{"-o", "vethr1234"}, config: config}
+	if err := n.applyFiltering(); err != nil {
+		t.Fatalf("TestNetFilter failed: %v", err)
+	}
+
+	rules := fw.chains["CONTAINER-vethr1234"]
+	if len(rules) != 3 || rules[2] != "-j CONTAINER-REJECT" {
+		t.Fatalf("TestNetFilter failed: wrong endpoint chain %q", rules)
+	}
+	if jumps := fw.chains[containersChainName]; len(jumps) != 1 || jumps[0] != "-o vethr1234 -j CONTAINER-vethr1234" {
+		t.Fatalf("TestNetFilter failed: wrong jump %q", jumps)
+	}
+
+	if err := n.removeFiltering(); err != nil {
+		t.Fatalf("TestNetFilter failed: %v", err)
+	}
+	if fw.ChainExists("CONTAINER-vethr1234") || len(fw.chains[containersChainName]) != 0 {
+		t.Fatalf("TestNetFilter failed: rules left %+v", fw.chains)
+	}
+}
+
+func TestJoinRollback(t *testing.T) {
+	netID := "c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c"
+	eID := "4b50fb7f12adb0da3e6662148e9b1bc43b507ad2fd8a0f187ff297cbc88aee05"
+
+	// Netlink operations, and iptables commands of "apply filtering"
+	for _, op := range []string{"LinkSetMTU", "LinkSetHardwareAddr", "LinkSetUp", "RouteAdd", "-A", "-I"} {
+		nl := newFakeNetlink()
+		fw := newFakeIptables(containersChainName, containerRejectChainName)
+		d, err := newNetDriver(nl, fw, newFakeSysctls(), newFakeTc(), "0.1", "10.100.0.1", 1500, "")
+		if err != nil {
+			t.Fatalf("TestJoinRollback failed: could not create driver - %v", err)
+		}
+		d.SetDefaultPolicy("10.2.0.0/16")
+		d.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: netID})
+		d.CreateEndpoint(&netApi.CreateEndpointRequest{
+			NetworkID:  netID,
+			EndpointID: eID,
+			Interface:  &netApi.EndpointInterface{Address: "10.1.0.2/32"},
+		})
+
+		if strings.HasPrefix(op, "-") {
+			fw.failWith(op, syscall.EPERM)
+		} else {
+			nl.failWith(op, syscall.EPERM)
+		}
+		_, err = d.Join(&netApi.JoinRequest{NetworkID: netID, EndpointID: eID})
+		if err == nil || !strings.Contains(err.Error(), "Join failed at step") {
+			t.Fatalf("TestJoinRollback failed: %s: wrong error %v", op, err)
+		}
+
+		if links, _ := nl.LinkList(); len(links) != 0 {
+			t.Fatalf("TestJoinRollback failed: %s: links left %+v", op, links)
+		}
+		if routes, _ := nl.RouteList(nil, netlink.FAMILY_V4); len(routes) != 0 {
+			t.Fatalf("TestJoinRollback failed: %s: routes left %+v", op, routes)
+		}
+		if ep := d.networks[netID].endpoints[eID]; ep.joined || ep.hostInterfaceName != "" {
+			t.Fatalf("TestJoinRollback failed: %s: wrong endpoint %+v", op, ep)
+		}
+		if len(fw.chains) != 3 || len(fw.chains[containersChainName]) != 0 {
+			t.Fatalf("TestJoinRollback failed: %s: rules left %+v", op, fw.chains)
+		}
+	}
+}
+
+func TestCreateEndpointMac(t *testing.T) {
+	netID := "c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c"
+	eID := "4b50fb7f12adb0da3e6662148e9b1bc43b507ad2fd8a0f187ff297cbc88aee05"
+
+	d, _ := newNetDriver(newFakeNetlink(), newFakeIptables(), newFakeSysctls(), newFakeTc(), "0.1", "10.100.0.1", 1500, "")
+	d.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: netID})
+
+	// Docker already knows a MAC it asked for
+	res, err := d.CreateEndpoint(&netApi.CreateEndpointRequest{
+		NetworkID:  netID,
+		EndpointID: eID,
+		Interface:  &netApi.EndpointInterface{Address: "10.1.0.2/32", MacAddress: "02:42:0a:00:00:09"},
+	})
+	if err != nil || res != nil {
+		t.Fatalf("TestCreateEndpointMac failed: wrong response %+v, %v", res, err)
+	}
+	if mac := d.networks[netID].endpoints[eID].macAddress.String(); mac != "02:42:0a:00:00:09" {
+		t.Fatalf("TestCreateEndpointMac failed: wrong MAC %s", mac)
+	}
+
+	_, err = d.CreateEndpoint(&netApi.CreateEndpointRequest{
+		NetworkID:  netID,
+		EndpointID: eID,
+		Interface:  &netApi.EndpointInterface{Address: "10.1.0.2/32", MacAddress: "bogus"},
+	})
+	if err == nil {
+		t.Fatalf("TestCreateEndpointMac failed: accepted invalid MAC")
+	}
+}
+
+func TestNetworkOptions(t *testing.T) {
+	netID := "c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c"
+	eID := "4b50fb7f12adb0da3e6662148e9b1bc43b507ad2fd8a0f187ff297cbc88aee05"
+
+	nl := newFakeNetlink()
+	d, _ := newNetDriver(nl, newFakeIptables(), newFakeSysctls(), newFakeTc(), "0.1", "10.100.0.1", 1500, "")
+
+	// Left by a previous run with the same veth prefix
+	nl.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "rt4b50a1b2c3"}, PeerName: "rtpeer"})
+	nl.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "rt4b50a1b2c4"}})
+
+	err := d.CreateNetwork(&netApi.CreateNetworkRequest{
+		NetworkID: netID,
+		Options: map[string]interface{}{
+			netlabel.GenericData: map[string]interface{}{
+				"routed.gateway":    "10.200.0.1",
+				"routed.mtu":        "9000",
+				"routed.vethprefix": "rt",
+				"routed.metric":     "20",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("TestNetworkOptions failed: CreateNetwork %v", err)
+	}
+	if n := d.networks[netID]; n.gateway != "10.200.0.1" || n.mtu != 9000 || n.vethPrefix != "rt" || n.metric != 20 {
+		t.Fatalf("TestNetworkOptions failed: wrong network %+v", n)
+	}
+	if _, err := nl.LinkByName("rt4b50a1b2c3"); err == nil {
+		t.Fatalf("TestNetworkOptions failed: stale veth kept")
+	}
+	if _, err := nl.LinkByName("rt4b50a1b2c4"); err != nil {
+		t.Fatalf("TestNetworkOptions failed: removed a link that isn't a veth")
+	}
+
+	d.CreateEndpoint(&netApi.CreateEndpointRequest{
+		NetworkID:  netID,
+		EndpointID: eID,
+		Interface:  &netApi.EndpointInterface{Address: "10.1.0.2/32"},
+	})
+	res, err := d.Join(&netApi.JoinRequest{NetworkID: netID, EndpointID: eID})
+	if err != nil {
+		t.Fatalf("TestNetworkOptions failed: Join %v", err)
+	}
+	if res.StaticRoutes[1].NextHop != "10.200.0.1" {
+		t.Fatalf("TestNetworkOptions failed: wrong static routes %+v", res.StaticRoutes)
+	}
+
+	ep := d.networks[netID].endpoints[eID]
+	hostIface, _ := nl.LinkByName(ep.hostInterfaceName)
+	if !strings.HasPrefix(ep.hostInterfaceName, "rt4b50") || hostIface.Attrs().MTU != 9000 {
+		t.Fatalf("TestNetworkOptions failed: wrong host interface %+v", hostIface)
+	}
+	if route := nl.findRoute("10.1.0.2/32"); route == nil || route.Priority != 20 {
+		t.Fatalf("TestNetworkOptions failed: wrong route %+v", route)
+	}
+
+	for _, options := range []map[string]interface{}{
+		{"routed.gateway": "fe80::1"},
+		{"routed.mtu": "20"},
+		{"routed.vethprefix": "toolongprefix"},
+		{"routed.vethprefix": "ve th"},
+		{"routed.metric": "-1"},
+	} {
+		if err := d.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: "9f3c1d2e", Options: options}); err == nil {
+			t.Fatalf("TestNetworkOptions failed: accepted %v", options)
+		}
+	}
+
+	// The gateway given to the IPAM driver is taken, unless the network
+	// has its own
+	d.DeleteNetwork(&netApi.DeleteNetworkRequest{NetworkID: netID})
+	ipv4Data := []*netApi.IPAMData{{Pool: "10.1.0.0/16", Gateway: "10.200.0.1/32"}}
+	if err := d.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: netID, IPv4Data: ipv4Data}); err != nil || d.networks[netID].gateway != "10.200.0.1" {
+		t.Fatalf("TestNetworkOptions failed: IPAM gateway not taken %v %+v", err, d.networks[netID])
+	}
+	d.DeleteNetwork(&netApi.DeleteNetworkRequest{NetworkID: netID})
+	if err := d.CreateNetwork(&netApi.CreateNetworkRequest{
+		NetworkID: netID,
+		IPv4Data:  ipv4Data,
+		Options:   map[string]interface{}{"routed.gateway": "10.200.0.2"},
+	}); err != nil || d.networks[netID].gateway != "10.200.0.2" {
+		t.Fatalf("TestNetworkOptions failed: network gateway not taken %v %+v", err, d.networks[netID])
+	}
+	d.DeleteNetwork(&netApi.DeleteNetworkRequest{NetworkID: netID})
+	ipv4Data[0].Gateway = "10.100.0.1/32"
+	if err := d.CreateNetwork(&netApi.CreateNetworkRequest{
+		NetworkID: netID,
+		IPv4Data:  ipv4Data,
+		Options:   map[string]interface{}{"routed.gateway-mode": "link-local"},
+	}); err != nil || d.networks[netID].gateway != LinkLocalGateway {
+		t.Fatalf("TestNetworkOptions failed: default IPAM gateway taken %v %+v", err, d.networks[netID])
+	}
+}
+
+func TestLinkLocalGateway(t *testing.T) {
+	netID := "c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c"
+	eID := "4b50fb7f12adb0da3e6662148e9b1bc43b507ad2fd8a0f187ff297cbc88aee05"
+	sandBoxKey := "/var/run/docker/netns/68b0caca5d0c"
+
+	nl := newFakeNetlink()
+	sandbox := nl.addSandbox(sandBoxKey)
+	d, _ := newNetDriver(nl, newFakeIptables(), newFakeSysctls(), newFakeTc(), "0.1", "10.100.0.1", 1500, "")
+
+	err := d.CreateNetwork(&netApi.CreateNetworkRequest{
+		NetworkID: netID,
+		Options:   map[string]interface{}{"routed.gateway-mode": "link-local"},
+	})
+	if err != nil || d.networks[netID].gateway != LinkLocalGateway {
+		t.Fatalf("TestLinkLocalGateway failed: CreateNetwork %+v %v", d.networks[netID], err)
+	}
+
+	d.CreateEndpoint(&netApi.CreateEndpointRequest{
+		NetworkID:  netID,
+		EndpointID: eID,
+		Interface:  &netApi.EndpointInterface{Address: "10.1.0.2/32"},
+	})
+	res, err := d.Join(&netApi.JoinRequest{NetworkID: netID, EndpointID: eID, SandboxKey: sandBoxKey})
+	if err != nil {
+		t.Fatalf("TestLinkLocalGateway failed: Join %v", err)
+	}
+	if res.StaticRoutes[1].NextHop != LinkLocalGateway {
+		t.Fatalf("TestLinkLocalGateway failed: wrong static routes %+v", res.StaticRoutes)
+	}
+
+	hostIface, _ := nl.LinkByName(d.networks[netID].endpoints[eID].hostInterfaceName)
+	addrs, _ := nl.AddrList(hostIface, netlink.FAMILY_V4)
+	if len(addrs) != 1 || addrs[0].IPNet.String() != "169.254.1.1/32" {
+		t.Fatalf("TestLinkLocalGateway failed: wrong host interface addresses %+v", addrs)
+	}
+
+	// Docker moves the container link after Join
+	nl.moveLink(res.InterfaceName.SrcName, sandbox, "eth0")
+
+	var neigh *netlink.Neigh
+	for i := 0; i < 50 && neigh == nil; i++ {
+		time.Sleep(sandboxPollInterval)
+		neigh = sandbox.findNeigh(LinkLocalGateway)
+	}
+	if neigh == nil || neigh.State != netlink.NUD_PERMANENT ||
+		neigh.HardwareAddr.String() != hostIface.Attrs().HardwareAddr.String() {
+		t.Fatalf("TestLinkLocalGateway failed: wrong gateway neighbor %+v", neigh)
+	}
+
+	for _, options := range []map[string]interface{}{
+		{"routed.gateway-mode": "link-local", "routed.gateway": "10.100.0.1"},
+		{"routed.gateway-mode": "link-local", "routed.dataplane": "ipvlan", "routed.ipvlan.parent": "eth1"},
+		{"routed.gateway-mode": "arp"},
+	} {
+		if err := d.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: "9f3c1d2e", Options: options}); err == nil {
+			t.Fatalf("TestLinkLocalGateway failed: accepted %v", options)
+		}
+	}
 }
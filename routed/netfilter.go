@@ -1,18 +1,28 @@
 package routed
 
 import (
+	"bytes"
 	"fmt"
 	"net"
 	"strings"
+	"sync"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/docker/libnetwork/iptables"
 )
 
+// errNoIngressFiltering is returned when an ingress policy would apply to an
+// endpoint of a network whose traffic the FORWARD chain doesn't see: in l3
+// mode ipvlan traffic bypasses the host netfilter, in l3s mode it goes
+// through INPUT.
+var errNoIngressFiltering = fmt.Errorf("Ingress filtering needs the %s dataplane", vethDataplane)
+
 const (
 	containersChainName      = "CONTAINERS"
 	containerRejectChainName = "CONTAINER-REJECT"
 	vethChainPrefix          = "CONTAINER-"
+	// swapChainSuffix names the chain built aside while the policy of an
+	// endpoint is replaced
+	swapChainSuffix = "~"
 )
 
 type IPRange struct {
@@ -38,14 +48,23 @@ func (r *IPRange) String() string {
 	return r.from.String() + "-" + r.to.String()
 }
 
+func (r *IPRange) contains(ip net.IP) bool {
+	ip = ip.To16()
+	return bytes.Compare(ip, r.from.To16()) >= 0 && bytes.Compare(ip, r.to.To16()) <= 0
+}
+
 type netFilterConfig struct {
 	allowedNets   []*net.IPNet
 	allowedRanges []*IPRange
 }
 
 type netFilter struct {
+	fw        Firewall
 	ifaceName string
+	match     []string
 	config    *netFilterConfig
+	// chain is the chain jumped to while the filtering is applied
+	chain string
 }
 
 func ParseIpOrNet(ipStr string) *net.IPNet {
@@ -82,7 +101,9 @@ func NetFilterConfigParse(ingressAllowedString string) (*netFilterConfig, error)
 	}
 }
 
-func NewNetFilter(ifaceName string, epOptions map[string]interface{}) *netFilter {
+// NewNetFilter creates the filtering of the endpoint named ifaceName, whose
+// traffic is selected by the iptables match.
+func NewNetFilter(fw Firewall, ifaceName string, match []string, epOptions map[string]interface{}) *netFilter {
 	log.Debugf("New NetFilter for iface %s and options %s", ifaceName, epOptions)
 
 	// TODO: Fix
@@ -91,12 +112,23 @@ func NewNetFilter(ifaceName string, epOptions map[string]interface{}) *netFilter
 	//	log.Info("NetFilter: No network ingress filtering specified")
 	//}
 
-	//return &netFilter{ifaceName, ingressFiltering}
-	return &netFilter{ifaceName, nil}
+	//return &netFilter{fw, ifaceName, match, ingressFiltering}
+	return &netFilter{fw: fw, ifaceName: ifaceName, match: match}
 }
 
-func chainExists(chainName string) bool {
-	return iptables.Exists("", chainName, "-N", chainName)
+// String describes the ingress policy of the filter.
+func (n *netFilter) String() string {
+	if n == nil || n.config == nil {
+		return "none"
+	}
+	var allowed []string
+	for _, ipNet := range n.config.allowedNets {
+		allowed = append(allowed, ipNet.String())
+	}
+	for _, ipRange := range n.config.allowedRanges {
+		allowed = append(allowed, ipRange.String())
+	}
+	return "allow " + strings.Join(allowed, ",")
 }
 
 func (n *netFilter) applyFiltering() error {
@@ -110,49 +142,179 @@ func (n *netFilter) applyFiltering() error {
 
 	// Verify expected chains "CONTAINERS" and "CONTAINER-REJECT" exist
 	for _, chainName := range []string{containersChainName, containerRejectChainName} {
-		if !chainExists(chainName) {
+		if !n.fw.ChainExists(chainName) {
 			return fmt.Errorf("Expected iptables chain not found: %s", chainName)
 		}
 	}
 
-	rules := new(iptablesRules)
-	rules.addRule("-N", vethChainName) // create veth specific chain
+	if err := n.buildChain(vethChainName, n.config); err != nil {
+		return err
+	}
 
-	// Allow specified nets and ranges only
-	for _, ipNet := range n.config.allowedNets {
-		rules.addRule("-A", vethChainName, "-s", ipNet.String(), "-j", "ACCEPT")
+	// Add JUMP in CONTAINERS, send all traffic going to the endpoint
+	if err := applyIpTablesRule(n.fw, n.jumpRule("-I", vethChainName)...); err != nil {
+		n.deleteChain(vethChainName)
+		return err
 	}
-	for _, ipRange := range n.config.allowedRanges {
-		rules.addRule("-A", vethChainName, "-m", "iprange", "--src-range", ipRange.String(), "-j", "ACCEPT")
+	n.chain = vethChainName
+
+	log.Info("NetFilter: Successfully applied ingress filtering")
+	return nil
+}
+
+// jumpRule returns the rule of CONTAINERS sending the traffic of the
+// endpoint to chain, for cmd -I, -D or -C.
+func (n *netFilter) jumpRule(cmd string, chain string) []string {
+	rule := []string{cmd, containersChainName}
+	if cmd == "-I" {
+		rule = append(rule, "1")
 	}
+	rule = append(rule, n.match...)
+	return append(rule, "-j", chain)
+}
 
-	rules.addRule("-A", vethChainName, "-j", "CONTAINER-REJECT")
+// chainRules returns the rules of an endpoint chain accepting the sources
+// allowed by config and rejecting the others.
+func chainRules(config *netFilterConfig) [][]string {
+	var rules [][]string
+	// Allow specified nets and ranges only
+	for _, ipNet := range config.allowedNets {
+		rules = append(rules, []string{"-s", ipNet.String(), "-j", "ACCEPT"})
+	}
+	for _, ipRange := range config.allowedRanges {
+		rules = append(rules, []string{"-m", "iprange", "--src-range", ipRange.String(), "-j", "ACCEPT"})
+	}
+	return append(rules, []string{"-j", containerRejectChainName})
+}
 
-	// Add JUMP in CONTAINERS, send all traffic going to the veth interface
-	rules.addRule("-I", containersChainName, "1", "-o", n.ifaceName, "-j", vethChainName)
+// buildChain creates the chain named name applying config. The chain is
+// removed again when a rule fails.
+func (n *netFilter) buildChain(name string, config *netFilterConfig) error {
+	rules := new(iptablesRules)
+	rules.addRule("-N", name) // create veth specific chain
+	for _, rule := range chainRules(config) {
+		rules.addRule(append([]string{"-A", name}, rule...)...)
+	}
 
-	if err := rules.apply(); err != nil {
+	if err := rules.apply(n.fw); err != nil {
+		if n.fw.ChainExists(name) {
+			n.deleteChain(name)
+		}
 		return err
 	}
-
-	log.Info("NetFilter: Successfully applied ingress filtering")
 	return nil
 }
 
+// deleteChain flushes and deletes a chain no longer jumped to.
+func (n *netFilter) deleteChain(name string) error {
+	rules := new(iptablesRules)
+	rules.addRule("-F", name)
+	rules.addRule("-X", name)
+	return rules.applyAll(n.fw)
+}
+
 func (n *netFilter) removeFiltering() error {
-	if n.config == nil {
+	if n.config == nil || n.chain == "" {
 		return nil
 	}
 
 	log.Debugf("NetFilter. Removing rules for %s", n.ifaceName)
 
+	// The jump might be missing, the chain is removed anyway
+	rules := new(iptablesRules)
+	rules.addRule(n.jumpRule("-D", n.chain)...)
+	rules.addRule("-F", n.chain)
+	rules.addRule("-X", n.chain)
+	if err := rules.applyAll(n.fw); err != nil {
+		return err
+	}
+	n.chain = ""
+	return nil
+}
+
+// reapplyFiltering adds what is missing of the filtering of the endpoint,
+// leaving it in place otherwise. A chain whose rules were changed is
+// replaced as a whole.
+func (n *netFilter) reapplyFiltering() error {
+	if n.config == nil {
+		return nil
+	}
+	if n.chain == "" || !n.fw.ChainExists(n.chain) {
+		n.chain = ""
+		return n.applyFiltering()
+	}
+
+	if _, err := n.fw.Raw(n.jumpRule("-C", n.chain)...); err != nil {
+		log.Infof("reapplyFiltering: Adding missing jump to %s", n.chain)
+		if err := applyIpTablesRule(n.fw, n.jumpRule("-I", n.chain)...); err != nil {
+			return err
+		}
+	}
+
+	rules, err := listRules(n.fw, "filter", n.chain)
+	if err != nil {
+		return err
+	}
+	if !sameRules(rules, chainRules(n.config)) {
+		log.Infof("reapplyFiltering: Rebuilding chain %s", n.chain)
+		return n.swapFiltering(n.config)
+	}
+	return nil
+}
+
+func sameRules(a [][]string, b [][]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if strings.Join(a[i], " ") != strings.Join(b[i], " ") {
+			return false
+		}
+	}
+	return true
+}
+
+// swapFiltering replaces the chain of an endpoint filtered with one applying
+// config. The new chain is built aside and jumped to before the old jump is
+// deleted, the endpoint being filtered all along. On failure the old chain
+// stays in force.
+func (n *netFilter) swapFiltering(config *netFilterConfig) error {
 	vethChainName := vethChainPrefix + n.ifaceName
+	old, swapped := n.chain, vethChainName+swapChainSuffix
+	if old == swapped {
+		swapped = vethChainName
+	}
 
-	rules := new(iptablesRules)
-	rules.addRule("-D", containersChainName, "-o", n.ifaceName, "-j", vethChainName)
-	rules.addRule("-F", vethChainName)
-	rules.addRule("-X", vethChainName)
-	return rules.apply()
+	if err := n.buildChain(swapped, config); err != nil {
+		return err
+	}
+	if err := applyIpTablesRule(n.fw, n.jumpRule("-I", swapped)...); err != nil {
+		n.deleteChain(swapped)
+		return err
+	}
+	if err := applyIpTablesRule(n.fw, n.jumpRule("-D", old)...); err != nil {
+		if err := applyIpTablesRule(n.fw, n.jumpRule("-D", swapped)...); err != nil {
+			log.Warnf("swapFiltering: Couldn't delete jump to %s: %v", swapped, err)
+		} else {
+			n.deleteChain(swapped)
+		}
+		return err
+	}
+	n.chain, n.config = swapped, config
+
+	if err := n.deleteChain(old); err != nil {
+		log.Warnf("swapFiltering: Couldn't delete chain %s: %v", old, err)
+		return nil
+	}
+	// Keep the usual name when possible, the jump follows the rename
+	if swapped != vethChainName {
+		if err := applyIpTablesRule(n.fw, "-E", swapped, vethChainName); err != nil {
+			log.Warnf("swapFiltering: Couldn't rename chain %s: %v", swapped, err)
+			return nil
+		}
+		n.chain = vethChainName
+	}
+	return nil
 }
 
 type iptablesRules struct {
@@ -163,19 +325,163 @@ func (ipRules *iptablesRules) addRule(args ...string) {
 	ipRules.rules = append(ipRules.rules, args)
 }
 
-func (ipRules *iptablesRules) apply() error {
+func (ipRules *iptablesRules) apply(fw Firewall) error {
 	for _, rule := range ipRules.rules {
-		if err := applyIpTablesRule(rule...); err != nil {
+		if err := applyIpTablesRule(fw, rule...); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func applyIpTablesRule(args ...string) error {
+// applyAll applies every rule even when some fail, and returns the first
+// error.
+func (ipRules *iptablesRules) applyAll(fw Firewall) error {
+	var failed error
+	for _, rule := range ipRules.rules {
+		if err := applyIpTablesRule(fw, rule...); err != nil && failed == nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
+func applyIpTablesRule(fw Firewall, args ...string) error {
 	log.Debugf("NetFilter. IpTables call %s", args)
-	if output, err := iptables.Raw(args...); err != nil {
+	if output, err := fw.Raw(args...); err != nil {
 		return fmt.Errorf("NetFilter. IP tables apply rule failed %s %s %v", args, output, err)
 	}
 	return nil
 }
+
+// replaceFiltering applies config in place of the ingress filtering of a
+// joined endpoint. On failure the previous filtering stays in force. Caller
+// must hold the network lock.
+func replaceFiltering(ep *routedEndpoint, config *netFilterConfig) error {
+	n := ep.netFilter
+	switch {
+	case n.chain == "":
+		previous := n.config
+		n.config = config
+		if err := n.applyFiltering(); err != nil {
+			n.config = previous
+			return err
+		}
+	case config == nil:
+		// Removing the jump opens the endpoint, the chain is left to the
+		// garbage collection when it can't be deleted
+		if err := applyIpTablesRule(n.fw, n.jumpRule("-D", n.chain)...); err != nil {
+			return err
+		}
+		if err := n.deleteChain(n.chain); err != nil {
+			log.Warnf("replaceFiltering: Couldn't delete chain %s: %v", n.chain, err)
+		}
+		n.chain, n.config = "", nil
+	default:
+		return n.swapFiltering(config)
+	}
+	return nil
+}
+
+// SetEndpointPolicy replaces the ingress filtering of a joined endpoint with
+// the comma separated IPs, CIDRs and IP ranges allowed, or removes it when
+// allowed is empty. The endpoint no longer follows the default policy.
+func (d *NetDriver) SetEndpointPolicy(eid string, allowed string) error {
+	config, err := NetFilterConfigParse(allowed)
+	if err != nil {
+		return err
+	}
+
+	network, err := d.endpointNetwork(eid)
+	if err != nil {
+		return err
+	}
+
+	network.m.Lock()
+	defer network.m.Unlock()
+
+	ep, ok := network.endpoints[eid]
+	if !ok {
+		return fmt.Errorf("Endpoint %s not found", eid)
+	}
+	if ep.netFilter == nil {
+		return fmt.Errorf("Endpoint %s is not joined", eid)
+	}
+	if config != nil && network.dataplane.SharesHostLink() {
+		return errNoIngressFiltering
+	}
+
+	previous := ep.netFilter.String()
+	if err := replaceFiltering(ep, config); err != nil {
+		return fmt.Errorf("Endpoint %s keeps its previous ingress policy %s: %v", eid, previous, err)
+	}
+	ep.defaultPolicy = false
+	log.Infof("SetEndpointPolicy: Endpoint %s ingress %s", eid, ep.netFilter)
+	return nil
+}
+
+// defaultPolicy is the ingress filtering of the endpoints not given their
+// own.
+type defaultPolicy struct {
+	config *netFilterConfig
+	m      sync.Mutex
+}
+
+func (p *defaultPolicy) get() *netFilterConfig {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.config
+}
+
+// SetDefaultPolicy sets the comma separated IPs, CIDRs and IP ranges allowed
+// to reach the endpoints not given their own policy, or allows any source
+// when allowed is empty. It is applied to the joined endpoints following the
+// default policy and not already filtered by it, so that setting the same
+// policy again, as a reload does, leaves their chains alone.
+func (d *NetDriver) SetDefaultPolicy(allowed string) error {
+	config, err := NetFilterConfigParse(allowed)
+	if err != nil {
+		return err
+	}
+
+	networks := d.allNetworks()
+	for _, network := range networks {
+		if config != nil && network.dataplane.SharesHostLink() {
+			return fmt.Errorf("Default ingress policy not set on network %s: %v", network.id, errNoIngressFiltering)
+		}
+	}
+
+	d.policy.m.Lock()
+	d.policy.config = config
+	d.policy.m.Unlock()
+	log.Infof("SetDefaultPolicy: Default ingress %s", (&netFilter{config: config}).String())
+
+	var failed []string
+	for _, network := range networks {
+		failed = append(failed, d.applyDefaultPolicy(network, config)...)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Default policy not applied to endpoints %s, their previous policy is still in force", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// applyDefaultPolicy replaces the filtering of the joined endpoints of a
+// network following the default policy, and returns those it failed on.
+func (d *NetDriver) applyDefaultPolicy(network *routedNetwork, config *netFilterConfig) []string {
+	network.m.Lock()
+	defer network.m.Unlock()
+
+	policy := (&netFilter{config: config}).String()
+	var failed []string
+	for eid, ep := range network.endpoints {
+		if ep.netFilter == nil || !ep.defaultPolicy || ep.netFilter.String() == policy {
+			continue
+		}
+		if err := replaceFiltering(ep, config); err != nil {
+			log.Errorf("SetDefaultPolicy: Couldn't apply default policy to endpoint %s: %v", eid, err)
+			failed = append(failed, eid)
+		}
+	}
+	return failed
+}
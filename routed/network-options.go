@@ -0,0 +1,236 @@
+package routed
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+const (
+	gatewayLabel     = labelPrefix + "gateway"
+	gatewayModeLabel = labelPrefix + "gateway-mode"
+	mtuLabel         = labelPrefix + "mtu"
+	vethPrefixLabel  = labelPrefix + "vethprefix"
+	metricLabel      = labelPrefix + "metric"
+	profileLabel     = labelPrefix + "profile"
+
+	// The host answers ARP requests for the gateway with proxy_arp
+	GatewayProxyArp = "proxy-arp"
+	// The gateway is a link-local address put on each host veth, and a
+	// permanent neighbor in each container
+	GatewayLinkLocal = "link-local"
+
+	// LinkLocalGateway is the gateway of link-local mode unless set
+	LinkLocalGateway = "169.254.1.1"
+
+	minMtu = 68
+	maxMtu = 65535
+
+	// Host veth names are the prefix, 4 characters of the endpoint id and
+	// random characters, at most 12 in total
+	maxVethPrefixLen = 7
+
+	// Leaves room for the drain metric on top of it
+	maxRouteMetric = 65535
+)
+
+func parseGateway(value string) (net.IP, error) {
+	ip := net.ParseIP(value)
+	if ip == nil || ip.To4() == nil {
+		return nil, fmt.Errorf("Invalid gateway %s", value)
+	}
+	return ip.To4(), nil
+}
+
+var linkLocalNet = &net.IPNet{IP: net.IPv4(169, 254, 0, 0), Mask: net.CIDRMask(16, 32)}
+
+// checkGatewayMode validates a gateway mode and the gateway it is used with.
+func checkGatewayMode(mode string, gateway string) error {
+	switch mode {
+	case GatewayProxyArp:
+		return nil
+	case GatewayLinkLocal:
+		if gw := net.ParseIP(gateway); gw == nil || !linkLocalNet.Contains(gw) {
+			return fmt.Errorf("Gateway %s of %s mode must be in %s", gateway, GatewayLinkLocal, linkLocalNet)
+		}
+		return nil
+	}
+	return fmt.Errorf("Invalid gateway mode %s", mode)
+}
+
+func parseVethPrefix(value string) (string, error) {
+	if len(value) == 0 || len(value) > maxVethPrefixLen {
+		return "", fmt.Errorf("Invalid veth prefix %s, must have 1 to %d characters", value, maxVethPrefixLen)
+	}
+	for _, c := range value {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return "", fmt.Errorf("Invalid veth prefix %s, must be letters, digits, - or _", value)
+		}
+	}
+	return value, nil
+}
+
+func parseMtu(value string) (int, error) {
+	mtu, err := strconv.Atoi(value)
+	if err != nil || mtu < minMtu || mtu > maxMtu {
+		return 0, fmt.Errorf("Invalid mtu %s, must be %d to %d", value, minMtu, maxMtu)
+	}
+	return mtu, nil
+}
+
+func parseMetric(value string) (int, error) {
+	metric, err := strconv.Atoi(value)
+	if err != nil || metric < 0 || metric > maxRouteMetric {
+		return 0, fmt.Errorf("Invalid route metric %s, must be 0 to %d", value, maxRouteMetric)
+	}
+	return metric, nil
+}
+
+// checkNetworkLabels validates network options without creating the
+// network, as given in a network profile.
+func checkNetworkLabels(labels map[string]string) error {
+	if value, ok := labels[gatewayLabel]; ok {
+		if _, err := parseGateway(value); err != nil {
+			return err
+		}
+	}
+	if value, ok := labels[gatewayModeLabel]; ok && value != GatewayProxyArp && value != GatewayLinkLocal {
+		return fmt.Errorf("Invalid gateway mode %s", value)
+	}
+	if value, ok := labels[mtuLabel]; ok {
+		if _, err := parseMtu(value); err != nil {
+			return err
+		}
+	}
+	if value, ok := labels[vethPrefixLabel]; ok {
+		if _, err := parseVethPrefix(value); err != nil {
+			return err
+		}
+	}
+	if value, ok := labels[metricLabel]; ok {
+		if _, err := parseMetric(value); err != nil {
+			return err
+		}
+	}
+	if value, ok := labels[dataplaneLabel]; ok && value != vethDataplane && value != ipvlanDataplane {
+		return fmt.Errorf("Unknown dataplane %s", value)
+	}
+	return nil
+}
+
+// networkProfiles are named sets of network options, which networks
+// select with the profile option.
+type networkProfiles struct {
+	profiles map[string]map[string]string
+	m        sync.Mutex
+}
+
+// apply returns labels completed with the options of the profile they
+// select. Options given to the network take precedence.
+func (p *networkProfiles) apply(labels map[string]string) (map[string]string, error) {
+	name, ok := labels[profileLabel]
+	if !ok {
+		return labels, nil
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+	profile, ok := p.profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown network profile %s", name)
+	}
+	merged := make(map[string]string)
+	for key, value := range profile {
+		merged[key] = value
+	}
+	for key, value := range labels {
+		merged[key] = value
+	}
+	return merged, nil
+}
+
+// SetNetworkProfiles replaces the network profiles, by name. They apply to
+// the networks created afterwards.
+func (d *NetDriver) SetNetworkProfiles(profiles map[string]map[string]string) error {
+	for name, labels := range profiles {
+		if err := checkNetworkLabels(labels); err != nil {
+			return fmt.Errorf("Invalid network profile %s: %v", name, err)
+		}
+	}
+
+	d.profiles.m.Lock()
+	defer d.profiles.m.Unlock()
+	d.profiles.profiles = profiles
+	return nil
+}
+
+// newRoutedNetwork creates the network id with the settings given in its
+// driver options, or in the profile they select, defaulting to those of the
+// driver.
+func (d *NetDriver) newRoutedNetwork(id string, labels map[string]string) (*routedNetwork, error) {
+	labels, err := d.profiles.apply(labels)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &routedNetwork{
+		id:          id,
+		gateway:     d.gateway,
+		gatewayMode: d.gatewayMode,
+		mtu:         d.mtu,
+		vethPrefix:  vethPrefix,
+		endpoints:   make(map[string]*routedEndpoint),
+	}
+
+	if value, ok := labels[gatewayModeLabel]; ok {
+		n.gatewayMode = value
+		if value == GatewayLinkLocal && d.gatewayMode != GatewayLinkLocal {
+			n.gateway = LinkLocalGateway
+		}
+	}
+	if value, ok := labels[gatewayLabel]; ok {
+		gw, err := parseGateway(value)
+		if err != nil {
+			return nil, err
+		}
+		n.gateway = gw.String()
+	}
+	if err := checkGatewayMode(n.gatewayMode, n.gateway); err != nil {
+		return nil, err
+	}
+	if value, ok := labels[mtuLabel]; ok {
+		mtu, err := parseMtu(value)
+		if err != nil {
+			return nil, err
+		}
+		n.mtu = mtu
+	}
+	if value, ok := labels[vethPrefixLabel]; ok {
+		prefix, err := parseVethPrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		n.vethPrefix = prefix
+	}
+	if value, ok := labels[metricLabel]; ok {
+		metric, err := parseMetric(value)
+		if err != nil {
+			return nil, err
+		}
+		n.metric = metric
+	}
+
+	dataplane, err := newDataplane(d.nl, id, n.vethPrefix, labels)
+	if err != nil {
+		return nil, err
+	}
+	if n.gatewayMode == GatewayLinkLocal && !dataplane.SetsMac() {
+		return nil, fmt.Errorf("The %s gateway mode needs the %s dataplane", GatewayLinkLocal, vethDataplane)
+	}
+	if dataplane.SharesHostLink() && d.policy.get() != nil {
+		return nil, errNoIngressFiltering
+	}
+	n.dataplane = dataplane
+	return n, nil
+}
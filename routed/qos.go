@@ -0,0 +1,280 @@
+package routed
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	egressRateLabel  = labelPrefix + "egress-rate"
+	ingressRateLabel = labelPrefix + "ingress-rate"
+	dscpLabel        = labelPrefix + "dscp"
+
+	// Smallest bucket of the rate limits, in bytes
+	minBurst = 15000
+	// Queueing delay of traffic to a rate limited container
+	tbfLatency = "50ms"
+	// Handle of the u32 filter policing traffic from a container
+	policeHandle = "800::800"
+)
+
+var rateUnits = []struct {
+	suffix string
+	bits   float64
+}{
+	// Longest suffixes first
+	{"kbps", 8e3}, {"mbps", 8e6}, {"gbps", 8e9},
+	{"kbit", 1e3}, {"mbit", 1e6}, {"gbit", 1e9},
+	{"bps", 8}, {"bit", 1},
+}
+
+var dscpClasses = map[string]int{
+	"cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14,
+	"af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30,
+	"af41": 34, "af42": 36, "af43": 38,
+	"ef": 46,
+}
+
+// qosConfig limits the traffic of an endpoint on its host veth.
+type qosConfig struct {
+	// Bits per second sent by the container, 0 for no limit
+	egressRate uint64
+	// Bits per second sent to the container, 0 for no limit
+	ingressRate uint64
+	// DSCP set on the traffic sent by the container, -1 to leave it
+	dscp int
+}
+
+// parseRate reads a rate in the units of tc, e.g. 10mbit or 500kbps.
+func parseRate(value string) (uint64, error) {
+	lower := strings.ToLower(value)
+	for _, unit := range rateUnits {
+		if !strings.HasSuffix(lower, unit.suffix) {
+			continue
+		}
+		n, err := strconv.ParseFloat(strings.TrimSuffix(lower, unit.suffix), 64)
+		if err != nil || n <= 0 {
+			break
+		}
+		return uint64(n * unit.bits), nil
+	}
+	return 0, fmt.Errorf("Invalid rate %s, expected e.g. 10mbit or 500kbps", value)
+}
+
+// parseDscp reads a DSCP value, 0 to 63, or class name such as af41 or ef.
+func parseDscp(value string) (int, error) {
+	if dscp, ok := dscpClasses[strings.ToLower(value)]; ok {
+		return dscp, nil
+	}
+	dscp, err := strconv.Atoi(value)
+	if err != nil || dscp < 0 || dscp > 63 {
+		return 0, fmt.Errorf("Invalid DSCP %s, expected 0 to 63 or a class such as af41 or ef", value)
+	}
+	return dscp, nil
+}
+
+// parseQos reads the traffic limits of an endpoint from its labels:
+// routed.egress-rate, routed.ingress-rate and routed.dscp.
+func parseQos(labels map[string]string) (*qosConfig, error) {
+	q := &qosConfig{dscp: -1}
+
+	var err error
+	if value, ok := labels[egressRateLabel]; ok && value != "" {
+		if q.egressRate, err = parseRate(value); err != nil {
+			return nil, err
+		}
+	}
+	if value, ok := labels[ingressRateLabel]; ok && value != "" {
+		if q.ingressRate, err = parseRate(value); err != nil {
+			return nil, err
+		}
+	}
+	if value, ok := labels[dscpLabel]; ok && value != "" {
+		if q.dscp, err = parseDscp(value); err != nil {
+			return nil, err
+		}
+	}
+
+	if q.egressRate == 0 && q.ingressRate == 0 && q.dscp < 0 {
+		return nil, nil
+	}
+	return q, nil
+}
+
+func (q *qosConfig) String() string {
+	if q == nil {
+		return "none"
+	}
+	var limits []string
+	if q.egressRate > 0 {
+		limits = append(limits, fmt.Sprintf("egress %dbit", q.egressRate))
+	}
+	if q.ingressRate > 0 {
+		limits = append(limits, fmt.Sprintf("ingress %dbit", q.ingressRate))
+	}
+	if q.dscp >= 0 {
+		limits = append(limits, fmt.Sprintf("dscp %d", q.dscp))
+	}
+	return strings.Join(limits, ", ")
+}
+
+func burst(rate uint64) string {
+	// 20ms of traffic
+	b := rate / 8 / 50
+	if b < minBurst {
+		b = minBurst
+	}
+	return strconv.FormatUint(b, 10)
+}
+
+func runTc(tc TrafficControl, args ...string) error {
+	log.Debugf("runTc: tc %s", args)
+	if output, err := tc.Tc(args...); err != nil {
+		return fmt.Errorf("tc %s failed: %s %v", strings.Join(args, " "), output, err)
+	}
+	return nil
+}
+
+func dscpRule(action string, iface string, dscp int) []string {
+	return []string{"-t", "mangle", action, "PREROUTING", "-i", iface, "-j", "DSCP", "--set-dscp", strconv.Itoa(dscp)}
+}
+
+// applyQos sets up the limits of q on the host veth iface. Traffic the
+// container sends is received by the veth: it is policed and marked there.
+// Traffic to the container is shaped when the veth sends it. Limits already
+// set are replaced in place, so that applying again is harmless.
+func applyQos(tc TrafficControl, fw Firewall, iface string, q *qosConfig) error {
+	if q == nil {
+		return nil
+	}
+
+	if q.ingressRate > 0 {
+		rate := fmt.Sprintf("%dbit", q.ingressRate)
+		if err := runTc(tc, "qdisc", "replace", "dev", iface, "root", "tbf",
+			"rate", rate, "burst", burst(q.ingressRate), "latency", tbfLatency); err != nil {
+			return err
+		}
+	}
+	if q.egressRate > 0 {
+		rate := fmt.Sprintf("%dbit", q.egressRate)
+		if err := runTc(tc, "qdisc", "replace", "dev", iface, "ingress"); err != nil {
+			return err
+		}
+		// A fixed handle lets the policing filter be replaced
+		if err := runTc(tc, "filter", "replace", "dev", iface, "parent", "ffff:", "protocol", "all",
+			"pref", "1", "handle", policeHandle, "u32", "match", "u32", "0", "0", "police", "rate", rate, "burst", burst(q.egressRate),
+			"drop", "flowid", ":1"); err != nil {
+			return err
+		}
+	}
+	if q.dscp >= 0 {
+		if _, err := fw.Raw(dscpRule("-C", iface, q.dscp)...); err != nil {
+			if err := applyIpTablesRule(fw, dscpRule("-A", iface, q.dscp)...); err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Infof("applyQos: Limited %s to %s", iface, q)
+	return nil
+}
+
+// removeQos takes down the limits of q on the host veth iface, going on
+// after errors so that as much as possible is removed.
+func removeQos(tc TrafficControl, fw Firewall, iface string, q *qosConfig) error {
+	if q == nil {
+		return nil
+	}
+
+	var errs []string
+	if q.ingressRate > 0 {
+		if err := runTc(tc, "qdisc", "del", "dev", iface, "root"); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if q.egressRate > 0 {
+		if err := runTc(tc, "qdisc", "del", "dev", iface, "ingress"); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if q.dscp >= 0 {
+		if err := applyIpTablesRule(fw, dscpRule("-D", iface, q.dscp)...); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// qosOnly returns the limits of q that other doesn't set.
+func qosOnly(q *qosConfig, other *qosConfig) *qosConfig {
+	if q == nil || other == nil {
+		return q
+	}
+	only := &qosConfig{dscp: -1}
+	if q.ingressRate > 0 && other.ingressRate == 0 {
+		only.ingressRate = q.ingressRate
+	}
+	if q.egressRate > 0 && other.egressRate == 0 {
+		only.egressRate = q.egressRate
+	}
+	if q.dscp >= 0 && q.dscp != other.dscp {
+		only.dscp = q.dscp
+	}
+	return only
+}
+
+// SetEndpointQos changes the traffic limits of an endpoint, given as for its
+// labels. Empty values remove a limit.
+func (d *NetDriver) SetEndpointQos(eid string, egressRate string, ingressRate string, dscp string) error {
+	q, err := parseQos(map[string]string{
+		egressRateLabel:  egressRate,
+		ingressRateLabel: ingressRate,
+		dscpLabel:        dscp,
+	})
+	if err != nil {
+		return err
+	}
+
+	network, err := d.endpointNetwork(eid)
+	if err != nil {
+		return err
+	}
+
+	network.m.Lock()
+	defer network.m.Unlock()
+
+	ep, ok := network.endpoints[eid]
+	if !ok {
+		return fmt.Errorf("Endpoint %s not found", eid)
+	}
+	if q != nil && network.dataplane.SharesHostLink() {
+		return fmt.Errorf("Traffic limits need the %s dataplane", vethDataplane)
+	}
+
+	if iface := ep.hostInterfaceName; iface != "" {
+		// The new limits replace the old ones in place, those no longer
+		// wanted are removed once the new ones are set
+		if err := applyQos(d.tc, d.fw, iface, q); err != nil {
+			removeQos(d.tc, d.fw, iface, qosOnly(q, ep.qos))
+			if err := applyQos(d.tc, d.fw, iface, ep.qos); err != nil {
+				log.Errorf("SetEndpointQos: Couldn't restore limits of %s: %v", iface, err)
+			}
+			return fmt.Errorf("Endpoint %s keeps its previous limits %s: %v", eid, ep.qos, err)
+		}
+		if err := removeQos(d.tc, d.fw, iface, qosOnly(ep.qos, q)); err != nil {
+			log.Warnf("SetEndpointQos: Couldn't remove limits of %s: %v", iface, err)
+		}
+	}
+	ep.qos = q
+	log.Infof("SetEndpointQos: Endpoint %s limited to %s", eid, q)
+	return nil
+}
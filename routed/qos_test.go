@@ -0,0 +1,106 @@
+package routed
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+
+	netApi "github.com/docker/go-plugins-helpers/network"
+)
+
+func TestParseQos(t *testing.T) {
+	for value, rate := range map[string]uint64{
+		"10mbit":  10000000,
+		"1.5Gbit": 1500000000,
+		"500kbps": 4000000,
+		"800bit":  800,
+	} {
+		if r, err := parseRate(value); err != nil || r != rate {
+			t.Fatalf("TestParseQos failed: rate %s parsed as %d %v", value, r, err)
+		}
+	}
+	for _, value := range []string{"10", "fast", "-1mbit", "0kbit"} {
+		if _, err := parseRate(value); err == nil {
+			t.Fatalf("TestParseQos failed: accepted rate %s", value)
+		}
+	}
+
+	if dscp, err := parseDscp("EF"); err != nil || dscp != 46 {
+		t.Fatalf("TestParseQos failed: dscp ef parsed as %d %v", dscp, err)
+	}
+	if _, err := parseDscp("64"); err == nil {
+		t.Fatalf("TestParseQos failed: accepted dscp 64")
+	}
+
+	if q, err := parseQos(map[string]string{}); q != nil || err != nil {
+		t.Fatalf("TestParseQos failed: limits without labels %+v %v", q, err)
+	}
+}
+
+func TestEndpointQos(t *testing.T) {
+	netID := "c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c"
+	eID := "4b50fb7f12adb0da3e6662148e9b1bc43b507ad2fd8a0f187ff297cbc88aee05"
+
+	fw := newFakeIptables()
+	tc := newFakeTc()
+	d, _ := newNetDriver(newFakeNetlink(), fw, newFakeSysctls(), tc, "0.1", "10.100.0.1", 1500, "")
+	d.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: netID})
+
+	_, err := d.CreateEndpoint(&netApi.CreateEndpointRequest{
+		NetworkID:  netID,
+		EndpointID: eID,
+		Interface:  &netApi.EndpointInterface{Address: "10.1.0.2/32"},
+		Options: map[string]interface{}{
+			"routed.egress-rate":  "10mbit",
+			"routed.ingress-rate": "100mbit",
+			"routed.dscp":         "af41",
+		},
+	})
+	if err != nil {
+		t.Fatalf("TestEndpointQos failed: CreateEndpoint %v", err)
+	}
+	if _, err := d.Join(&netApi.JoinRequest{NetworkID: netID, EndpointID: eID}); err != nil {
+		t.Fatalf("TestEndpointQos failed: Join %v", err)
+	}
+
+	iface := d.networks[netID].endpoints[eID].hostInterfaceName
+	if root := tc.qdiscs[iface]["root"]; !strings.HasPrefix(root, "tbf rate 100000000bit burst 250000") {
+		t.Fatalf("TestEndpointQos failed: wrong root qdisc %q", root)
+	}
+	if filters := tc.filters[iface]; len(filters) != 1 || !strings.Contains(filters[0], "police rate 10000000bit") {
+		t.Fatalf("TestEndpointQos failed: wrong ingress filters %q", filters)
+	}
+	if rules := fw.chains["mangle/PREROUTING"]; len(rules) != 1 || rules[0] != "-i "+iface+" -j DSCP --set-dscp 34" {
+		t.Fatalf("TestEndpointQos failed: wrong marking rules %q", rules)
+	}
+
+	// A change failing halfway leaves the previous limits
+	fw.failWith("-A", syscall.EPERM)
+	if err := d.SetEndpointQos(eID, "10mbit", "50mbit", "ef"); err == nil || !strings.Contains(err.Error(), "keeps its previous limits") {
+		t.Fatalf("TestEndpointQos failed: SetEndpointQos %v", err)
+	}
+	if root := tc.qdiscs[iface]["root"]; !strings.HasPrefix(root, "tbf rate 100000000bit") || len(tc.filters[iface]) != 1 ||
+		len(fw.chains["mangle/PREROUTING"]) != 1 || d.networks[netID].endpoints[eID].qos.dscp != 34 {
+		t.Fatalf("TestEndpointQos failed: previous limits not kept %q %q", root, fw.chains["mangle/PREROUTING"])
+	}
+	fw.failWith("-A", nil)
+
+	if err := d.SetEndpointQos(eID, "", "", "ef"); err != nil {
+		t.Fatalf("TestEndpointQos failed: SetEndpointQos %v", err)
+	}
+	if len(tc.qdiscs[iface]) != 0 || len(tc.filters[iface]) != 0 {
+		t.Fatalf("TestEndpointQos failed: qdiscs left %+v %+v", tc.qdiscs[iface], tc.filters[iface])
+	}
+	if rules := fw.chains["mangle/PREROUTING"]; len(rules) != 1 || rules[0] != "-i "+iface+" -j DSCP --set-dscp 46" {
+		t.Fatalf("TestEndpointQos failed: wrong marking rules %q", rules)
+	}
+	if err := d.SetEndpointQos(eID, "1tbit/s", "", ""); err == nil {
+		t.Fatalf("TestEndpointQos failed: accepted invalid rate")
+	}
+
+	d.Leave(&netApi.LeaveRequest{NetworkID: netID, EndpointID: eID})
+	d.DeleteEndpoint(&netApi.DeleteEndpointRequest{NetworkID: netID, EndpointID: eID})
+	if rules := fw.chains["mangle/PREROUTING"]; len(rules) != 0 {
+		t.Fatalf("TestEndpointQos failed: marking rules left %q", rules)
+	}
+}
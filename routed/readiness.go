@@ -0,0 +1,246 @@
+package routed
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	readinessTCPLabel      = labelPrefix + "readiness.tcp"
+	readinessHTTPLabel     = labelPrefix + "readiness.http"
+	readinessIntervalLabel = labelPrefix + "readiness.interval"
+	readinessTimeoutLabel  = labelPrefix + "readiness.timeout"
+	readinessFailuresLabel = labelPrefix + "readiness.failures"
+
+	defaultReadinessInterval = 2 * time.Second
+	defaultReadinessTimeout  = time.Second
+	defaultReadinessFailures = 3
+
+	// Metric of the route the host probes a container over, so that it can
+	// be next to the announced route while one replaces the other.
+	probeRouteMetric = 8192
+)
+
+// readinessProbe checks that the application of an endpoint accepts
+// connections, either on a TCP port or answering an HTTP GET on a path.
+type readinessProbe struct {
+	port     int
+	path     string
+	interval time.Duration
+	timeout  time.Duration
+	failures int
+}
+
+// parseReadinessProbe reads the probe of an endpoint from its labels:
+// routed.readiness.tcp=<port> or routed.readiness.http=<port>/<path>, and
+// optionally routed.readiness.interval, .timeout and .failures.
+func parseReadinessProbe(labels map[string]string) (*readinessProbe, error) {
+	p := &readinessProbe{
+		interval: defaultReadinessInterval,
+		timeout:  defaultReadinessTimeout,
+		failures: defaultReadinessFailures,
+	}
+
+	port := labels[readinessTCPLabel]
+	if target, ok := labels[readinessHTTPLabel]; ok {
+		if port != "" {
+			return nil, fmt.Errorf("Only one of %s and %s can be set", readinessTCPLabel, readinessHTTPLabel)
+		}
+		p.path = "/"
+		port = target
+		if idx := strings.Index(target, "/"); idx >= 0 {
+			port, p.path = target[:idx], target[idx:]
+		}
+	}
+	if port == "" {
+		return nil, nil
+	}
+
+	var err error
+	if p.port, err = strconv.Atoi(port); err != nil || p.port <= 0 || p.port > 65535 {
+		return nil, fmt.Errorf("Invalid readiness probe port %s", port)
+	}
+	if value, ok := labels[readinessIntervalLabel]; ok {
+		if p.interval, err = time.ParseDuration(value); err != nil || p.interval <= 0 {
+			return nil, fmt.Errorf("Invalid readiness probe interval %s", value)
+		}
+	}
+	if value, ok := labels[readinessTimeoutLabel]; ok {
+		if p.timeout, err = time.ParseDuration(value); err != nil || p.timeout <= 0 {
+			return nil, fmt.Errorf("Invalid readiness probe timeout %s", value)
+		}
+	}
+	if value, ok := labels[readinessFailuresLabel]; ok {
+		if p.failures, err = strconv.Atoi(value); err != nil || p.failures <= 0 {
+			return nil, fmt.Errorf("Invalid readiness probe failures %s", value)
+		}
+	}
+	return p, nil
+}
+
+func (p *readinessProbe) String() string {
+	if p.path != "" {
+		return fmt.Sprintf("http %d%s", p.port, p.path)
+	}
+	return fmt.Sprintf("tcp %d", p.port)
+}
+
+// check runs the probe from the host against ip.
+func (p *readinessProbe) check(ip net.IP) error {
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(p.port))
+	conn, err := net.DialTimeout("tcp", addr, p.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if p.path == "" {
+		return nil
+	}
+
+	// The request is written on the connection by hand so that one
+	// deadline bounds the whole probe
+	conn.SetDeadline(time.Now().Add(p.timeout))
+	req, err := http.NewRequest("GET", "http://"+addr+p.path, nil)
+	if err != nil {
+		return err
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 400 {
+		return fmt.Errorf("http status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// probe runs the readiness probe of an endpoint until stop is closed,
+// announcing its route when the probe succeeds and withdrawing it when the
+// probe fails too many times in a row.
+func (d *NetDriver) probe(nid string, eid string, ep *routedEndpoint, stop chan struct{}) {
+	p := ep.readiness
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := p.check(ep.ipv4Address.IP)
+		if err == nil {
+			failures = 0
+		} else {
+			failures++
+			log.Debugf("probe: %s probe %s of %s failed: %v", eid, p, ep.ipv4Address, err)
+		}
+
+		if err == nil || failures >= p.failures {
+			d.setReady(nid, eid, stop, err == nil)
+		}
+	}
+}
+
+// setReady announces or withdraws the route of an endpoint of the network
+// nid following the result of its readiness probe.
+func (d *NetDriver) setReady(nid string, eid string, stop chan struct{}, ready bool) {
+	network, err := d.getNetwork(nid)
+	if err != nil {
+		return
+	}
+
+	network.m.Lock()
+	defer network.m.Unlock()
+
+	ep, ok := network.endpoints[eid]
+	if !ok || !ep.joined || ep.stopProbe != stop || ep.ready == ready {
+		return
+	}
+
+	link, err := d.nl.LinkByName(ep.hostInterfaceName)
+	if err != nil {
+		log.Errorf("setReady: Can't find host interface %s: %v", ep.hostInterfaceName, err)
+		return
+	}
+
+	if ready {
+		ep.ready = true
+		if wait := d.dampening.announce(ep.ipv4Address.String()); wait > 0 && !ep.suppressed {
+			ep.suppressed = true
+			d.scheduleAnnounce(nid, eid, wait)
+		}
+		if ep.routable() {
+			if err := d.announceRoute(network, ep, link); err != nil {
+				ep.ready = false
+				return
+			}
+		}
+		log.Infof("setReady: Endpoint %s passed readiness probe %s", eid, ep.readiness)
+		return
+	}
+
+	routed := ep.routable()
+	ep.ready = false
+	if routed {
+		// Keeps probing over a route of its own
+		if err := d.nl.RouteAdd(d.probeRoute(network, ep.ipv4Address, link)); err != nil {
+			log.Errorf("setReady: Unable to add probe route to %s: %v", ep.ipv4Address, err)
+		}
+		if err := d.nl.RouteDel(d.hostRoute(network, ep.ipv4Address, link)); err != nil {
+			log.Errorf("setReady: Unable to delete route to %s: %v", ep.ipv4Address, err)
+		}
+		d.dampening.withdrawn(ep.ipv4Address.String())
+	}
+	log.Warnf("setReady: Endpoint %s failed readiness probe %s, withdrew route to %s", eid, ep.readiness, ep.ipv4Address)
+}
+
+// probeRoute builds the route the host reaches a container over while its
+// readiness probe has not passed. Routing daemons don't redistribute routes
+// of the kernel protocol, so the container is not announced yet.
+func (d *NetDriver) probeRoute(network *routedNetwork, ip *net.IPNet, iface netlink.Link) *netlink.Route {
+	route := d.hostRoute(network, ip, iface)
+	route.Protocol = syscall.RTPROT_KERNEL
+	route.Priority += probeRouteMetric
+	return route
+}
+
+// announceRoute installs the host route of an endpoint, then removes the
+// route its readiness probe used, if any. Caller must hold the network lock.
+func (d *NetDriver) announceRoute(network *routedNetwork, ep *routedEndpoint, link netlink.Link) error {
+	if err := d.routeAdd(d.hostRoute(network, ep.ipv4Address, link)); err != nil {
+		return err
+	}
+	if ep.readiness == nil {
+		return nil
+	}
+	if err := d.nl.RouteDel(d.probeRoute(network, ep.ipv4Address, link)); err != nil && err != syscall.ESRCH {
+		log.Warnf("announceRoute: Unable to delete probe route to %s: %v", ep.ipv4Address, err)
+	}
+	return nil
+}
+
+// stopProbing stops the readiness probe of an endpoint, if any. Caller must
+// hold the network lock.
+func (ep *routedEndpoint) stopProbing() {
+	if ep.stopProbe != nil {
+		close(ep.stopProbe)
+		ep.stopProbe = nil
+	}
+}
@@ -0,0 +1,112 @@
+package routed
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	netApi "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/vishvananda/netlink"
+)
+
+func TestReadinessProbe(t *testing.T) {
+	labels := routedLabels(map[string]interface{}{
+		"routed.readiness.http": "8080/healthz",
+		netlabel.GenericData: map[string]interface{}{
+			"routed.readiness.interval": "5s",
+			"other.label":               "ignored",
+		},
+	})
+
+	p, err := parseReadinessProbe(labels)
+	if err != nil || p == nil {
+		t.Fatalf("TestReadinessProbe failed: %v", err)
+	}
+	if p.port != 8080 || p.path != "/healthz" || p.interval != 5*time.Second || p.failures != defaultReadinessFailures {
+		t.Fatalf("TestReadinessProbe failed: wrong probe %+v", p)
+	}
+
+	if p, err := parseReadinessProbe(map[string]string{}); p != nil || err != nil {
+		t.Fatalf("TestReadinessProbe failed: probe without labels %+v %v", p, err)
+	}
+
+	for _, labels := range []map[string]string{
+		{"routed.readiness.tcp": "http"},
+		{"routed.readiness.tcp": "70000"},
+		{"routed.readiness.tcp": "80", "routed.readiness.http": "80/"},
+		{"routed.readiness.tcp": "80", "routed.readiness.failures": "0"},
+	} {
+		if _, err := parseReadinessProbe(labels); err == nil {
+			t.Fatalf("TestReadinessProbe failed: accepted %v", labels)
+		}
+	}
+}
+
+func TestReadinessCheck(t *testing.T) {
+	healthy := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy || r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	tcp := &readinessProbe{port: addr.Port, timeout: time.Second}
+	if err := tcp.check(addr.IP); err != nil {
+		t.Fatalf("TestReadinessCheck failed: tcp %v", err)
+	}
+	get := &readinessProbe{port: addr.Port, path: "/healthz", timeout: time.Second}
+	if err := get.check(addr.IP); err != nil {
+		t.Fatalf("TestReadinessCheck failed: http %v", err)
+	}
+	healthy = false
+	if err := get.check(addr.IP); err == nil {
+		t.Fatalf("TestReadinessCheck failed: accepted status 503")
+	}
+	server.Close()
+	if err := tcp.check(addr.IP); err == nil {
+		t.Fatalf("TestReadinessCheck failed: closed port accepted")
+	}
+}
+
+func TestReadinessRoutes(t *testing.T) {
+	netID := "c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c"
+	eID := "4b50fb7f12adb0da3e6662148e9b1bc43b507ad2fd8a0f187ff297cbc88aee05"
+
+	nl := newFakeNetlink()
+	d, _ := newNetDriver(nl, newFakeIptables(), newFakeSysctls(), newFakeTc(), "0.1", "10.100.0.1", 1500, "")
+	d.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: netID})
+	d.CreateEndpoint(&netApi.CreateEndpointRequest{
+		NetworkID:  netID,
+		EndpointID: eID,
+		Interface:  &netApi.EndpointInterface{Address: "10.1.0.2/32"},
+		Options:    map[string]interface{}{readinessTCPLabel: "8080", readinessIntervalLabel: "1h"},
+	})
+	if _, err := d.Join(&netApi.JoinRequest{NetworkID: netID, EndpointID: eID}); err != nil {
+		t.Fatalf("TestReadinessRoutes failed: Join %v", err)
+	}
+
+	// Until the probe passes the host reaches the container unannounced
+	routes, _ := nl.RouteList(nil, netlink.FAMILY_V4)
+	if len(routes) != 1 || routes[0].Protocol != syscall.RTPROT_KERNEL || routes[0].Priority != probeRouteMetric {
+		t.Fatalf("TestReadinessRoutes failed: wrong routes before probe %+v", routes)
+	}
+
+	stop := d.networks[netID].endpoints[eID].stopProbe
+	d.setReady(netID, eID, stop, true)
+	routes, _ = nl.RouteList(nil, netlink.FAMILY_V4)
+	if len(routes) != 1 || routes[0].Protocol == syscall.RTPROT_KERNEL || routes[0].Priority != 0 {
+		t.Fatalf("TestReadinessRoutes failed: wrong routes once ready %+v", routes)
+	}
+
+	d.setReady(netID, eID, stop, false)
+	routes, _ = nl.RouteList(nil, netlink.FAMILY_V4)
+	if len(routes) != 1 || routes[0].Protocol != syscall.RTPROT_KERNEL {
+		t.Fatalf("TestReadinessRoutes failed: wrong routes after failed probe %+v", routes)
+	}
+}
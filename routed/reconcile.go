@@ -0,0 +1,176 @@
+package routed
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	driftLinkMissing  = "link-missing"
+	driftLinkDown     = "link-down"
+	driftMtu          = "mtu"
+	driftRouteMissing = "route-missing"
+)
+
+// driftCounters counts the differences found between the endpoint table
+// and the kernel state, by kind.
+type driftCounters struct {
+	counts map[string]uint64
+	m      sync.Mutex
+}
+
+func (c *driftCounters) inc(kind string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]uint64)
+	}
+	c.counts[kind]++
+}
+
+func (c *driftCounters) snapshot() map[string]uint64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	counts := make(map[string]uint64, len(c.counts))
+	for kind, count := range c.counts {
+		counts[kind] = count
+	}
+	return counts
+}
+
+func (d *NetDriver) reportDrift(eid string, ep *routedEndpoint, kind string, format string, args ...interface{}) {
+	d.drift.inc(kind)
+	log.WithFields(log.Fields{
+		"event":    "drift",
+		"kind":     kind,
+		"endpoint": eid,
+		"iface":    ep.hostInterfaceName,
+	}).Warnf("Reconcile: "+format, args...)
+}
+
+func (d *NetDriver) hasRoute(link netlink.Link, dst *net.IPNet) (bool, error) {
+	routes, err := d.nl.RouteList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return false, err
+	}
+	for i := range routes {
+		if routes[i].Dst != nil && routes[i].Dst.String() == dst.String() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// reconcileEndpoint brings the host side of a joined endpoint back to the
+// state set up by Join. Caller must hold the network lock.
+func (d *NetDriver) reconcileEndpoint(network *routedNetwork, eid string, ep *routedEndpoint) error {
+	if !ep.joined {
+		return nil
+	}
+
+	link, err := d.nl.LinkByName(ep.hostInterfaceName)
+	if err != nil {
+		// The container side lives in the container namespace, the pair
+		// can't be recreated from here.
+		d.reportDrift(eid, ep, driftLinkMissing, "host interface %s is gone", ep.hostInterfaceName)
+		ep.joined = false
+		return err
+	}
+
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		d.reportDrift(eid, ep, driftLinkDown, "host interface %s is down", ep.hostInterfaceName)
+		if err := d.nl.LinkSetUp(link); err != nil {
+			return fmt.Errorf("could not set link up for host interface %s, %v", ep.hostInterfaceName, err)
+		}
+	}
+
+	if network.mtu != 0 && link.Attrs().MTU != network.mtu {
+		d.reportDrift(eid, ep, driftMtu, "host interface %s has mtu %d", ep.hostInterfaceName, link.Attrs().MTU)
+		if err := d.nl.LinkSetMTU(link, network.mtu); err != nil {
+			return fmt.Errorf("could not set mtu for host interface %s, %v", ep.hostInterfaceName, err)
+		}
+	}
+
+	if !ep.routable() {
+		return nil
+	}
+
+	found, err := d.hasRoute(link, ep.ipv4Address)
+	if err != nil {
+		return fmt.Errorf("could not list routes of host interface %s, %v", ep.hostInterfaceName, err)
+	}
+	if !found {
+		d.reportDrift(eid, ep, driftRouteMissing, "route to %s is gone", ep.ipv4Address)
+		if err := d.routeAdd(d.hostRoute(network, ep.ipv4Address, link)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcile checks the endpoints selected by match, or all of them when
+// match is nil, on every network.
+func (d *NetDriver) reconcile(match func(ep *routedEndpoint) bool) {
+	for _, network := range d.allNetworks() {
+		d.reconcileNetwork(network, match)
+	}
+}
+
+func (d *NetDriver) reconcileNetwork(network *routedNetwork, match func(ep *routedEndpoint) bool) {
+	network.m.Lock()
+	defer network.m.Unlock()
+
+	for eid, ep := range network.endpoints {
+		if match != nil && !match(ep) {
+			continue
+		}
+		if err := d.reconcileEndpoint(network, eid, ep); err != nil {
+			log.Errorf("Reconcile: endpoint %s: %v", eid, err)
+		}
+	}
+}
+
+// Reconcile watches route and link updates and repairs the host routes and
+// interfaces of the joined endpoints, until done is closed.
+func (d *NetDriver) Reconcile(done <-chan struct{}) error {
+	routes := make(chan netlink.RouteUpdate)
+	if err := d.nl.RouteSubscribe(routes, done); err != nil {
+		return fmt.Errorf("Unable to subscribe to route updates: %v", err)
+	}
+
+	links := make(chan netlink.LinkUpdate)
+	if err := d.nl.LinkSubscribe(links, done); err != nil {
+		return fmt.Errorf("Unable to subscribe to link updates: %v", err)
+	}
+
+	d.reconcile(nil)
+
+	for {
+		select {
+		case update, ok := <-routes:
+			if !ok {
+				return nil
+			}
+			if update.Type != syscall.RTM_DELROUTE || update.Dst == nil {
+				continue
+			}
+			dst := update.Dst.String()
+			d.reconcile(func(ep *routedEndpoint) bool {
+				return ep.ipv4Address.String() == dst
+			})
+		case update, ok := <-links:
+			if !ok {
+				return nil
+			}
+			name := update.Link.Attrs().Name
+			d.reconcile(func(ep *routedEndpoint) bool {
+				return ep.hostInterfaceName == name
+			})
+		}
+	}
+}
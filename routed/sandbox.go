@@ -0,0 +1,193 @@
+package routed
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	sandboxSysctlPrefix  = labelPrefix + "sysctl."
+	gatewayNeighborLabel = labelPrefix + "gateway-neighbor"
+	gratuitousArpLabel   = labelPrefix + "gratuitous-arp"
+
+	// Stands for the container interface in sysctl names
+	ifacePlaceholder = ".iface."
+
+	sandboxPollInterval = 100 * time.Millisecond
+	sandboxTimeout      = 10 * time.Second
+)
+
+// sandboxSysctls are the sysctls endpoints may set in their namespace, with
+// the number of integers in their value.
+var sandboxSysctls = map[string]int{
+	"net.ipv4.conf.iface.arp_ignore":   1,
+	"net.ipv4.conf.iface.arp_announce": 1,
+	"net.ipv4.conf.iface.arp_notify":   1,
+	"net.ipv4.tcp_keepalive_time":      1,
+	"net.ipv4.tcp_keepalive_intvl":     1,
+	"net.ipv4.tcp_keepalive_probes":    1,
+	"net.ipv4.tcp_fin_timeout":         1,
+	"net.ipv4.tcp_tw_reuse":            1,
+	"net.ipv4.tcp_syn_retries":         1,
+	"net.ipv4.tcp_max_syn_backlog":     1,
+	"net.ipv4.ip_local_port_range":     2,
+	"net.core.somaxconn":               1,
+}
+
+// sandboxConfig is the configuration of the namespace of an endpoint asked
+// for in its labels.
+type sandboxConfig struct {
+	sysctls         []sysctl
+	gatewayNeighbor bool
+	gratuitousArp   bool
+}
+
+func validSysctlValue(value string, fields int) bool {
+	values := strings.Fields(value)
+	if len(values) != fields {
+		return false
+	}
+	for _, v := range values {
+		if _, err := strconv.Atoi(v); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSandboxConfig reads the namespace settings of an endpoint from its
+// labels: routed.sysctl.<name>=<value> for allowed sysctls, with iface for
+// the container interface, routed.gateway-neighbor and routed.gratuitous-arp.
+func parseSandboxConfig(labels map[string]string) (*sandboxConfig, error) {
+	c := &sandboxConfig{}
+
+	var names []string
+	for key := range labels {
+		if strings.HasPrefix(key, sandboxSysctlPrefix) {
+			names = append(names, strings.TrimPrefix(key, sandboxSysctlPrefix))
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := labels[sandboxSysctlPrefix+name]
+		fields, ok := sandboxSysctls[name]
+		if !ok {
+			return nil, fmt.Errorf("Sysctl %s is not allowed in containers", name)
+		}
+		if !validSysctlValue(value, fields) {
+			return nil, fmt.Errorf("Invalid value %q for sysctl %s", value, name)
+		}
+		c.sysctls = append(c.sysctls, sysctl{name: name, value: strings.Join(strings.Fields(value), " ")})
+	}
+
+	var err error
+	if value, ok := labels[gatewayNeighborLabel]; ok {
+		if c.gatewayNeighbor, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("Invalid %s %s", gatewayNeighborLabel, value)
+		}
+	}
+	if value, ok := labels[gratuitousArpLabel]; ok {
+		if c.gratuitousArp, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("Invalid %s %s", gratuitousArpLabel, value)
+		}
+	}
+
+	if len(c.sysctls) == 0 && !c.gatewayNeighbor && !c.gratuitousArp {
+		return nil, nil
+	}
+	return c, nil
+}
+
+// sandboxSetup is the configuration of the network namespace of an endpoint.
+type sandboxSetup struct {
+	sandboxKey string
+	// MAC address of the container link, which Docker renames
+	mac net.HardwareAddr
+	ip  net.IP
+	// Permanent neighbors on the container link
+	neighs        []*netlink.Neigh
+	sysctls       []sysctl
+	gratuitousArp bool
+}
+
+func (s *sandboxSetup) empty() bool {
+	return len(s.neighs) == 0 && len(s.sysctls) == 0 && !s.gratuitousArp
+}
+
+// sandboxLink returns the container link of an endpoint in its sandbox once
+// Docker configured it, nil while it is not there or not up yet.
+func sandboxLink(sb Sandbox, mac net.HardwareAddr) (netlink.Link, error) {
+	links, err := sb.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		if bytes.Equal(link.Attrs().HardwareAddr, mac) && link.Attrs().Flags&net.FlagUp != 0 {
+			return link, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *sandboxSetup) apply(sb Sandbox, link netlink.Link) error {
+	name := link.Attrs().Name
+	for _, sc := range s.sysctls {
+		sysctlName := strings.Replace(sc.name, ifacePlaceholder, "."+name+".", 1)
+		if err := sb.SetSysctl(sysctlName, sc.value); err != nil {
+			return fmt.Errorf("could not set %s to %s: %v", sysctlName, sc.value, err)
+		}
+	}
+	for _, neigh := range s.neighs {
+		neigh.LinkIndex = link.Attrs().Index
+		if err := sb.NeighSet(neigh); err != nil {
+			return fmt.Errorf("could not set neighbor %s on %s: %v", neigh.IP, name, err)
+		}
+	}
+	if s.gratuitousArp {
+		if err := sb.SendGratuitousArp(link, s.ip); err != nil {
+			return fmt.Errorf("could not send gratuitous ARP for %s on %s: %v", s.ip, name, err)
+		}
+	}
+	return nil
+}
+
+// setupSandbox configures the network namespace of an endpoint. Docker moves
+// the container link into the namespace after Join returned, so this waits
+// for the link to show up.
+func (d *NetDriver) setupSandbox(eid string, s *sandboxSetup) {
+	deadline := time.Now().Add(sandboxTimeout)
+
+	var err error
+	for ; time.Now().Before(deadline); time.Sleep(sandboxPollInterval) {
+		var sb Sandbox
+		if sb, err = d.nl.OpenSandbox(s.sandboxKey); err != nil {
+			continue
+		}
+
+		var link netlink.Link
+		link, err = sandboxLink(sb, s.mac)
+		if err == nil && link != nil {
+			err = s.apply(sb, link)
+			sb.Close()
+			break
+		}
+		sb.Close()
+		if err == nil {
+			err = fmt.Errorf("no link up with MAC %s", s.mac)
+		}
+	}
+
+	if err != nil {
+		log.Errorf("setupSandbox: Couldn't configure sandbox %s of endpoint %s: %v", s.sandboxKey, eid, err)
+		return
+	}
+	log.Infof("setupSandbox: Configured sandbox %s of endpoint %s", s.sandboxKey, eid)
+}
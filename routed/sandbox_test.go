@@ -0,0 +1,107 @@
+package routed
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	netApi "github.com/docker/go-plugins-helpers/network"
+)
+
+func TestSandboxConfig(t *testing.T) {
+	c, err := parseSandboxConfig(map[string]string{"routed.readiness.tcp": "8080"})
+	if c != nil || err != nil {
+		t.Fatalf("TestSandboxConfig failed: config without labels %+v %v", c, err)
+	}
+
+	c, err = parseSandboxConfig(map[string]string{
+		"routed.sysctl.net.ipv4.conf.iface.arp_ignore": "1",
+		"routed.sysctl.net.ipv4.ip_local_port_range":   "20000  30000",
+		"routed.gratuitous-arp":                        "true",
+	})
+	if err != nil || len(c.sysctls) != 2 || !c.gratuitousArp || c.gatewayNeighbor {
+		t.Fatalf("TestSandboxConfig failed: %+v %v", c, err)
+	}
+	if c.sysctls[1].name != "net.ipv4.ip_local_port_range" || c.sysctls[1].value != "20000 30000" {
+		t.Fatalf("TestSandboxConfig failed: wrong sysctls %+v", c.sysctls)
+	}
+
+	for _, labels := range []map[string]string{
+		{"routed.sysctl.net.ipv4.ip_forward": "1"},
+		{"routed.sysctl.net.core.somaxconn": "many"},
+		{"routed.sysctl.net.ipv4.ip_local_port_range": "20000"},
+		{"routed.gateway-neighbor": "sometimes"},
+	} {
+		if _, err := parseSandboxConfig(labels); err == nil {
+			t.Fatalf("TestSandboxConfig failed: accepted %v", labels)
+		}
+	}
+}
+
+func TestGratuitousArp(t *testing.T) {
+	mac, _ := net.ParseMAC("02:42:0a:01:00:02")
+	frame := hex.EncodeToString(gratuitousArp(mac, net.ParseIP("10.1.0.2")))
+	expected := "ffffffffffff02420a010002" + "0806" + "0001080006040001" + "02420a010002" + "0a010002" + "000000000000" + "0a010002"
+	if frame != expected {
+		t.Fatalf("TestGratuitousArp failed: wrong frame %s", frame)
+	}
+}
+
+func TestSandboxSetup(t *testing.T) {
+	netID := "c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c"
+	eID := "4b50fb7f12adb0da3e6662148e9b1bc43b507ad2fd8a0f187ff297cbc88aee05"
+	sandBoxKey := "/var/run/docker/netns/68b0caca5d0c"
+
+	nl := newFakeNetlink()
+	sandbox := nl.addSandbox(sandBoxKey)
+	d, _ := newNetDriver(nl, newFakeIptables(), newFakeSysctls(), newFakeTc(), "0.1", "10.100.0.1", 1500, "")
+	d.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: netID})
+
+	_, err := d.CreateEndpoint(&netApi.CreateEndpointRequest{
+		NetworkID:  netID,
+		EndpointID: eID,
+		Interface:  &netApi.EndpointInterface{Address: "10.1.0.2/32"},
+		Options: map[string]interface{}{
+			"routed.sysctl.net.ipv4.conf.iface.arp_announce": "2",
+			"routed.sysctl.net.core.somaxconn":               "1024",
+			"routed.gateway-neighbor":                        "true",
+			"routed.gratuitous-arp":                          "true",
+		},
+	})
+	if err != nil {
+		t.Fatalf("TestSandboxSetup failed: CreateEndpoint %v", err)
+	}
+
+	res, err := d.Join(&netApi.JoinRequest{NetworkID: netID, EndpointID: eID, SandboxKey: sandBoxKey})
+	if err != nil {
+		t.Fatalf("TestSandboxSetup failed: Join %v", err)
+	}
+	hostIface, _ := nl.LinkByName(d.networks[netID].endpoints[eID].hostInterfaceName)
+
+	// Docker moves the container link after Join
+	nl.moveLink(res.InterfaceName.SrcName, sandbox, "eth1")
+
+	// The gratuitous ARP comes last
+	configured := func() bool {
+		sandbox.m.Lock()
+		defer sandbox.m.Unlock()
+		return len(sandbox.garps) > 0
+	}
+	for i := 0; i < 50 && !configured(); i++ {
+		time.Sleep(sandboxPollInterval)
+	}
+	if neigh := sandbox.findNeigh("10.100.0.1"); neigh == nil ||
+		neigh.HardwareAddr.String() != hostIface.Attrs().HardwareAddr.String() {
+		t.Fatalf("TestSandboxSetup failed: wrong gateway neighbor %+v", neigh)
+	}
+
+	sandbox.m.Lock()
+	defer sandbox.m.Unlock()
+	if sandbox.sysctls["net.ipv4.conf.eth1.arp_announce"] != "2" || sandbox.sysctls["net.core.somaxconn"] != "1024" {
+		t.Fatalf("TestSandboxSetup failed: wrong sysctls %+v", sandbox.sysctls)
+	}
+	if len(sandbox.garps) != 1 || sandbox.garps[0] != "eth1 10.1.0.2" {
+		t.Fatalf("TestSandboxSetup failed: wrong gratuitous ARPs %+v", sandbox.garps)
+	}
+}
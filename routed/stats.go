@@ -0,0 +1,104 @@
+package routed
+
+import (
+	"fmt"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// EndpointStats holds the traffic counters of an endpoint, read from its
+// host link. They are counted on the host side: rx is what the container
+// sent, tx what it received. The vendored netlink reads the 32 bit
+// counters of the link, which wrap around.
+type EndpointStats struct {
+	EndpointID    string `json:"endpoint_id"`
+	Address       string `json:"address"`
+	HostInterface string `json:"host_interface"`
+	RxBytes       uint64 `json:"rx_bytes"`
+	TxBytes       uint64 `json:"tx_bytes"`
+	RxPackets     uint64 `json:"rx_packets"`
+	TxPackets     uint64 `json:"tx_packets"`
+	RxDropped     uint64 `json:"rx_dropped"`
+	TxDropped     uint64 `json:"tx_dropped"`
+	RxErrors      uint64 `json:"rx_errors"`
+	TxErrors      uint64 `json:"tx_errors"`
+}
+
+type byEndpointID []EndpointStats
+
+func (s byEndpointID) Len() int           { return len(s) }
+func (s byEndpointID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byEndpointID) Less(i, j int) bool { return s[i].EndpointID < s[j].EndpointID }
+
+func newEndpointStats(eid string, ep *routedEndpoint, stats *netlink.LinkStatistics) *EndpointStats {
+	return &EndpointStats{
+		EndpointID:    eid,
+		Address:       ep.ipv4Address.IP.String(),
+		HostInterface: ep.hostInterfaceName,
+		RxBytes:       uint64(stats.RxBytes),
+		TxBytes:       uint64(stats.TxBytes),
+		RxPackets:     uint64(stats.RxPackets),
+		TxPackets:     uint64(stats.TxPackets),
+		RxDropped:     uint64(stats.RxDropped),
+		TxDropped:     uint64(stats.TxDropped),
+		RxErrors:      uint64(stats.RxErrors),
+		TxErrors:      uint64(stats.TxErrors),
+	}
+}
+
+// info adds the counters to the endpoint information returned to Docker.
+func (s *EndpointStats) info(value map[string]string) {
+	value["rxBytes"] = fmt.Sprint(s.RxBytes)
+	value["txBytes"] = fmt.Sprint(s.TxBytes)
+	value["rxPackets"] = fmt.Sprint(s.RxPackets)
+	value["txPackets"] = fmt.Sprint(s.TxPackets)
+	value["rxDropped"] = fmt.Sprint(s.RxDropped)
+	value["txDropped"] = fmt.Sprint(s.TxDropped)
+	value["rxErrors"] = fmt.Sprint(s.RxErrors)
+	value["txErrors"] = fmt.Sprint(s.TxErrors)
+}
+
+// readStats reads the counters of an endpoint and keeps them, so the last
+// ones read are still reported once its host link is gone. Returns nil when
+// the endpoint has no link of its own on the host. Caller must hold the
+// network lock.
+func (n *routedNetwork) readStats(eid string, ep *routedEndpoint) *EndpointStats {
+	if ep.hostInterfaceName == "" {
+		return ep.traffic
+	}
+
+	stats, err := n.dataplane.Statistics(ep)
+	if err != nil {
+		log.Warnf("readStats: Couldn't read statistics of %s: %v", ep.hostInterfaceName, err)
+		return ep.traffic
+	}
+	if stats == nil {
+		return nil
+	}
+	ep.traffic = newEndpointStats(eid, ep, stats)
+	return ep.traffic
+}
+
+// EndpointStatistics returns the traffic counters of the endpoints having a
+// link of their own on the host, ordered by endpoint ID.
+func (d *NetDriver) EndpointStatistics() []EndpointStats {
+	networks := d.allNetworks()
+	if len(networks) == 0 {
+		return nil
+	}
+
+	all := []EndpointStats{}
+	for _, network := range networks {
+		network.m.Lock()
+		for eid, ep := range network.endpoints {
+			if s := network.readStats(eid, ep); s != nil {
+				all = append(all, *s)
+			}
+		}
+		network.m.Unlock()
+	}
+	sort.Sort(byEndpointID(all))
+	return all
+}
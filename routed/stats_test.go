@@ -0,0 +1,54 @@
+package routed
+
+import (
+	"testing"
+
+	netApi "github.com/docker/go-plugins-helpers/network"
+	"github.com/vishvananda/netlink"
+)
+
+func TestEndpointStatistics(t *testing.T) {
+	netID := "c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c"
+	eIDs := map[string]string{
+		"9b50fb7f12adb0da3e6662148e9b1bc43b507ad2fd8a0f187ff297cbc88aee05": "10.1.0.3",
+		"4b50fb7f12adb0da3e6662148e9b1bc43b507ad2fd8a0f187ff297cbc88aee05": "10.1.0.2",
+	}
+
+	nl := newFakeNetlink()
+	d, _ := newNetDriver(nl, newFakeIptables(), newFakeSysctls(), newFakeTc(), "0.1", "10.100.0.1", 1500, "")
+
+	if stats := d.EndpointStatistics(); stats != nil {
+		t.Fatalf("TestEndpointStatistics failed: statistics without network %+v", stats)
+	}
+
+	d.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: netID})
+	for eID, address := range eIDs {
+		d.CreateEndpoint(&netApi.CreateEndpointRequest{
+			NetworkID:  netID,
+			EndpointID: eID,
+			Interface:  &netApi.EndpointInterface{Address: address + "/32"},
+		})
+		if _, err := d.Join(&netApi.JoinRequest{NetworkID: netID, EndpointID: eID}); err != nil {
+			t.Fatalf("TestEndpointStatistics failed: Join %v", err)
+		}
+		link, _ := nl.LinkByName(d.networks[netID].endpoints[eID].hostInterfaceName)
+		link.Attrs().Statistics = &netlink.LinkStatistics{RxBytes: 100, TxPackets: 2, RxDropped: 1}
+	}
+
+	stats := d.EndpointStatistics()
+	if len(stats) != 2 || stats[0].Address != "10.1.0.2" || stats[1].Address != "10.1.0.3" {
+		t.Fatalf("TestEndpointStatistics failed: wrong endpoints %+v", stats)
+	}
+	if s := stats[0]; s.RxBytes != 100 || s.TxPackets != 2 || s.RxDropped != 1 || s.HostInterface == "" {
+		t.Fatalf("TestEndpointStatistics failed: wrong counters %+v", s)
+	}
+
+	// The last counters read are kept once the veth is gone
+	eID := stats[0].EndpointID
+	link, _ := nl.LinkByName(stats[0].HostInterface)
+	nl.LinkDel(link)
+	info, err := d.EndpointInfo(&netApi.InfoRequest{NetworkID: netID, EndpointID: eID})
+	if err != nil || info.Value["rxBytes"] != "100" || info.Value["txPackets"] != "2" {
+		t.Fatalf("TestEndpointStatistics failed: wrong endpoint info %+v %v", info, err)
+	}
+}
@@ -0,0 +1,97 @@
+package routed
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// SysctlCheck refuses to start when a required host sysctl is not set
+	SysctlCheck = "check"
+	// SysctlFix sets the required host sysctls
+	SysctlFix = "fix"
+	// SysctlOff skips checking the host sysctls
+	SysctlOff = "off"
+)
+
+type sysctl struct {
+	name  string
+	value string
+	// Skipped when the kernel doesn't have it
+	optional bool
+}
+
+// hostSysctlProfile is required on the host for routing container traffic.
+var hostSysctlProfile = []sysctl{
+	{name: "net.ipv4.ip_forward", value: "1"},
+}
+
+// vethSysctlProfile is applied to each host veth.
+func vethSysctlProfile(iface string, gatewayMode string) []sysctl {
+	// In link-local mode the veth owns the gateway address
+	proxyArp := "1"
+	if gatewayMode == GatewayLinkLocal {
+		proxyArp = "0"
+	}
+	return []sysctl{
+		{name: "net.ipv4.conf." + iface + ".proxy_arp", value: proxyArp},
+		// Only accept packets from the container address routed to the veth
+		{name: "net.ipv4.conf." + iface + ".rp_filter", value: "1"},
+		// Drop packets claiming to come from the host
+		{name: "net.ipv4.conf." + iface + ".accept_local", value: "0"},
+		// Containers are routed over IPv4 only
+		{name: "net.ipv6.conf." + iface + ".forwarding", value: "0", optional: true},
+	}
+}
+
+func applySysctls(sc Sysctls, settings []sysctl) error {
+	for _, s := range settings {
+		if err := sc.Set(s.name, s.value); err != nil {
+			if s.optional && os.IsNotExist(err) {
+				log.Debugf("applySysctls: Skipping missing %s", s.name)
+				continue
+			}
+			return fmt.Errorf("could not set %s to %s: %v", s.name, s.value, err)
+		}
+	}
+	return nil
+}
+
+// CheckHostSysctls verifies the sysctls the host needs for routing container
+// traffic. In fix mode it sets the ones that are wrong, in check mode it
+// returns an error naming them.
+func (d *NetDriver) CheckHostSysctls(mode string) error {
+	switch mode {
+	case SysctlOff:
+		return nil
+	case SysctlCheck, SysctlFix:
+	default:
+		return fmt.Errorf("Invalid host sysctl mode %s", mode)
+	}
+
+	for _, s := range hostSysctlProfile {
+		value, err := d.sysctl.Get(s.name)
+		if err != nil {
+			if s.optional && os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("Can't read host sysctl %s: %v", s.name, err)
+		}
+		if value == s.value {
+			continue
+		}
+
+		if mode == SysctlCheck {
+			return fmt.Errorf("Host sysctl %s is %s and must be %s: run 'sysctl -w %s=%s' or start with --host-sysctls %s",
+				s.name, value, s.value, s.name, s.value, SysctlFix)
+		}
+		if err := d.sysctl.Set(s.name, s.value); err != nil {
+			return fmt.Errorf("Can't set host sysctl %s to %s: %v", s.name, s.value, err)
+		}
+		log.Warnf("CheckHostSysctls: Changed host sysctl %s from %s to %s", s.name, value, s.value)
+		d.startup.record("Changed host sysctl %s from %s to %s", s.name, value, s.value)
+	}
+	return nil
+}
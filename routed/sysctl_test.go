@@ -0,0 +1,46 @@
+package routed
+
+import (
+	"testing"
+)
+
+func TestHostSysctls(t *testing.T) {
+	sc := newFakeSysctls()
+	sc.values["net.ipv4.ip_forward"] = "0"
+	d, err := newNetDriver(newFakeNetlink(), newFakeIptables(), sc, newFakeTc(), "0.1", "10.100.0.1", 1500, "")
+	if err != nil {
+		t.Fatalf("TestHostSysctls failed: could not create driver - %v", err)
+	}
+
+	if err := d.CheckHostSysctls(SysctlOff); err != nil {
+		t.Fatalf("TestHostSysctls failed: off mode %v", err)
+	}
+	if err := d.CheckHostSysctls(SysctlCheck); err == nil {
+		t.Fatalf("TestHostSysctls failed: check mode accepted ip_forward 0")
+	}
+	if err := d.CheckHostSysctls(SysctlFix); err != nil || sc.values["net.ipv4.ip_forward"] != "1" {
+		t.Fatalf("TestHostSysctls failed: fix mode %v %v", sc.values, err)
+	}
+	if err := d.CheckHostSysctls(SysctlCheck); err != nil {
+		t.Fatalf("TestHostSysctls failed: check mode %v", err)
+	}
+	if err := d.CheckHostSysctls("ignore"); err == nil {
+		t.Fatalf("TestHostSysctls failed: accepted invalid mode")
+	}
+}
+
+func TestVethSysctls(t *testing.T) {
+	sc := newFakeSysctls()
+	if err := applySysctls(sc, vethSysctlProfile("vethr1234", GatewayProxyArp)); err != nil {
+		t.Fatalf("TestVethSysctls failed: %v", err)
+	}
+	if sc.values["net.ipv4.conf.vethr1234.proxy_arp"] != "1" || sc.values["net.ipv4.conf.vethr1234.rp_filter"] != "1" ||
+		sc.values["net.ipv4.conf.vethr1234.accept_local"] != "0" || sc.values["net.ipv6.conf.vethr1234.forwarding"] != "0" {
+		t.Fatalf("TestVethSysctls failed: wrong values %v", sc.values)
+	}
+
+	if err := applySysctls(sc, vethSysctlProfile("vethr1234", GatewayLinkLocal)); err != nil ||
+		sc.values["net.ipv4.conf.vethr1234.proxy_arp"] != "0" {
+		t.Fatalf("TestVethSysctls failed: link-local mode %v %v", sc.values, err)
+	}
+}
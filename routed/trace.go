@@ -0,0 +1,516 @@
+package routed
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// Origins of the route to a traced address
+	OriginLocal     = "local"
+	OriginPeer      = "peer"
+	OriginHost      = "host"
+	OriginDefault   = "default"
+	OriginBlackhole = "blackhole"
+	OriginNone      = "none"
+
+	// Verdict of the filtering when CONTAINERS lets the traffic through to
+	// the rest of FORWARD
+	VerdictReturn = "RETURN"
+
+	// Jumps followed before giving up on a chain loop
+	maxChainDepth = 16
+)
+
+// Names of the routing protocols, as /etc/iproute2/rt_protos
+var routeProtocols = map[int]string{
+	syscall.RTPROT_REDIRECT: "redirect",
+	syscall.RTPROT_KERNEL:   "kernel",
+	syscall.RTPROT_BOOT:     "boot",
+	syscall.RTPROT_STATIC:   "static",
+	syscall.RTPROT_ZEBRA:    "zebra",
+	syscall.RTPROT_BIRD:     "bird",
+	syscall.RTPROT_DHCP:     "dhcp",
+	aggregatedRouteProto:    "routed",
+	186:                     "bgp",
+	187:                     "isis",
+	188:                     "ospf",
+	189:                     "rip",
+}
+
+// TraceReport is the path the host gives to traffic towards an address:
+// the endpoint having it, the kernel route, the netfilter rules matched and
+// the routes of the container back to the source.
+type TraceReport struct {
+	Destination     string         `json:"destination"`
+	Source          string         `json:"source,omitempty"`
+	Protocol        string         `json:"protocol,omitempty"`
+	Port            int            `json:"port,omitempty"`
+	Endpoint        *EndpointState `json:"endpoint,omitempty"`
+	Route           string         `json:"route,omitempty"`
+	Interface       string         `json:"interface,omitempty"`
+	InterfaceState  string         `json:"interface_state,omitempty"`
+	Origin          string         `json:"origin"`
+	Rules           []string       `json:"rules"`
+	Verdict         string         `json:"verdict,omitempty"`
+	ContainerRoutes []string       `json:"container_routes"`
+	// Problems are what keeps the traffic from reaching the address, Notes
+	// what the trace couldn't tell.
+	Problems []string `json:"problems"`
+	Notes    []string `json:"notes"`
+}
+
+func (r *TraceReport) problem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+func (r *TraceReport) note(format string, args ...interface{}) {
+	r.Notes = append(r.Notes, fmt.Sprintf(format, args...))
+}
+
+// Tracer follows the path of traffic to an address through the host, as
+// done by hand with ip route get, ip link and iptables -S.
+type Tracer struct {
+	nl Netlink
+	fw Firewall
+	// endpoints lists the endpoints of the running plugin
+	endpoints func() ([]EndpointState, error)
+}
+
+// NewTracer returns a tracer of the host, which asks client for the
+// endpoints.
+func NewTracer(client *AdminClient) *Tracer {
+	return newTracer(hostNetlink{}, hostIptables{}, func() ([]EndpointState, error) {
+		networks, err := client.Networks()
+		if err != nil {
+			return nil, err
+		}
+		var endpoints []EndpointState
+		for _, n := range networks {
+			endpoints = append(endpoints, n.Endpoints...)
+		}
+		return endpoints, nil
+	})
+}
+
+func newTracer(nl Netlink, fw Firewall, endpoints func() ([]EndpointState, error)) *Tracer {
+	return &Tracer{nl: nl, fw: fw, endpoints: endpoints}
+}
+
+// lookupRoute returns the most specific route to ip, and of those the one
+// with the lowest metric.
+func lookupRoute(routes []netlink.Route, ip net.IP) *netlink.Route {
+	var best *netlink.Route
+	bestOnes := -1
+	for i := range routes {
+		ones := 0
+		if dst := routes[i].Dst; dst != nil {
+			if !dst.Contains(ip) {
+				continue
+			}
+			ones, _ = dst.Mask.Size()
+		}
+		if ones > bestOnes || (ones == bestOnes && routes[i].Priority < best.Priority) {
+			best = &routes[i]
+			bestOnes = ones
+		}
+	}
+	return best
+}
+
+// formatRoute prints route as ip route does.
+func formatRoute(route *netlink.Route, names map[int]string) string {
+	var fields []string
+	if route.Type == syscall.RTN_BLACKHOLE {
+		fields = append(fields, "blackhole")
+	}
+	if route.Dst == nil {
+		fields = append(fields, "default")
+	} else {
+		fields = append(fields, route.Dst.String())
+	}
+	if route.Gw != nil {
+		fields = append(fields, "via", route.Gw.String())
+	}
+	if route.LinkIndex != 0 {
+		name, ok := names[route.LinkIndex]
+		if !ok {
+			name = fmt.Sprintf("if%d", route.LinkIndex)
+		}
+		fields = append(fields, "dev", name)
+	}
+	if route.Protocol != 0 && route.Protocol != syscall.RTPROT_BOOT {
+		proto, ok := routeProtocols[route.Protocol]
+		if !ok {
+			proto = strconv.Itoa(route.Protocol)
+		}
+		fields = append(fields, "proto", proto)
+	}
+	if route.Src != nil {
+		fields = append(fields, "src", route.Src.String())
+	}
+	if route.Priority != 0 {
+		fields = append(fields, "metric", strconv.Itoa(route.Priority))
+	}
+	return strings.Join(fields, " ")
+}
+
+// linkNames maps the link indexes to their names.
+func linkNames(links []netlink.Link) map[int]string {
+	names := make(map[int]string)
+	for _, link := range links {
+		names[link.Attrs().Index] = link.Attrs().Name
+	}
+	return names
+}
+
+// Trace follows traffic to dst. The source, protocol and port are only used
+// to tell which netfilter rules match, and may be left empty.
+func (t *Tracer) Trace(dst net.IP, src net.IP, proto string, port int) (*TraceReport, error) {
+	if dst.To4() == nil {
+		return nil, fmt.Errorf("Destination %s is not an IPv4 address", dst)
+	}
+	report := &TraceReport{
+		Destination:     dst.String(),
+		Protocol:        proto,
+		Port:            port,
+		Origin:          OriginNone,
+		Rules:           []string{},
+		ContainerRoutes: []string{},
+		Problems:        []string{},
+		Notes:           []string{},
+	}
+	if src != nil {
+		report.Source = src.String()
+	}
+
+	endpoints, err := t.endpoints()
+	if err != nil {
+		report.note("Can't list the endpoints, local endpoints are not recognized: %v", err)
+	}
+	for i := range endpoints {
+		if net.ParseIP(endpoints[i].Address).Equal(dst) {
+			report.Endpoint = &endpoints[i]
+			break
+		}
+	}
+
+	links, err := t.nl.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("Can't list links: %v", err)
+	}
+	names := linkNames(links)
+
+	if err := t.traceRoute(report, dst, links, names); err != nil {
+		return nil, err
+	}
+	if report.Endpoint == nil {
+		if report.Origin == OriginBlackhole {
+			report.problem("%s is in the aggregate of this host but no endpoint has it, traffic is dropped", dst)
+		}
+		return report, nil
+	}
+
+	t.traceFiltering(report, &tracePacket{src: src, dst: dst, proto: proto, port: port, out: report.Interface})
+	t.traceContainer(report, src)
+	return report, nil
+}
+
+// traceRoute finds the route and interface the kernel uses for dst.
+func (t *Tracer) traceRoute(report *TraceReport, dst net.IP, links []netlink.Link, names map[int]string) error {
+	routes, err := t.nl.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("Can't list routes: %v", err)
+	}
+	route := lookupRoute(routes, dst)
+	got, getErr := t.nl.RouteGet(dst)
+	if route == nil {
+		if getErr != nil || len(got) == 0 {
+			report.problem("No route to %s", dst)
+			return nil
+		}
+		// Local addresses and the other tables
+		route = &got[0]
+	}
+	report.Route = formatRoute(route, names)
+
+	// The kernel's choice may differ from the main table with policy routing
+	linkIndex := route.LinkIndex
+	if getErr != nil {
+		if route.Type != syscall.RTN_BLACKHOLE {
+			report.note("The kernel can't resolve the route to %s: %v", dst, getErr)
+		}
+	} else if len(got) > 0 && got[0].LinkIndex != route.LinkIndex {
+		linkIndex = got[0].LinkIndex
+		report.note("The kernel uses %s rather than the main table route %s, check the policy routing rules",
+			names[linkIndex], report.Route)
+	}
+
+	for _, link := range links {
+		if link.Attrs().Index != linkIndex || linkIndex == 0 {
+			continue
+		}
+		report.Interface = link.Attrs().Name
+		if link.Attrs().Flags&net.FlagUp != 0 {
+			report.InterfaceState = "up"
+		} else {
+			report.InterfaceState = "down"
+			report.problem("Interface %s is down", report.Interface)
+		}
+	}
+
+	ep := report.Endpoint
+	switch {
+	case route.Type == syscall.RTN_BLACKHOLE:
+		report.Origin = OriginBlackhole
+	case ep != nil && ep.HostInterface != "" && ep.HostInterface == report.Interface:
+		report.Origin = OriginLocal
+	case route.Dst == nil:
+		report.Origin = OriginDefault
+	case isPeerRoute(route):
+		report.Origin = OriginPeer
+	default:
+		report.Origin = OriginHost
+	}
+
+	if ep != nil && report.Origin != OriginLocal {
+		report.problem("%s is the address of endpoint %s but is routed %s instead of to %s",
+			dst, ep.ID, report.Route, ep.HostInterface)
+	}
+	return nil
+}
+
+// tracePacket is the traffic netfilter rules are matched against. Unset
+// fields make the rules matching them undecided.
+type tracePacket struct {
+	src   net.IP
+	dst   net.IP
+	proto string
+	port  int
+	out   string
+}
+
+// matchAddress tells whether ip is in value, an address or a CIDR.
+func matchAddress(value string, ip net.IP) bool {
+	ipNet := ParseIpOrNet(value)
+	return ipNet != nil && ipNet.Contains(ip)
+}
+
+// matchRange tells whether ip is in value, a range of addresses.
+func matchRange(value string, ip net.IP) bool {
+	ipRange := ParseIPRange(value)
+	return ipRange != nil && ipRange.contains(ip)
+}
+
+// matchPort tells whether port is value, a port or a range of ports.
+func matchPort(value string, port int) bool {
+	bounds := strings.SplitN(value, ":", 2)
+	low, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return false
+	}
+	high := low
+	if len(bounds) == 2 {
+		if high, err = strconv.Atoi(bounds[1]); err != nil {
+			return false
+		}
+	}
+	return port >= low && port <= high
+}
+
+// matchInterface tells whether iface is value, where a trailing + matches
+// any suffix.
+func matchInterface(value string, iface string) bool {
+	if strings.HasSuffix(value, "+") {
+		return strings.HasPrefix(iface, strings.TrimSuffix(value, "+"))
+	}
+	return value == iface
+}
+
+// match tells whether p matches the conditions of rule, as printed by
+// iptables -S without the chain, and returns the target of the matching
+// rule. When a condition can't be evaluated, it is returned as undecided
+// and the rule does not match.
+func (p *tracePacket) match(rule []string) (matched bool, target string, undecided string) {
+	matched = true
+	negate := false
+	for i := 0; i < len(rule); i++ {
+		option := rule[i]
+		if option == "!" {
+			negate = true
+			continue
+		}
+		value := ""
+		if i+1 < len(rule) {
+			value = rule[i+1]
+			i++
+		}
+
+		result, known := true, true
+		switch option {
+		case "-s", "--source":
+			result, known = p.src != nil && matchAddress(value, p.src), p.src != nil
+		case "-d", "--destination":
+			result = matchAddress(value, p.dst)
+		case "-o", "--out-interface":
+			result, known = matchInterface(value, p.out), p.out != ""
+		case "-p", "--protocol":
+			result, known = value == "all" || value == p.proto, value == "all" || p.proto != ""
+		case "--dport", "--destination-port":
+			result, known = matchPort(value, p.port), p.port != 0
+		case "--src-range":
+			result, known = p.src != nil && matchRange(value, p.src), p.src != nil
+		case "--dst-range":
+			result = matchRange(value, p.dst)
+		case "-m", "--match":
+			// The module options follow
+		case "--comment":
+			// Quoted comments were split on spaces
+			for strings.HasPrefix(value, "\"") && !strings.HasSuffix(value, "\"") && i+1 < len(rule) {
+				i++
+				value = rule[i]
+			}
+		case "-j", "--jump", "-g", "--goto":
+			if !matched {
+				return false, "", ""
+			}
+			return true, value, ""
+		default:
+			known = false
+		}
+
+		if !known && matched {
+			undecided = option + " " + value
+			if negate {
+				undecided = "! " + undecided
+			}
+			return false, "", undecided
+		}
+		if known && result == negate {
+			matched = false
+		}
+		negate = false
+	}
+	return matched, "", ""
+}
+
+// walk evaluates the rules of chain for p, following the jumps. It returns
+// the verdict, or an empty string when the traffic returns from the chain.
+func (t *Tracer) walk(report *TraceReport, chain string, p *tracePacket, depth int) (string, error) {
+	if depth > maxChainDepth {
+		return "", fmt.Errorf("Too many jumps from %s, the chains loop", chain)
+	}
+	rules, err := listRules(t.fw, "filter", chain)
+	if err != nil {
+		return "", err
+	}
+	for _, rule := range rules {
+		matched, target, undecided := p.match(rule)
+		if undecided != "" {
+			report.note("Can't evaluate %s in %s: %s, the rule is assumed not to match",
+				undecided, chain, strings.Join(rule, " "))
+			continue
+		}
+		if !matched {
+			continue
+		}
+		report.Rules = append(report.Rules, chain+": "+strings.Join(rule, " "))
+
+		switch target {
+		case "ACCEPT", "DROP", "REJECT":
+			return target, nil
+		case "RETURN":
+			return "", nil
+		case "":
+			continue
+		}
+		if !t.fw.ChainExists(target) {
+			// LOG, MARK and the other non terminating targets
+			continue
+		}
+		verdict, err := t.walk(report, target, p, depth+1)
+		if err != nil {
+			return "", err
+		}
+		if verdict != "" || ruleOption(rule, "-g") != "" {
+			return verdict, nil
+		}
+	}
+	return "", nil
+}
+
+// traceFiltering walks the CONTAINERS chain, which filters the forwarded
+// traffic going to endpoints.
+func (t *Tracer) traceFiltering(report *TraceReport, p *tracePacket) {
+	forward, err := listRules(t.fw, "filter", "FORWARD")
+	if err != nil {
+		report.note("%v", err)
+	} else {
+		jumps := false
+		for _, rule := range forward {
+			jumps = jumps || ruleOption(rule, "-j") == containersChainName
+		}
+		if !jumps {
+			report.note("FORWARD doesn't jump to %s, containers are not filtered", containersChainName)
+		}
+	}
+
+	verdict, err := t.walk(report, containersChainName, p, 0)
+	if err != nil {
+		report.note("Can't evaluate the filtering: %v", err)
+		return
+	}
+	if verdict == "" {
+		verdict = VerdictReturn
+	}
+	report.Verdict = verdict
+	if verdict == "DROP" || verdict == "REJECT" {
+		source := "any source"
+		if p.src != nil {
+			source = p.src.String()
+		}
+		report.problem("Traffic from %s is stopped with %s by %s", source, verdict, report.Rules[len(report.Rules)-1])
+	}
+	if p.src == nil {
+		report.note("Give the source to evaluate the rules matching it")
+	}
+}
+
+// traceContainer lists the routes of the container of the endpoint and
+// checks it can answer src.
+func (t *Tracer) traceContainer(report *TraceReport, src net.IP) {
+	key := report.Endpoint.SandboxKey
+	if key == "" {
+		report.note("Endpoint %s has not joined a container", report.Endpoint.ID)
+		return
+	}
+	sb, err := t.nl.OpenSandbox(key)
+	if err != nil {
+		report.note("Can't open the namespace %s of the container: %v", key, err)
+		return
+	}
+	defer sb.Close()
+
+	links, err := sb.LinkList()
+	if err != nil {
+		report.note("Can't list the links of the container: %v", err)
+		return
+	}
+	routes, err := sb.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		report.note("Can't list the routes of the container: %v", err)
+		return
+	}
+	names := linkNames(links)
+	for i := range routes {
+		report.ContainerRoutes = append(report.ContainerRoutes, formatRoute(&routes[i], names))
+	}
+	if src != nil && lookupRoute(routes, src) == nil {
+		report.problem("The container has no route back to %s", src)
+	}
+}
@@ -0,0 +1,124 @@
+package routed
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+
+	netApi "github.com/docker/go-plugins-helpers/network"
+	"github.com/vishvananda/netlink"
+)
+
+func TestTrace(t *testing.T) {
+	netID := "c56656e6066544b3c0a42058fad46872fb55eb85bfcfb2217349cf4a1d847f4c"
+	eID := "4b50fb7f12adb0da3e6662148e9b1bc43b507ad2fd8a0f187ff297cbc88aee05"
+	sandBoxKey := "/var/run/docker/netns/68b0caca5d0c"
+
+	nl := newFakeNetlink()
+	sandbox := nl.addSandbox(sandBoxKey)
+	fw := newFakeIptables(containersChainName, containerRejectChainName, "FORWARD")
+	fw.Raw("-A", "FORWARD", "-j", containersChainName)
+	fw.Raw("-A", containerRejectChainName, "-p", "tcp", "-j", "REJECT", "--reject-with", "tcp-reset")
+	fw.Raw("-A", containerRejectChainName, "-j", "REJECT", "--reject-with", "icmp-port-unreachable")
+	d, _ := newNetDriver(nl, fw, newFakeSysctls(), newFakeTc(), "0.1", "10.100.0.1", 1500, "")
+	d.CreateNetwork(&netApi.CreateNetworkRequest{NetworkID: netID})
+	d.CreateEndpoint(&netApi.CreateEndpointRequest{
+		NetworkID:  netID,
+		EndpointID: eID,
+		Interface:  &netApi.EndpointInterface{Address: "10.1.0.2/32"},
+	})
+	res, _ := d.Join(&netApi.JoinRequest{NetworkID: netID, EndpointID: eID, SandboxKey: sandBoxKey})
+	if err := d.SetEndpointPolicy(eID, "10.2.0.0/16"); err != nil {
+		t.Fatalf("TestTrace failed: SetEndpointPolicy %v", err)
+	}
+	veth := d.networks[netID].endpoints[eID].hostInterfaceName
+
+	// Docker moves the container link and adds the routes of Join
+	nl.moveLink(res.InterfaceName.SrcName, sandbox, "eth0")
+	eth0, _ := sandbox.LinkByName("eth0")
+	_, gateway, _ := net.ParseCIDR("10.100.0.1/32")
+	sandbox.RouteAdd(&netlink.Route{LinkIndex: eth0.Attrs().Index, Dst: gateway})
+	sandbox.RouteAdd(&netlink.Route{LinkIndex: eth0.Attrs().Index, Gw: gateway.IP})
+
+	// A peer announces another block
+	uplink := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth1"}}
+	nl.LinkAdd(uplink)
+	nl.LinkSetUp(uplink)
+	_, block, _ := net.ParseCIDR("10.1.5.0/24")
+	nl.RouteAdd(&netlink.Route{LinkIndex: uplink.Index, Dst: block, Gw: net.ParseIP("10.0.0.2"), Protocol: syscall.RTPROT_ZEBRA})
+
+	tracer := newTracer(nl, fw, func() ([]EndpointState, error) {
+		return d.Networks()[0].Endpoints, nil
+	})
+
+	report, err := tracer.Trace(net.ParseIP("10.1.0.2"), net.ParseIP("10.2.3.4"), "tcp", 80)
+	if err != nil {
+		t.Fatalf("TestTrace failed: %v", err)
+	}
+	if report.Endpoint == nil || report.Endpoint.ID != eID || report.Origin != OriginLocal ||
+		report.Route != "10.1.0.2/32 dev "+veth || report.Interface != veth || report.InterfaceState != "up" {
+		t.Fatalf("TestTrace failed: wrong route %+v", report)
+	}
+	if report.Verdict != "ACCEPT" || len(report.Rules) != 2 ||
+		report.Rules[1] != "CONTAINER-"+veth+": -s 10.2.0.0/16 -j ACCEPT" {
+		t.Fatalf("TestTrace failed: wrong filtering %+v", report.Rules)
+	}
+	if len(report.ContainerRoutes) != 2 || report.ContainerRoutes[1] != "default via 10.100.0.1 dev eth0" {
+		t.Fatalf("TestTrace failed: wrong container routes %+v", report.ContainerRoutes)
+	}
+	if len(report.Problems) != 0 || len(report.Notes) != 0 {
+		t.Fatalf("TestTrace failed: problems %+v notes %+v", report.Problems, report.Notes)
+	}
+
+	// Rejected source, down veth
+	link, _ := nl.LinkByName(veth)
+	nl.LinkSetDown(link)
+	report, _ = tracer.Trace(net.ParseIP("10.1.0.2"), net.ParseIP("10.9.0.1"), "udp", 53)
+	if report.Verdict != "REJECT" || len(report.Rules) != 3 || len(report.Problems) != 2 || len(report.Notes) != 0 {
+		t.Fatalf("TestTrace failed: wrong rejected trace %+v", report)
+	}
+	nl.LinkSetUp(link)
+
+	// Peer block
+	report, _ = tracer.Trace(net.ParseIP("10.1.5.3"), nil, "", 0)
+	if report.Endpoint != nil || report.Origin != OriginPeer || report.Interface != "eth1" ||
+		report.Route != "10.1.5.0/24 via 10.0.0.2 dev eth1 proto zebra" || len(report.Rules) != 0 {
+		t.Fatalf("TestTrace failed: wrong peer trace %+v", report)
+	}
+
+	// No route, and the plugin doesn't answer
+	tracer.endpoints = func() ([]EndpointState, error) {
+		return nil, fmt.Errorf("connection refused")
+	}
+	report, _ = tracer.Trace(net.ParseIP("192.168.1.1"), nil, "", 0)
+	if report.Origin != OriginNone || len(report.Problems) != 1 || len(report.Notes) != 1 {
+		t.Fatalf("TestTrace failed: wrong trace without route %+v", report)
+	}
+}
+
+func TestTraceRuleMatch(t *testing.T) {
+	p := &tracePacket{src: net.ParseIP("10.2.0.5"), dst: net.ParseIP("10.1.0.2"), proto: "tcp", port: 8080, out: "vethr1234"}
+	for _, c := range []struct {
+		rule      string
+		matched   bool
+		target    string
+		undecided string
+	}{
+		{"-o vethr1234 -j CONTAINER-vethr1234", true, "CONTAINER-vethr1234", ""},
+		{"-o vethr+ -j ACCEPT", true, "ACCEPT", ""},
+		{"! -s 10.2.0.0/16 -j ACCEPT", false, "", ""},
+		{"-d 10.1.0.2/32 -p tcp -m tcp --dport 8000:9000 -j ACCEPT", true, "ACCEPT", ""},
+		{"-p udp -j ACCEPT", false, "", ""},
+		{"-m iprange --src-range 10.2.0.1-10.2.0.9 -m comment --comment \"allowed sources\" -j ACCEPT", true, "ACCEPT", ""},
+		{"-i eth0 -j DROP", false, "", "-i eth0"},
+		{"-p udp -i eth0 -j DROP", false, "", ""},
+		{"-m conntrack ! --ctstate NEW -j ACCEPT", false, "", "! --ctstate NEW"},
+	} {
+		matched, target, undecided := p.match(strings.Fields(c.rule))
+		if matched != c.matched || target != c.target || undecided != c.undecided {
+			t.Fatalf("TestTraceRuleMatch failed: %s gave %v %q %q", c.rule, matched, target, undecided)
+		}
+	}
+}
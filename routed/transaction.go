@@ -0,0 +1,54 @@
+package routed
+
+import (
+	"fmt"
+)
+
+// transaction runs a sequence of named steps, undoing the steps already
+// done in reverse order when one of them fails.
+type transaction struct {
+	name    string
+	steps   []transactionStep
+	metrics *Metrics
+	log     *callLog
+}
+
+type transactionStep struct {
+	name string
+	undo func() error
+}
+
+// newTransaction creates a transaction counting its failed steps in m and
+// logging them with the fields of l, both of which may be nil.
+func newTransaction(name string, m *Metrics, l *callLog) *transaction {
+	return &transaction{name: name, metrics: m, log: l}
+}
+
+// run performs a step. undo reverts it and may be nil when there is nothing
+// to revert, or when reverting an earlier step reverts it too. On failure
+// the transaction is rolled back and the error names the failed step.
+func (t *transaction) run(name string, do func() error, undo func() error) error {
+	t.log.at(name).Debugf("%s: %s", t.name, name)
+	if err := do(); err != nil {
+		t.log.at(name).Errorf("%s: %s failed: %v", t.name, name, err)
+		t.metrics.stepFailed(t.name, name)
+		t.rollback()
+		return fmt.Errorf("%s failed at step %s: %v", t.name, name, err)
+	}
+	t.steps = append(t.steps, transactionStep{name: name, undo: undo})
+	return nil
+}
+
+func (t *transaction) rollback() {
+	for i := len(t.steps) - 1; i >= 0; i-- {
+		step := t.steps[i]
+		if step.undo == nil {
+			continue
+		}
+		t.log.at(step.name).Infof("%s: Undoing %s", t.name, step.name)
+		if err := step.undo(); err != nil {
+			t.log.at(step.name).Warnf("%s: Couldn't undo %s: %v", t.name, step.name, err)
+		}
+	}
+	t.steps = nil
+}
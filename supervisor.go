@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/medallia/cnm-routed-plugin/routed"
+	"github.com/urfave/cli"
+)
+
+const (
+	defaultShutdownTimeout = 30 * time.Second
+
+	// Time the plugin sockets have to show up after starting
+	listenTimeout = 10 * time.Second
+	listenPoll    = 50 * time.Millisecond
+)
+
+// supervisor runs the plugin servers until a signal or a failure, then
+// stops the plugin in order: it waits for the calls in progress, drains the
+// container routes, writes the state and removes the sockets.
+type supervisor struct {
+	ipam            *routed.IpamDriver
+	net             *routed.NetDriver
+	config          *configFile
+	gate            *routed.Gate
+	stateFile       string
+	shutdownTimeout time.Duration
+	drainGrace      time.Duration
+	// Plugin sockets, waited for at startup
+	plugins []string
+	// Other socket files removed on exit
+	sockets []string
+	// Metrics and admin API listeners, closed on exit
+	listeners []net.Listener
+	// Closed on shutdown, stops the background loops
+	done   chan struct{}
+	failed chan error
+	// Signals received since the supervisor was created
+	stop    chan os.Signal
+	hangups chan os.Signal
+}
+
+// newSupervisor creates a supervisor, catching the signals from then on so
+// that none is missed while the servers start.
+func newSupervisor(ipam *routed.IpamDriver, net *routed.NetDriver, config *configFile) *supervisor {
+	s := &supervisor{
+		ipam:            ipam,
+		net:             net,
+		config:          config,
+		gate:            routed.NewGate(),
+		shutdownTimeout: defaultShutdownTimeout,
+		done:            make(chan struct{}),
+		failed:          make(chan error, 4),
+		stop:            make(chan os.Signal, 2),
+		hangups:         make(chan os.Signal, 1),
+	}
+	signal.Notify(s.stop, syscall.SIGTERM, syscall.SIGINT)
+	signal.Notify(s.hangups, syscall.SIGHUP)
+	return s
+}
+
+// serve runs a plugin server on the socket named name. The server stopping
+// for any reason stops the plugin.
+func (s *supervisor) serve(kind string, name string, serveUnix func(systemGroup string, addr string) error) {
+	path := routed.PluginSocket(name)
+	// A socket left by a previous run would pass for this one
+	if err := os.Remove(path); err == nil {
+		log.Infof("serve: Removed stale %s socket %s", kind, path)
+	}
+	s.plugins = append(s.plugins, path)
+
+	go func() {
+		if err := serveUnix("root", name); err != nil {
+			s.failed <- fmt.Errorf("The %s plugin on %s stopped: %v", kind, path, err)
+			return
+		}
+		s.failed <- fmt.Errorf("The %s plugin on %s stopped", kind, path)
+	}()
+}
+
+// listen serves l, bound at startup. The server stopping before the
+// shutdown stops the plugin.
+func (s *supervisor) listen(kind string, l net.Listener, serve func(l net.Listener) error) {
+	s.listeners = append(s.listeners, l)
+
+	go func() {
+		err := serve(l)
+		select {
+		case <-s.done:
+			// Closed by the shutdown
+		default:
+			s.failed <- fmt.Errorf("The %s on %s stopped: %v", kind, l.Addr(), err)
+		}
+	}()
+}
+
+// bounded runs a shutdown step, giving up after timeout. A plugin call stuck
+// with the network lock would block it for good.
+func bounded(step string, timeout time.Duration, run func() error) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- run()
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("%s didn't finish in %s", step, timeout)
+	}
+}
+
+// listening waits until the plugin sockets show up.
+func (s *supervisor) listening() error {
+	deadline := time.Now().Add(listenTimeout)
+	for _, path := range s.plugins {
+		for {
+			if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+				break
+			}
+			select {
+			case err := <-s.failed:
+				return err
+			case <-time.After(listenPoll):
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("Socket %s didn't show up in %s", path, listenTimeout)
+			}
+		}
+	}
+	return nil
+}
+
+// run supervises the plugin until it stops, and returns the exit status.
+func (s *supervisor) run() error {
+	if err := s.listening(); err != nil {
+		log.Errorf("run: %v", err)
+		s.shutdown()
+		return cli.NewExitError(err.Error(), exitStartupFailed)
+	}
+	log.Infof("run: Serving the plugins on %s", strings.Join(s.plugins, ", "))
+
+	for {
+		select {
+		case <-s.hangups:
+			if err := s.config.reload(s.net); err != nil {
+				log.Errorf("run: Configuration not reloaded: %v", err)
+			}
+		case sig := <-s.stop:
+			log.Infof("run: Stopping on %s", sig)
+			go func() {
+				sig := <-s.stop
+				log.Errorf("run: Stopped on %s before finishing the shutdown", sig)
+				os.Exit(exitUnclean)
+			}()
+			if err := s.shutdown(); err != nil {
+				return cli.NewExitError(err.Error(), exitUnclean)
+			}
+			log.Infof("run: Stopped")
+			return nil
+		case err := <-s.failed:
+			log.Errorf("run: %v", err)
+			s.shutdown()
+			return cli.NewExitError(err.Error(), exitUnclean)
+		}
+	}
+}
+
+// shutdown stops the plugin in order. Every step is attempted, the error
+// tells the first that failed.
+func (s *supervisor) shutdown() error {
+	var failure error
+	failed := func(err error) {
+		log.Errorf("shutdown: %v", err)
+		if failure == nil {
+			failure = err
+		}
+	}
+
+	if active := s.gate.Close(s.shutdownTimeout); active > 0 {
+		failed(fmt.Errorf("%d plugin calls still in progress after %s", active, s.shutdownTimeout))
+	}
+	close(s.done)
+
+	// Takes down the container routes as set with --drain-mode
+	if err := bounded("Drain", s.shutdownTimeout+s.drainGrace, func() error {
+		s.net.Drain()
+		return nil
+	}); err != nil {
+		failed(err)
+	}
+
+	if s.stateFile != "" {
+		if err := bounded("Writing the state", s.shutdownTimeout, func() error {
+			return routed.WriteState(s.stateFile, s.ipam, s.net)
+		}); err != nil {
+			failed(err)
+		} else {
+			log.Infof("shutdown: Wrote state to %s", s.stateFile)
+		}
+	}
+
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	for _, path := range append(s.plugins, s.sockets...) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			failed(fmt.Errorf("Couldn't remove socket %s: %v", path, err))
+		}
+	}
+	return failure
+}